@@ -0,0 +1,115 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/vault"
+	"github.com/stretchr/testify/require"
+
+	gitlabtoken "github.com/splunk/vault-plugin-secrets-gitlab/plugin"
+)
+
+const (
+	mountPath = "gitlab"
+	projectID = 1
+)
+
+// testCluster is a Vault cluster with the backend mounted at mountPath
+type testCluster struct {
+	*vault.TestCluster
+
+	mu sync.Mutex
+	// backends are the backends the cluster created, in order. A node creates its backend when it
+	// becomes active.
+	backends []*gitlabtoken.GitlabBackend
+}
+
+func newTestCluster(t *testing.T, numCores int) *testCluster {
+	t.Helper()
+	c := &testCluster{}
+	factory := func(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
+		b, err := gitlabtoken.Factory(ctx, conf)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.backends = append(c.backends, b.(*gitlabtoken.GitlabBackend))
+		return b, nil
+	}
+
+	c.TestCluster = vault.NewTestCluster(t, &vault.CoreConfig{
+		LogicalBackends: map[string]logical.Factory{mountPath: factory},
+		// the raw storage endpoint changes the config behind the backend, as replication would
+		EnableRaw: true,
+	}, &vault.TestClusterOptions{
+		HandlerFunc: vaulthttp.Handler,
+		NumCores:    numCores,
+	})
+	c.Start()
+	t.Cleanup(c.Cleanup)
+	vault.TestWaitActive(t, c.Cores[0].Core)
+
+	err := c.Cores[0].Client.Sys().Mount(mountPath, &api.MountInput{Type: mountPath})
+	require.NoError(t, err)
+	return c
+}
+
+// backend returns the backend of the node that became active last
+func (c *testCluster) backend(t *testing.T) *gitlabtoken.GitlabBackend {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	require.NotEmpty(t, c.backends, "no backend has been created")
+	return c.backends[len(c.backends)-1]
+}
+
+// configure writes the config and a role for projectID, named role
+func configure(t *testing.T, client *api.Client, gitlab *fakeGitlab, role string, roleData map[string]interface{}) {
+	t.Helper()
+	_, err := client.Logical().Write(mountPath+"/config", map[string]interface{}{
+		"base_url": gitlab.URL,
+		"token":    gitlab.token,
+	})
+	require.NoError(t, err)
+
+	data := map[string]interface{}{
+		"id":         projectID,
+		"name":       role + "-token",
+		"scopes":     []string{"read_api"},
+		"token_type": "project",
+	}
+	for k, v := range roleData {
+		data[k] = v
+	}
+	_, err = client.Logical().Write(mountPath+"/roles/"+role, data)
+	require.NoError(t, err)
+}
+
+// issue requests a token of role and returns the response
+func issue(t *testing.T, client *api.Client, role string) *api.Secret {
+	t.Helper()
+	secret, err := client.Logical().Write(mountPath+"/token/"+role, nil)
+	require.NoError(t, err)
+	require.NotNil(t, secret)
+	return secret
+}
@@ -0,0 +1,20 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package integration runs the backend in an in-process Vault test cluster, driven through the Vault
+// api client against a stand-in Gitlab. It covers what the unit tests cannot: response wrapping and
+// leases handled by Vault, config invalidation, and requests to standby nodes.
+//
+// It is a separate module, so that the dependency on Vault itself stays out of the plugin.
+package integration
@@ -0,0 +1,137 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var accessTokensPath = regexp.MustCompile(`^/api/v4/projects/(\d+)/access_tokens(?:/(\d+))?$`)
+
+// fakeGitlab serves the project access tokens API, which is all the tests issue and revoke tokens with
+type fakeGitlab struct {
+	*httptest.Server
+	// token is the Gitlab token requests must carry
+	token string
+
+	mu     sync.Mutex
+	nextID int
+	// tokens are the access tokens of each project
+	tokens map[int][]map[string]interface{}
+}
+
+func newFakeGitlab(t *testing.T, token string) *fakeGitlab {
+	t.Helper()
+	g := &fakeGitlab{token: token, nextID: 1, tokens: map[int][]map[string]interface{}{}}
+	g.Server = httptest.NewServer(http.HandlerFunc(g.serve))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *fakeGitlab) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("PRIVATE-TOKEN") != g.token {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "401 Unauthorized"})
+		return
+	}
+	m := accessTokensPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Not Found"})
+		return
+	}
+	projectID, _ := strconv.Atoi(m[1])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && m[2] == "":
+		tokens := g.tokens[projectID]
+		if tokens == nil {
+			tokens = []map[string]interface{}{}
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	case r.Method == http.MethodPost && m[2] == "":
+		var opt map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&opt); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		id := g.nextID
+		g.nextID++
+		token := map[string]interface{}{
+			"id":           id,
+			"name":         opt["name"],
+			"scopes":       opt["scopes"],
+			"user_id":      1000 + id,
+			"active":       true,
+			"revoked":      false,
+			"access_level": 40,
+			"created_at":   time.Now().UTC().Format(time.RFC3339),
+			"expires_at":   opt["expires_at"],
+		}
+		g.tokens[projectID] = append(g.tokens[projectID], token)
+		created := map[string]interface{}{"token": fmt.Sprintf("glpat-%d", id)}
+		for k, v := range token {
+			created[k] = v
+		}
+		writeJSON(w, http.StatusCreated, created)
+	case r.Method == http.MethodDelete && m[2] != "":
+		tokenID, _ := strconv.Atoi(m[2])
+		for _, token := range g.tokens[projectID] {
+			if token["id"] == tokenID {
+				token["active"] = false
+				token["revoked"] = true
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Not Found"})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "405 Method Not Allowed"})
+	}
+}
+
+// issued returns the number of tokens created in the project
+func (g *fakeGitlab) issued(projectID int) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.tokens[projectID])
+}
+
+// active returns the number of tokens of the project that have not been revoked
+func (g *fakeGitlab) active(projectID int) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, token := range g.tokens[projectID] {
+		if token["active"] == true {
+			n++
+		}
+	}
+	return n
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/helper/testhelpers"
+	"github.com/hashicorp/vault/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseExpiry(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	client := cluster.Cores[0].Client
+	gitlab := newFakeGitlab(t, "backend-token")
+	configure(t, client, gitlab, "plain", nil)
+	configure(t, client, gitlab, "wrapped", map[string]interface{}{"wrap_ttl": "2s"})
+
+	t.Run("tokens are not leased", func(t *testing.T) {
+		// tokens expire in Gitlab, there is no Vault lease to renew or revoke
+		secret := issue(t, client, "plain")
+		assert.Empty(t, secret.LeaseID)
+		assert.Zero(t, secret.LeaseDuration)
+		assert.False(t, secret.Renewable)
+		assert.NotEmpty(t, secret.Data["token"])
+	})
+
+	t.Run("wrapped token unwraps before the wrap TTL", func(t *testing.T) {
+		secret := issue(t, client, "wrapped")
+		require.NotNil(t, secret.WrapInfo)
+		assert.Equal(t, 2, secret.WrapInfo.TTL)
+		assert.Nil(t, secret.Data)
+
+		unwrapped, err := client.Logical().Unwrap(secret.WrapInfo.Token)
+		require.NoError(t, err)
+		require.NotNil(t, unwrapped)
+		assert.NotEmpty(t, unwrapped.Data["token"])
+
+		// a wrapping token is single use
+		_, err = client.Logical().Unwrap(secret.WrapInfo.Token)
+		assert.Error(t, err)
+	})
+
+	t.Run("wrapped token expires with the wrap TTL", func(t *testing.T) {
+		secret := issue(t, client, "wrapped")
+		require.NotNil(t, secret.WrapInfo)
+
+		// looking the wrapping token up does not use it
+		lookup := map[string]interface{}{"token": secret.WrapInfo.Token}
+		_, err := client.Logical().Write("sys/wrapping/lookup", lookup)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			_, err := client.Logical().Write("sys/wrapping/lookup", lookup)
+			return err != nil
+		}, 10*time.Second, 250*time.Millisecond)
+		_, err = client.Logical().Unwrap(secret.WrapInfo.Token)
+		assert.Error(t, err)
+		// the token was created in Gitlab all the same, and left to expire there
+		assert.Equal(t, 3, gitlab.issued(projectID))
+	})
+}
+
+func TestInvalidateConfig(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	client := cluster.Cores[0].Client
+	before := newFakeGitlab(t, "before-token")
+	after := newFakeGitlab(t, "after-token")
+	configure(t, client, before, "role", nil)
+
+	issue(t, client, "role")
+	require.Equal(t, 1, before.issued(projectID))
+
+	// the config is changed in storage, behind the backend, as replication changes it on another cluster
+	mounts, err := client.Sys().ListMounts()
+	require.NoError(t, err)
+	rawPath := fmt.Sprintf("sys/raw/logical/%s/config", mounts[mountPath+"/"].UUID)
+	raw, err := client.Logical().Read(rawPath)
+	require.NoError(t, err)
+	require.NotNil(t, raw)
+	var config map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(raw.Data["value"].(string)), &config))
+	config["base_url"] = after.URL
+	config["token"] = after.token
+	value, err := json.Marshal(config)
+	require.NoError(t, err)
+	_, err = client.Logical().Write(rawPath, map[string]interface{}{"value": string(value)})
+	require.NoError(t, err)
+
+	// the cached Gitlab client still calls the previous Gitlab until the config is invalidated
+	issue(t, client, "role")
+	assert.Equal(t, 2, before.issued(projectID))
+	assert.Equal(t, 0, after.issued(projectID))
+
+	cluster.backend(t).InvalidateKey(context.Background(), "config")
+	issue(t, client, "role")
+	assert.Equal(t, 2, before.issued(projectID))
+	assert.Equal(t, 1, after.issued(projectID))
+}
+
+func TestStandby(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	active := testhelpers.DeriveStableActiveCore(t, cluster.TestCluster)
+	var standby *vault.TestClusterCore
+	for _, core := range cluster.Cores {
+		if core != active {
+			standby = core
+			break
+		}
+	}
+	gitlab := newFakeGitlab(t, "backend-token")
+
+	t.Run("requests to a standby are forwarded", func(t *testing.T) {
+		configure(t, standby.Client, gitlab, "role", nil)
+		secret := issue(t, standby.Client, "role")
+		assert.NotEmpty(t, secret.Data["token"])
+		assert.Equal(t, 1, gitlab.issued(projectID))
+	})
+
+	t.Run("a new active node takes over", func(t *testing.T) {
+		require.NoError(t, active.Client.Sys().StepDown())
+		var next *vault.TestClusterCore
+		require.Eventually(t, func() bool {
+			next = testhelpers.WaitForActiveNode(t, cluster.TestCluster)
+			return next != active
+		}, 30*time.Second, time.Second)
+		testhelpers.EnsureStableActiveNode(t, cluster.TestCluster)
+
+		secret := issue(t, next.Client, "role")
+		assert.NotEmpty(t, secret.Data["token"])
+		assert.Equal(t, 2, gitlab.issued(projectID))
+
+		// the inventory written by the previous active node is kept
+		list, err := next.Client.Logical().List(mountPath + "/tokens")
+		require.NoError(t, err)
+		require.NotNil(t, list)
+		assert.Len(t, list.Data["keys"], 2)
+
+		// and its tokens can be revoked from the new one
+		_, err = next.Client.Logical().Write(fmt.Sprintf("%s/revoke/project/%d", mountPath, projectID), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 0, gitlab.active(projectID))
+	})
+}
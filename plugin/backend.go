@@ -16,10 +16,14 @@ package gitlabtoken
 
 import (
 	"context"
+	"errors"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
@@ -31,38 +35,85 @@ type GitlabBackend struct {
 	client    Client
 	lock      sync.RWMutex
 	roleLocks []*locksutil.LockEntry
+	// templateLock is held for writing while role templates change, and for reading while roles are
+	// validated against their template
+	templateLock sync.RWMutex
+	// configLock serializes config writes and the creation of the Gitlab client, including the rotation
+	// of the oauth refresh token. It is taken before lock, never after.
+	configLock sync.Mutex
+	// newClient creates the Gitlab client from the config
+	newClient func(config *ConfigStorageEntry, logger hclog.Logger) (Client, error)
+
+	lastInventoryPrune time.Time
 }
 
 func (b *GitlabBackend) getClient(ctx context.Context, s logical.Storage) (Client, error) {
-	b.lock.RLock()
-	unlockFunc := b.lock.RUnlock
-	defer func() { unlockFunc() }()
-
-	if b.client != nil && b.client.Valid() {
-		return b.client, nil
+	if c := b.cachedClient(); c != nil {
+		emitClientCache(true)
+		return c, nil
 	}
 
-	b.lock.RUnlock()
-	b.lock.Lock()
-	unlockFunc = b.lock.Unlock
+	// the credential is obtained under configLock only, so that requests served by the cached client are
+	// not held up by the calls to Gitlab or to the identity token exchange
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
 
-	if b.client != nil && b.client.Valid() {
-		return b.client, nil
+	// another request may have created the client while this one waited for configLock
+	if c := b.cachedClient(); c != nil {
+		emitClientCache(true)
+		return c, nil
 	}
+	emitClientCache(false)
 
 	config, err := getConfig(ctx, s)
 	if err != nil {
 		return nil, err
 	}
+	if config != nil {
+		provider := b.credentialProvider(config)
+		if config.credential, err = provider.credential(ctx, s, config); err != nil {
+			return nil, err
+		}
+		b.Logger().Debug("obtained gitlab credential", "provider", provider.name())
+	}
 
-	c, err := NewClient(config)
+	c, err := b.newClient(config, b.Logger().Named("gitlab"))
 	if err != nil {
 		return nil, err
 	}
+	b.lock.Lock()
 	b.client = c
+	b.lock.Unlock()
 
 	return c, nil
 }
+
+// cachedClient returns the cached Gitlab client, or nil if there is none that is still valid
+func (b *GitlabBackend) cachedClient() Client {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.client != nil && b.client.Valid() {
+		return b.client
+	}
+	return nil
+}
+
+// clientErrorResponse answers a request that could not get a Gitlab client. ErrReadOnly is returned as
+// is, for Vault to forward the request to the active node.
+func clientErrorResponse(err error) (*logical.Response, error) {
+	if errors.Is(err, logical.ErrReadOnly) {
+		return nil, err
+	}
+	return logical.ErrorResponse("failed to obtain gitlab client - %s", err.Error()), nil
+}
+
+// requestLogger returns a logger whose entries carry the Vault request ID and the given fields, so they can
+// be matched with the audit log and with Gitlab's logs
+func (b *GitlabBackend) requestLogger(req *logical.Request, args ...interface{}) hclog.Logger {
+	return b.Logger().With(append([]interface{}{"request_id", req.ID}, args...)...)
+}
+
 func (b *GitlabBackend) reset() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -72,9 +123,37 @@ func (b *GitlabBackend) reset() {
 func (b *GitlabBackend) invalidate(ctx context.Context, key string) {
 	switch key {
 	case pathPatternConfig:
+		// a client being created from the previous config is swapped in before it is dropped
+		b.configLock.Lock()
+		defer b.configLock.Unlock()
 		b.reset()
 	}
 }
+func (b *GitlabBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// storage is read-only on performance standbys. Performance secondaries can only write their local
+	// storage, which holds the token inventory, and leave roles to the primary cluster.
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+	if !replicationState.HasState(consts.ReplicationPerformanceSecondary) {
+		if err := b.finalizeDeletingRoles(ctx, req.Storage); err != nil {
+			return err
+		}
+	}
+
+	if time.Since(b.lastInventoryPrune) < inventoryPruneInterval {
+		return nil
+	}
+	if err := b.pruneTokenInventory(ctx, req.Storage); err != nil {
+		return err
+	}
+	if err := b.pruneTokenCache(ctx, req.Storage); err != nil {
+		return err
+	}
+	b.lastInventoryPrune = time.Now()
+	return nil
+}
 
 // Factory is factory for backend
 func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, error) {
@@ -89,6 +168,7 @@ func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, er
 func Backend(conf *logical.BackendConfig) *GitlabBackend {
 	backend := &GitlabBackend{
 		view:      conf.StorageView,
+		newClient: NewClient,
 		roleLocks: locksutil.CreateLocks(),
 	}
 
@@ -100,9 +180,31 @@ func Backend(conf *logical.BackendConfig) *GitlabBackend {
 			pathToken(backend),
 			pathRole(backend),
 			pathRoleList(backend),
+			pathRoleBulk(backend),
+			pathRoleTemplate(backend),
+			pathRoleTemplateList(backend),
 			pathRoleToken(backend),
+			pathTokenInventory(backend),
+			pathRevoke(backend),
 		),
-		Invalidate: backend.invalidate,
+		PathsSpecial: &logical.Paths{
+			// credentials: the Gitlab token in config, and the cached tokens
+			SealWrapStorage: []string{
+				pathPatternConfig,
+				pathPatternTokenCache + "/",
+			},
+			// tokens are tracked by the cluster that issued them, so role quotas are enforced by each cluster
+			// on its own tokens and issuances
+			LocalStorage: []string{
+				pathPatternTokens + "/",
+				pathPatternTokensByRole + "/",
+				pathPatternRoleUsage + "/",
+				pathPatternTokenCache + "/",
+			},
+		},
+		InitializeFunc: backend.initialize,
+		Invalidate:     backend.invalidate,
+		PeriodicFunc:   backend.periodicFunc,
 	}
 
 	return backend
@@ -115,4 +217,5 @@ Gitlab resources without needing to create or manage a static project access tok
 
 After mounting this secrets engine, you can configure the credentials using the
 "config/" endpoints. You can generate project access tokens using the "token/" endpoints. 
+Every issued token is recorded and can be looked up using the "tokens/" endpoints.
 `
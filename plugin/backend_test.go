@@ -16,9 +16,17 @@ package gitlabtoken
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -32,7 +40,15 @@ func getTestBackend(t *testing.T, mockGitlab bool) (logical.Backend, logical.Sto
 	require.NoError(t, err, "unable to create backend")
 
 	if mockGitlab {
-		b.(*GitlabBackend).client = &mockGitlabClient{}
+		// the mock outlives config changes, as long as the config is valid
+		mock := &mockGitlabClient{}
+		b.(*GitlabBackend).client = mock
+		b.(*GitlabBackend).newClient = func(config *ConfigStorageEntry, logger hclog.Logger) (Client, error) {
+			if _, err := NewClient(config, logger); err != nil {
+				return nil, err
+			}
+			return mock, nil
+		}
 	}
 
 	return b, config.StorageView
@@ -55,3 +71,502 @@ func newGitlabAccEnv(t *testing.T) (*logical.Request, logical.Backend) {
 	}
 	return req, backend
 }
+
+// newGitlabFakeEnv returns a backend configured against a fake Gitlab
+func newGitlabFakeEnv(t *testing.T) (*logical.Request, logical.Backend, *fakeGitlab) {
+	t.Helper()
+
+	fg := newFakeGitlab(t)
+	backend, storage := getTestBackend(t, false)
+	testConfigUpdate(t, backend, storage, fg.config())
+
+	req := &logical.Request{
+		Storage: storage,
+	}
+	return req, backend, fg
+}
+
+// responseStatus returns the HTTP status code Vault would answer a request with
+func responseStatus(resp *logical.Response, err error) int {
+	code, codeErr := logical.RespondErrorCommon(&logical.Request{Operation: logical.UpdateOperation}, resp, err)
+	logical.AdjustErrorStatusCode(&code, codeErr)
+	if code == 0 {
+		return http.StatusOK
+	}
+	return code
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabFakeEnv(t)
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	fg.addGroup(2, "team", accessLevelOwner)
+
+	mustRoleCreate(t, backend, req.Storage, "app", map[string]interface{}{
+		"id":           1,
+		"name":         "app-ci",
+		"scopes":       "read_api,read_repository",
+		"access_level": "reporter",
+		"verify":       true,
+	})
+	mustRoleCreate(t, backend, req.Storage, "team", map[string]interface{}{
+		"token_type":       tokenTypeGroup,
+		"id":               2,
+		"name":             "team-ci",
+		"scopes":           "api",
+		"access_level":     "owner",
+		"revoke_on_delete": true,
+	})
+
+	issue := func(roleName string) int {
+		t.Helper()
+		resp, err := testIssueRoleToken(t, backend, req, roleName, nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		return resp.Data["id"].(int)
+	}
+
+	app1 := issue("app")
+	app2 := issue("app")
+	team := issue("team")
+	resp, err := testIssueToken(t, backend, req, map[string]interface{}{
+		"id":     1,
+		"name":   "adhoc",
+		"scopes": []string{"read_registry"},
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+	adhoc := resp.Data["id"].(int)
+
+	t.Run("create", func(t *testing.T) {
+		assert.Equal(t, []int{app1, app2, adhoc}, fg.activeTokens(tokenTypeProject, 1))
+		assert.Equal(t, []int{team}, fg.activeTokens(tokenTypeGroup, 2))
+
+		token, ok := fg.token(app1)
+		require.True(t, ok)
+		assert.Equal(t, "app-ci", token.Name)
+		assert.Equal(t, []string{"read_api", "read_repository"}, token.Scopes)
+		assert.Equal(t, accessLevelReporter, token.AccessLevel)
+		require.NotNil(t, token.ExpiresAt)
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), *token.ExpiresAt, 24*time.Hour)
+
+		token, ok = fg.token(adhoc)
+		require.True(t, ok)
+		assert.Equal(t, accessLevelMaintainer, token.AccessLevel, "Gitlab defaults to Maintainer")
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp, err := testTokenInventoryList(t, backend, req.Storage)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		assert.ElementsMatch(t, []string{
+			strconv.Itoa(app1), strconv.Itoa(app2), strconv.Itoa(team), strconv.Itoa(adhoc),
+		}, resp.Data["keys"])
+
+		resp, err = testTokenInventoryRead(t, backend, req.Storage, team)
+		require.NoError(t, err)
+		assert.Equal(t, tokenTypeGroup, resp.Data["token_type"])
+		assert.Equal(t, "team", resp.Data["role_name"])
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		resp, err := testTokenRotate(t, backend, req.Storage, app2)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		rotated := resp.Data["id"].(int)
+		assert.NotEqual(t, app2, rotated)
+		assert.Equal(t, app2, resp.Data["rotated_token_id"])
+		assert.Equal(t, "glpat-fake-"+strconv.Itoa(rotated), resp.Data["token"])
+		assert.Equal(t, []int{app1, adhoc, rotated}, fg.activeTokens(tokenTypeProject, 1))
+
+		token, ok := fg.token(rotated)
+		require.True(t, ok)
+		assert.Equal(t, "app-ci", token.Name)
+		assert.Equal(t, []string{"read_api", "read_repository"}, token.Scopes)
+		assert.Equal(t, accessLevelReporter, token.AccessLevel)
+
+		resp, err = testTokenInventoryRead(t, backend, req.Storage, app2)
+		require.NoError(t, err)
+		assert.Equal(t, tokenStatusRevoked, resp.Data["status"])
+		resp, err = testTokenInventoryRead(t, backend, req.Storage, rotated)
+		require.NoError(t, err)
+		assert.Equal(t, tokenStatusActive, resp.Data["status"])
+		assert.Equal(t, "app", resp.Data["role_name"])
+
+		resp, err = testTokenRotate(t, backend, req.Storage, app2)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "is revoked and cannot be rotated")
+
+		resp, err = testTokenRotate(t, backend, req.Storage, team)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		team = resp.Data["id"].(int)
+		assert.Equal(t, []int{team}, fg.activeTokens(tokenTypeGroup, 2))
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		resp, err := testRevoke(t, backend, req.Storage, "role/app", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		assert.Equal(t, 2, resp.Data["revoked"])
+		assert.Equal(t, []int{adhoc}, fg.activeTokens(tokenTypeProject, 1))
+
+		resp, err = testRevoke(t, backend, req.Storage, "project/1", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, resp.Data["revoked"])
+		assert.Empty(t, fg.activeTokens(tokenTypeProject, 1))
+
+		resp, err = testTokenInventoryRead(t, backend, req.Storage, app1)
+		require.NoError(t, err)
+		assert.Equal(t, tokenStatusRevoked, resp.Data["status"])
+	})
+
+	t.Run("revoke on role delete", func(t *testing.T) {
+		resp, err := testRoleDelete(t, backend, req.Storage, "team")
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError())
+		assert.Empty(t, fg.activeTokens(tokenTypeGroup, 2))
+	})
+}
+
+func TestFakeGitlabRevokeNotFound(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabFakeEnv(t)
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	fg.addGroup(2, "team", accessLevelOwner)
+	mustRoleCreate(t, backend, req.Storage, "app", map[string]interface{}{
+		"id": 1, "name": "app-ci", "scopes": "api",
+	})
+	mustRoleCreate(t, backend, req.Storage, "team", map[string]interface{}{
+		"token_type": tokenTypeGroup, "id": 2, "name": "team-ci", "scopes": "api",
+	})
+
+	issue := func(roleName string) int {
+		t.Helper()
+		resp, err := testIssueRoleToken(t, backend, req, roleName, nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		return resp.Data["id"].(int)
+	}
+
+	t.Run("project hidden from the backend", func(t *testing.T) {
+		id := issue("app")
+		fg.setBackendAccess(tokenTypeProject, 1, 0)
+		defer fg.setBackendAccess(tokenTypeProject, 1, accessLevelMaintainer)
+
+		resp, err := testRevoke(t, backend, req.Storage, "role/app", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		assert.Equal(t, 0, resp.Data["revoked"])
+		assert.Equal(t, 1, resp.Data["failed"])
+		assert.Equal(t, []int{id}, fg.activeTokens(tokenTypeProject, 1))
+
+		resp, err = testTokenInventoryRead(t, backend, req.Storage, id)
+		require.NoError(t, err)
+		assert.Equal(t, tokenStatusActive, resp.Data["status"])
+
+		fg.setBackendAccess(tokenTypeProject, 1, accessLevelMaintainer)
+		resp, err = testRevoke(t, backend, req.Storage, "role/app", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, resp.Data["revoked"])
+	})
+
+	t.Run("token revoked outside of the backend", func(t *testing.T) {
+		ids := map[string]int{"app": issue("app"), "team": issue("team")}
+		for roleName, id := range ids {
+			fg.revokeToken(id)
+
+			resp, err := testRevoke(t, backend, req.Storage, "role/"+roleName, nil)
+			require.NoError(t, err)
+			require.False(t, resp.IsError())
+			assert.Equal(t, 1, resp.Data["revoked"], roleName)
+			assert.Equal(t, 0, resp.Data["failed"], roleName)
+
+			resp, err = testTokenInventoryRead(t, backend, req.Storage, id)
+			require.NoError(t, err)
+			assert.Equal(t, tokenStatusRevoked, resp.Data["status"], roleName)
+		}
+	})
+}
+
+func TestFakeGitlabEnforcement(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabFakeEnv(t)
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	fg.addProject(2, "team/docs", accessLevelDeveloper)
+	fg.addProject(3, "other/app", 0)
+	fg.addProject(4, "locked/app", accessLevelMaintainer).TokensDisabled = true
+
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		status  int
+		message string
+	}{
+		{
+			name:    "unknown scope",
+			data:    map[string]interface{}{"id": 1, "scopes": []string{"sudo_everything"}},
+			status:  http.StatusBadRequest,
+			message: "scope 'sudo_everything' is not allowed",
+		},
+		{
+			name:    "access level above the backend's",
+			data:    map[string]interface{}{"id": 1, "scopes": []string{"api"}, "access_level": accessLevelOwner},
+			status:  http.StatusBadRequest,
+			message: "can't be greater the access level of the user",
+		},
+		{
+			name:    "backend below Maintainer",
+			data:    map[string]interface{}{"id": 2, "scopes": []string{"api"}},
+			status:  http.StatusForbidden,
+			message: "backend token lacks Maintainer on project 2",
+		},
+		{
+			name:    "project not visible",
+			data:    map[string]interface{}{"id": 3, "scopes": []string{"api"}},
+			status:  http.StatusNotFound,
+			message: "project 3 does not exist or is not visible",
+		},
+		{
+			name:    "creation disabled",
+			data:    map[string]interface{}{"id": 4, "scopes": []string{"api"}},
+			status:  http.StatusBadRequest,
+			message: "disabled by a parent group setting",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.data["name"] = "enforced"
+			resp, err := testIssueToken(t, backend, req, test.data)
+			assert.Equal(t, test.status, responseStatus(resp, err))
+			if resp != nil && resp.IsError() {
+				err = resp.Error()
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.message)
+		})
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, req.Storage, "docs", map[string]interface{}{
+			"id": 2, "name": "docs", "scopes": "read_api", "verify": true,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "backend token lacks Maintainer on project 2 (team/docs)")
+
+		fg.setBackendAdmin(true)
+		defer fg.setBackendAdmin(false)
+		mustRoleCreate(t, backend, req.Storage, "docs", map[string]interface{}{
+			"id": 2, "name": "docs", "scopes": "read_api", "verify": true,
+		})
+	})
+
+	t.Run("verify reports the group setting as unknown", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, req.Storage, "locked", map[string]interface{}{
+			"id": 4, "name": "locked", "scopes": "read_api", "verify": true,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, map[string]interface{}{
+			"status":  "unknown",
+			"unknown": []string{"whether a group setting disables project access token creation on project 4 (locked/app)"},
+		}, resp.Data["verification"])
+	})
+
+	t.Run("scopes unknown to Gitlab", func(t *testing.T) {
+		c, err := NewClient(&ConfigStorageEntry{BaseURL: fg.URL, Token: fakeGitlabBackendToken}, nil)
+		require.NoError(t, err)
+		_, err = c.CreateProjectAccessToken(&BaseTokenStorageEntry{ID: 1, Name: "unknown", Scopes: []string{"sudo_everything"}}, nil)
+		var apiErr *APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, ErrorKindInvalid, apiErr.Kind())
+		assert.Contains(t, apiErr.Message, "scopes does not have a valid value")
+	})
+
+	t.Run("issued token scopes", func(t *testing.T) {
+		resp, err := testIssueToken(t, backend, req, map[string]interface{}{
+			"id": 1, "name": "reader", "scopes": []string{"read_repository"},
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		c, err := NewClient(&ConfigStorageEntry{BaseURL: fg.URL, Token: resp.Data["token"].(string)}, nil)
+		require.NoError(t, err)
+		_, err = c.GetTargetAccess(tokenTypeProject, 1)
+		var apiErr *APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, ErrorKindForbidden, apiErr.Kind(), "read_repository does not grant API access")
+	})
+}
+
+func TestFakeGitlabFaults(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabFakeEnv(t)
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	data := map[string]interface{}{"id": 1, "name": "faulty", "scopes": []string{"api"}}
+
+	t.Run("transient failure is retried", func(t *testing.T) {
+		fg.fail(http.MethodPost, `/access_tokens$`, 1, http.StatusServiceUnavailable, "503 Service Unavailable")
+		resp, err := testIssueToken(t, backend, req, data)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		assert.Len(t, fg.activeTokens(tokenTypeProject, 1), 1)
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		// more than the retries of the Gitlab client
+		fg.rateLimit(http.MethodPost, `/access_tokens$`, 10, 30*time.Second)
+		resp, err := testIssueToken(t, backend, req, data)
+		assert.Equal(t, http.StatusTooManyRequests, responseStatus(resp, err))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "retry after 30s")
+		assert.Len(t, fg.activeTokens(tokenTypeProject, 1), 1)
+	})
+
+	t.Run("revocation failure is reported", func(t *testing.T) {
+		fg.fail(http.MethodDelete, `/access_tokens/\d+$`, 1, http.StatusForbidden, "403 Forbidden")
+		resp, err := testRevoke(t, backend, req.Storage, "project/1", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 0, resp.Data["revoked"])
+		assert.Equal(t, 1, resp.Data["failed"])
+		assert.Len(t, fg.activeTokens(tokenTypeProject, 1), 1)
+
+		resp, err = testRevoke(t, backend, req.Storage, "project/1", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, resp.Data["revoked"])
+		assert.Empty(t, fg.activeTokens(tokenTypeProject, 1))
+	})
+
+	t.Run("invalid backend token", func(t *testing.T) {
+		backend, storage := getTestBackend(t, false)
+		testConfigUpdate(t, backend, storage, map[string]interface{}{"base_url": fg.URL, "token": "revoked-token"})
+		resp, err := testIssueToken(t, backend, &logical.Request{Storage: storage}, data)
+		assert.Equal(t, http.StatusBadGateway, responseStatus(resp, err))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "write a valid token to config")
+	})
+}
+
+func TestBackendInvalidate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	backend, _ := getTestBackend(t, true)
+	b := backend.(*GitlabBackend)
+	client := b.client
+
+	backend.InvalidateKey(ctx, pathPatternRoles+"/some-role")
+	assert.Same(t, client, b.client, "only config changes drop the client")
+
+	backend.InvalidateKey(ctx, pathPatternConfig)
+	assert.Nil(t, b.client)
+}
+
+// TestBackendPeriodic runs the periodic cleanup the way Vault's rollback manager does, on an active node
+// and on nodes whose storage is read-only
+func TestBackendPeriodic(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		state     consts.ReplicationState
+		pruned    bool
+		finalized bool
+	}{
+		{name: "active", pruned: true, finalized: true},
+		{name: "performance standby", state: consts.ReplicationPerformanceStandby},
+		{name: "performance secondary", state: consts.ReplicationPerformanceSecondary, pruned: true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+
+			config := logical.TestBackendConfig()
+			config.StorageView = &logical.InmemStorage{}
+			config.System = &logical.StaticSystemView{ReplicationStateVal: test.state}
+			backend, err := Factory(ctx, config)
+			require.NoError(t, err)
+
+			longAgo := time.Now().UTC().Add(-2 * defaultInventoryRetention)
+			require.NoError(t, (&TokenInventoryEntry{TokenID: 1, ExpiresAt: &longAgo}).save(ctx, config.StorageView))
+			role := &RoleStorageEntry{RoleName: "drained", Status: roleStatusDeleting}
+			require.NoError(t, role.save(ctx, config.StorageView))
+
+			_, err = backend.HandleRequest(ctx, &logical.Request{
+				Operation: logical.RollbackOperation,
+				Storage:   config.StorageView,
+			})
+			require.NoError(t, err)
+
+			ids, err := listTokenInventoryEntries(ctx, config.StorageView)
+			require.NoError(t, err)
+			assert.Equal(t, test.pruned, len(ids) == 0)
+
+			role, err = getRoleEntry(ctx, config.StorageView, "drained")
+			require.NoError(t, err)
+			assert.Equal(t, test.finalized, role == nil)
+		})
+	}
+}
+
+// TestBackendSpecialStorage checks every key the backend writes against the storage paths it declares
+// as seal wrapped and local
+func TestBackendSpecialStorage(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+	mustRoleCreate(t, backend, storage, "special", map[string]interface{}{
+		"id":           1,
+		"name":         "special",
+		"scopes":       "read_api",
+		"reuse_tokens": true,
+		"issue_rate":   "10/minute",
+	})
+	resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: "entity"}, "special", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	matches := func(prefixes []string, key string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	special := backend.SpecialPaths()
+	expected := map[string]struct{ sealWrapped, local bool }{
+		"config":                     {sealWrapped: true},
+		"roles/special":              {},
+		"tokens/1":                   {local: true},
+		"tokens-by-role/special/1":   {local: true},
+		"role-usage/special":         {local: true},
+		"token-cache/special/entity": {sealWrapped: true, local: true},
+	}
+
+	keys, err := logical.CollectKeys(ctx, storage)
+	require.NoError(t, err)
+	assert.Len(t, keys, len(expected))
+	for _, key := range keys {
+		want, ok := expected[key]
+		if !assert.True(t, ok, "unexpected storage key %s", key) {
+			continue
+		}
+		assert.Equal(t, want.sealWrapped, matches(special.SealWrapStorage, key), "seal wrapping of %s", key)
+		assert.Equal(t, want.local, matches(special.LocalStorage, key), "local storage of %s", key)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// bindsClaims reports whether tokens of the role are only issued to requests carrying the bound claims
+func (role *RoleStorageEntry) bindsClaims() bool {
+	return len(role.BoundClaims) > 0
+}
+
+// claimPatterns returns the comma separated patterns a bound claim must match
+func claimPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func (role *RoleStorageEntry) assertValidBoundClaims() error {
+	var err *multierror.Error
+	for claim, value := range role.BoundClaims {
+		if claim == "" {
+			err = multierror.Append(err, errors.New("bound_claims must not have an empty claim name"))
+		} else if len(claimPatterns(value)) == 0 {
+			err = multierror.Append(err, fmt.Errorf("bound claim '%s' has no values", claim))
+		}
+	}
+	if role.BoundClaimsMountAccessor != "" && !role.bindsClaims() {
+		err = multierror.Append(err, errors.New("bound_claims_mount_accessor requires bound_claims"))
+	}
+	return err.ErrorOrNil()
+}
+
+// checkBoundClaims checks the claims of the requesting entity against the bound claims of the role. The
+// claims are read from the metadata of the entity's alias on the auth mount with the role's
+// bound_claims_mount_accessor, such as the claim_mappings of a JWT auth mount for Gitlab CI, or from the
+// entity metadata if it is not set. Every bound claim must be present and match one of its values.
+//
+// Vault updates the alias metadata on every login through the mount, so the claims are those of the
+// entity's most recent login there rather than of the login that issued the requesting token. Entities
+// with several aliases on the mount, as left by entity merges, are refused because their claims are
+// ambiguous.
+func (b *GitlabBackend) checkBoundClaims(req *logical.Request, role *RoleStorageEntry) error {
+	if req.EntityID == "" {
+		return fmt.Errorf("role '%s' is bound to claims of the requesting entity, and the request has no entity", role.RoleName)
+	}
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return fmt.Errorf("failed to look up entity %s: %w", req.EntityID, err)
+	}
+	if entity == nil {
+		return fmt.Errorf("entity %s does not exist", req.EntityID)
+	}
+
+	claims := entity.Metadata
+	if role.BoundClaimsMountAccessor != "" {
+		var aliases []*logical.Alias
+		for _, alias := range entity.Aliases {
+			if alias.MountAccessor == role.BoundClaimsMountAccessor {
+				aliases = append(aliases, alias)
+			}
+		}
+		switch len(aliases) {
+		case 0:
+			return fmt.Errorf("entity %s has no alias with claims on auth mount %s", req.EntityID, role.BoundClaimsMountAccessor)
+		case 1:
+			claims = aliases[0].Metadata
+		default:
+			return fmt.Errorf("entity %s has %d aliases on auth mount %s, so its claims are ambiguous", req.EntityID, len(aliases), role.BoundClaimsMountAccessor)
+		}
+	}
+
+	names := make([]string, 0, len(role.BoundClaims))
+	for claim := range role.BoundClaims {
+		names = append(names, claim)
+	}
+	sort.Strings(names)
+	for _, claim := range names {
+		value, ok := claims[claim]
+		if !ok {
+			return fmt.Errorf("entity %s has no '%s' claim", req.EntityID, claim)
+		}
+		if !matchesAny(claimPatterns(role.BoundClaims[claim]), value) {
+			return fmt.Errorf("claim '%s' of entity %s has value '%s', which does not match the bound claims", claim, req.EntityID, value)
+		}
+	}
+	return nil
+}
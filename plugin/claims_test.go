@@ -0,0 +1,134 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testJWTAccessor = "auth_jwt_1234"
+
+// ciEntity returns an entity authenticated by a Gitlab CI job, whose claims are mapped to the metadata of its
+// alias on the JWT auth mount
+func ciEntity(id string, claims map[string]string) *logical.Entity {
+	return &logical.Entity{ID: id, Aliases: []*logical.Alias{
+		{MountAccessor: testJWTAccessor, Name: id, Metadata: claims},
+	}}
+}
+
+func TestRoleBoundClaims(t *testing.T) {
+	t.Parallel()
+
+	fg := newFakeGitlab(t)
+	fg.addProject(2, "group/docs", accessLevelMaintainer)
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.System = &entitySystemView{entities: map[string]*logical.Entity{
+		"job-main":    ciEntity("job-main", map[string]string{"project_path": "group/app", "ref": "main", "ref_protected": "true"}),
+		"job-release": ciEntity("job-release", map[string]string{"project_path": "group/app", "ref": "release/1.2", "ref_protected": "true"}),
+		"job-branch":  ciEntity("job-branch", map[string]string{"project_path": "group/app", "ref": "feature", "ref_protected": "false"}),
+		"job-other":   ciEntity("job-other", map[string]string{"project_path": "group/other", "ref": "main", "ref_protected": "true"}),
+		"job-partial": ciEntity("job-partial", map[string]string{"project_path": "group/app"}),
+		"user":        {ID: "user", Metadata: map[string]string{"project_path": "group/app"}},
+		"job-merged": {ID: "job-merged", Aliases: []*logical.Alias{
+			{MountAccessor: testJWTAccessor, Name: "job-1", Metadata: map[string]string{"project_path": "group/other", "ref": "main", "ref_protected": "true"}},
+			{MountAccessor: testJWTAccessor, Name: "job-2", Metadata: map[string]string{"project_path": "group/app", "ref": "main", "ref_protected": "true"}},
+		}},
+	}}
+	backend, err := Factory(context.Background(), config)
+	require.NoError(t, err)
+	storage := config.StorageView
+	testConfigUpdate(t, backend, storage, fg.config())
+
+	mustRoleCreate(t, backend, storage, "docs-writer", map[string]interface{}{
+		"id":                          2,
+		"name":                        "docs-ci",
+		"scopes":                      "write_repository",
+		"bound_claims":                []string{"project_path=group/app", "ref_protected=true", "ref=main,release/*"},
+		"bound_claims_mount_accessor": testJWTAccessor,
+	})
+	resp, err := testRoleRead(t, backend, storage, "docs-writer")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"project_path": "group/app", "ref_protected": "true", "ref": "main,release/*"}, resp.Data["bound_claims"])
+
+	issue := func(entityID string) (*logical.Response, error) {
+		t.Helper()
+		return testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: entityID}, "docs-writer", nil)
+	}
+
+	t.Run("jobs matching the bound claims get tokens", func(t *testing.T) {
+		for _, entityID := range []string{"job-main", "job-release"} {
+			resp, err := issue(entityID)
+			require.NoError(t, err)
+			require.False(t, resp.IsError(), "unexpected error for %s: %v", entityID, resp.Error())
+		}
+		assert.Len(t, fg.activeTokens(tokenTypeProject, 2), 2)
+	})
+
+	t.Run("other requests are refused before calling Gitlab", func(t *testing.T) {
+		requests := fg.requestCount()
+		for entityID, message := range map[string]string{
+			"job-branch":  "claim 'ref' of entity job-branch has value 'feature'",
+			"job-other":   "claim 'project_path' of entity job-other has value 'group/other'",
+			"job-partial": "entity job-partial has no 'ref' claim",
+			"user":        "entity user has no alias with claims on auth mount " + testJWTAccessor,
+			"job-merged":  "entity job-merged has 2 aliases on auth mount " + testJWTAccessor + ", so its claims are ambiguous",
+			"":            "the request has no entity",
+		} {
+			resp, err := issue(entityID)
+			require.NoError(t, err)
+			require.True(t, resp.IsError(), entityID)
+			assert.Contains(t, resp.Error().Error(), message)
+		}
+		assert.Equal(t, requests, fg.requestCount())
+		assert.Len(t, fg.activeTokens(tokenTypeProject, 2), 2)
+	})
+
+	t.Run("claims default to the entity metadata", func(t *testing.T) {
+		mustRoleCreate(t, backend, storage, "metadata", map[string]interface{}{
+			"id":           2,
+			"name":         "docs-ci",
+			"scopes":       "read_repository",
+			"bound_claims": map[string]interface{}{"project_path": "group/*"},
+		})
+		resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: "user"}, "metadata", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+
+		resp, err = testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: "job-main"}, "metadata", nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "has no 'project_path' claim")
+	})
+
+	t.Run("bound claims are validated", func(t *testing.T) {
+		for message, data := range map[string]map[string]interface{}{
+			"bound claim 'ref' has no values":                   {"bound_claims": []string{"ref="}},
+			"bound_claims_mount_accessor requires bound_claims": {"bound_claims_mount_accessor": testJWTAccessor},
+		} {
+			data["id"], data["name"], data["scopes"] = 2, "docs-ci", "read_api"
+			resp, err := testRoleCreate(t, backend, storage, "invalid", data)
+			require.NoError(t, err)
+			require.True(t, resp.IsError(), message)
+			assert.Contains(t, resp.Error().Error(), message)
+		}
+	})
+}
@@ -16,6 +16,7 @@ package gitlabtoken
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
@@ -23,9 +24,75 @@ import (
 
 // ConfigStorageEntry structure represents the config as it is stored within vault
 type ConfigStorageEntry struct {
+	// Version of the stored format, see storageKind
+	Version int           `json:"version" structs:"version" mapstructure:"version"`
 	BaseURL string        `json:"base_url" structs:"base_url" mapstructure:"base_url"`
 	Token   string        `json:"token" structs:"token" mapstructure:"token"`
 	MaxTTL  time.Duration `json:"max_ttl" structs:"max_ttl" mapstructure:"max_ttl"`
+	// How long revoked or expired tokens are kept in the inventory
+	InventoryRetention time.Duration `json:"inventory_retention" structs:"inventory_retention" mapstructure:"inventory_retention"`
+	// Whether a TTL beyond a maximum is rejected or clamped. Empty means reject.
+	TTLPolicy string `json:"ttl_policy,omitempty" structs:"ttl_policy" mapstructure:"ttl_policy"`
+	// Credentials of a Gitlab OAuth application, used instead of Token. Gitlab rotates the refresh token
+	// on every refresh, and the new one replaces the stored one.
+	OAuthClientID     string `json:"oauth_client_id,omitempty" structs:"oauth_client_id" mapstructure:"oauth_client_id"`
+	OAuthClientSecret string `json:"oauth_client_secret,omitempty" structs:"oauth_client_secret" mapstructure:"oauth_client_secret"`
+	OAuthRedirectURI  string `json:"oauth_redirect_uri,omitempty" structs:"oauth_redirect_uri" mapstructure:"oauth_redirect_uri"`
+	OAuthRefreshToken string `json:"oauth_refresh_token,omitempty" structs:"oauth_refresh_token" mapstructure:"oauth_refresh_token"`
+
+	// Plugin identity tokens are exchanged for a Gitlab access token at IdentityTokenExchangeURL, used
+	// instead of Token
+	IdentityTokenAudience    string        `json:"identity_token_audience,omitempty" structs:"identity_token_audience" mapstructure:"identity_token_audience"`
+	IdentityTokenTTL         time.Duration `json:"identity_token_ttl,omitempty" structs:"identity_token_ttl" mapstructure:"identity_token_ttl"`
+	IdentityTokenExchangeURL string        `json:"identity_token_exchange_url,omitempty" structs:"identity_token_exchange_url" mapstructure:"identity_token_exchange_url"`
+
+	// credential is obtained from the credentialProvider of the config when a client is created. It is
+	// never stored.
+	credential *gitlabCredential
+}
+
+// usesOAuth reports whether the backend authenticates as an OAuth application
+func (config *ConfigStorageEntry) usesOAuth() bool {
+	return config.OAuthClientID != "" || config.OAuthClientSecret != "" || config.OAuthRedirectURI != "" || config.OAuthRefreshToken != ""
+}
+
+// usesIdentityToken reports whether the backend exchanges plugin identity tokens for its Gitlab access
+func (config *ConfigStorageEntry) usesIdentityToken() bool {
+	return config.IdentityTokenAudience != "" || config.IdentityTokenExchangeURL != ""
+}
+
+// assertValid checks that the config holds exactly one way to authenticate to Gitlab
+func (config *ConfigStorageEntry) assertValid() error {
+	if config.usesIdentityToken() {
+		if config.Token != "" || config.usesOAuth() {
+			return fmt.Errorf("identity tokens, token and oauth credentials are mutually exclusive, unset all but one of them")
+		}
+		if config.IdentityTokenAudience == "" || config.IdentityTokenExchangeURL == "" {
+			return fmt.Errorf("identity_token_audience and identity_token_exchange_url are both required to authenticate with plugin identity tokens")
+		}
+		return nil
+	}
+	if !config.usesOAuth() {
+		return nil
+	}
+	if config.Token != "" {
+		return fmt.Errorf("token and oauth credentials are mutually exclusive, unset one of them")
+	}
+	if config.OAuthClientID == "" || config.OAuthClientSecret == "" || config.OAuthRedirectURI == "" || config.OAuthRefreshToken == "" {
+		return fmt.Errorf("oauth_client_id, oauth_client_secret, oauth_redirect_uri and oauth_refresh_token are all required to authenticate as an oauth application")
+	}
+	return nil
+}
+
+// save saves the config to storage
+func (config *ConfigStorageEntry) save(ctx context.Context, storage logical.Storage) error {
+	config.Version = storageConfig.version()
+	entry, err := logical.StorageEntryJSON(pathPatternConfig, config)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
 }
 
 func getConfig(ctx context.Context, s logical.Storage) (*ConfigStorageEntry, error) {
@@ -38,7 +105,7 @@ func getConfig(ctx context.Context, s logical.Storage) (*ConfigStorageEntry, err
 		return nil, nil
 	}
 
-	if err := configRaw.DecodeJSON(&config); err != nil {
+	if _, err := storageConfig.decode(configRaw, &config); err != nil {
 		return nil, err
 	}
 
@@ -19,12 +19,46 @@ import "github.com/xanzy/go-gitlab"
 type PAT = gitlab.ProjectAccessToken
 
 const (
-	pathPatternConfig = "config"
-	pathPatternToken  = "token"
-	pathPatternRoles  = "roles"
-
-	// accessLevelGuest      = 10
-	// accessLevelReporter   = 20
-	// accessLevelDeveloper  = 30
-	// accessLevelMaintainer = 40
+	pathPatternConfig        = "config"
+	pathPatternToken         = "token"
+	pathPatternRoles         = "roles"
+	pathPatternRolesBulk     = "roles-bulk"
+	pathPatternRoleTemplates = "role-templates"
+	pathPatternTokens        = "tokens"
+	pathPatternRevoke        = "revoke"
+
+	tokenTypeProject = "project"
+	tokenTypeGroup   = "group"
+
+	// accessLevelInvalid marks an access level that could not be parsed
+	accessLevelInvalid       = -1
+	accessLevelMinimalAccess = 5
+	accessLevelGuest         = 10
+	accessLevelPlanner       = 15
+	accessLevelReporter      = 20
+	accessLevelDeveloper     = 30
+	accessLevelMaintainer    = 40
+	accessLevelOwner         = 50
 )
+
+var accessLevelNames = map[int]string{
+	accessLevelMinimalAccess: "minimal_access",
+	accessLevelGuest:         "guest",
+	accessLevelPlanner:       "planner",
+	accessLevelReporter:      "reporter",
+	accessLevelDeveloper:     "developer",
+	accessLevelMaintainer:    "maintainer",
+	accessLevelOwner:         "owner",
+}
+
+// allowedAccessLevels lists the access levels a token of each type can be created with
+var allowedAccessLevels = map[string][]int{
+	tokenTypeProject: {
+		accessLevelGuest, accessLevelPlanner, accessLevelReporter,
+		accessLevelDeveloper, accessLevelMaintainer, accessLevelOwner,
+	},
+	tokenTypeGroup: {
+		accessLevelMinimalAccess, accessLevelGuest, accessLevelPlanner, accessLevelReporter,
+		accessLevelDeveloper, accessLevelMaintainer, accessLevelOwner,
+	},
+}
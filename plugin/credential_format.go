@@ -0,0 +1,148 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	formatGitCredential = "git-credential"
+	formatNetrc         = "netrc"
+	formatDocker        = "docker"
+	formatNpmrc         = "npmrc"
+	formatPip           = "pip"
+)
+
+var credentialFormats = []string{formatGitCredential, formatNetrc, formatDocker, formatNpmrc, formatPip}
+
+// npmScopePattern matches the scope of npm package names, such as @team
+var npmScopePattern = regexp.MustCompile(`^@[a-z0-9][a-z0-9._~-]*$`)
+
+func validCredentialFormat(format string) bool {
+	for _, f := range credentialFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// formatUsesUsername reports whether credentials of the format carry the username of the token's bot user.
+// npm authenticates with the token alone.
+func formatUsesUsername(format string) bool {
+	switch format {
+	case formatGitCredential, formatNetrc, formatDocker, formatPip:
+		return true
+	}
+	return false
+}
+
+// credentialFormatter builds the credential formats of access tokens for the Gitlab instance of base_url
+type credentialFormatter struct {
+	// scheme and host of the Gitlab instance
+	scheme string
+	host   string
+	// prefix is the path Gitlab is served under, empty unless it is installed under a relative URL
+	prefix string
+	// registryHost is the host of the container registry, the Gitlab host if not set
+	registryHost string
+	// npmScope is the package scope the npm registry is set for, the default registry if not set
+	npmScope string
+}
+
+func newCredentialFormatter(baseURL, registryHost, npmScope string) (*credentialFormatter, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("base_url is not a valid URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("base_url '%s' has no host", baseURL)
+	}
+	if npmScope != "" && !npmScopePattern.MatchString(npmScope) {
+		return nil, fmt.Errorf("npm_scope '%s' is not an npm package scope such as @team", npmScope)
+	}
+	f := &credentialFormatter{
+		scheme: u.Scheme,
+		host:   u.Host,
+		// base_url may include the API path, which go-gitlab otherwise adds
+		prefix:       strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api/v4"), "/"),
+		registryHost: registryHost,
+		npmScope:     npmScope,
+	}
+	if f.scheme == "" {
+		f.scheme = "https"
+	}
+	if f.registryHost == "" {
+		f.registryHost = f.host
+	}
+	return f, nil
+}
+
+// packagesPath returns the path of the package registry API of the project or group, without a trailing
+// slash. Group endpoints are only available for installing packages.
+func (f *credentialFormatter) packagesPath(base *BaseTokenStorageEntry, registry string) string {
+	if base.tokenType() == tokenTypeGroup {
+		return fmt.Sprintf("%s/api/v4/groups/%d/-/packages/%s", f.prefix, base.ID, registry)
+	}
+	return fmt.Sprintf("%s/api/v4/projects/%d/packages/%s", f.prefix, base.ID, registry)
+}
+
+// format returns the token of the bot user username, issued on the project or group of base, in the
+// credential format
+func (f *credentialFormatter) format(format, username string, pat *PAT, base *BaseTokenStorageEntry) (string, error) {
+	switch format {
+	case formatGitCredential:
+		// the input and output format of git credential helpers
+		return fmt.Sprintf("protocol=%s\nhost=%s\nusername=%s\npassword=%s\n", f.scheme, f.host, username, pat.Token), nil
+	case formatNetrc:
+		return fmt.Sprintf("machine %s login %s password %s\n", f.host, username, pat.Token), nil
+	case formatDocker:
+		config := map[string]interface{}{
+			"auths": map[string]interface{}{
+				f.registryHost: map[string]string{
+					"auth": base64.StdEncoding.EncodeToString([]byte(username + ":" + pat.Token)),
+				},
+			},
+		}
+		b, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b) + "\n", nil
+	case formatNpmrc:
+		// npm only sends the token to the registry it is configured for
+		registry := fmt.Sprintf("%s%s/", f.host, f.packagesPath(base, "npm"))
+		registryKey := "registry"
+		if f.npmScope != "" {
+			registryKey = f.npmScope + ":registry"
+		}
+		return fmt.Sprintf("%s=%s://%s\n//%s:_authToken=%s\n", registryKey, f.scheme, registry, registry, pat.Token), nil
+	case formatPip:
+		index := url.URL{
+			Scheme: f.scheme,
+			User:   url.UserPassword(username, pat.Token),
+			Host:   f.host,
+			Path:   f.packagesPath(base, "pypi") + "/simple",
+		}
+		return index.String() + "\n", nil
+	}
+	return "", fmt.Errorf("unknown format '%s', must be one of %s", format, strings.Join(credentialFormats, ", "))
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/pluginutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// credentialRefreshMargin is how long before its expiry a credential is replaced
+const credentialRefreshMargin = time.Minute
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// gitlabCredential is what the Gitlab client authenticates with
+type gitlabCredential struct {
+	token string
+	// bearer credentials are OAuth access tokens, sent in the Authorization header instead of as a
+	// private token
+	bearer bool
+	// expiresAt is when the credential expires, or the zero time if it does not
+	expiresAt time.Time
+}
+
+// credentialProvider obtains the credential the backend authenticates to Gitlab with. It is called under
+// configLock whenever a Gitlab client is created.
+type credentialProvider interface {
+	name() string
+	credential(ctx context.Context, storage logical.Storage, config *ConfigStorageEntry) (*gitlabCredential, error)
+}
+
+// credentialProvider returns the provider of the credential the config authenticates with
+func (b *GitlabBackend) credentialProvider(config *ConfigStorageEntry) credentialProvider {
+	switch {
+	case config.usesOAuth():
+		return &oauthProvider{b: b}
+	case config.usesIdentityToken():
+		return &identityTokenProvider{b: b}
+	default:
+		return staticTokenProvider{}
+	}
+}
+
+// staticTokenProvider authenticates with the token stored in the config
+type staticTokenProvider struct{}
+
+func (staticTokenProvider) name() string {
+	return "token"
+}
+
+func (staticTokenProvider) credential(_ context.Context, _ logical.Storage, config *ConfigStorageEntry) (*gitlabCredential, error) {
+	return &gitlabCredential{token: config.Token}, nil
+}
+
+// identityTokenProvider exchanges a plugin identity token signed by Vault for a Gitlab access token.
+// Gitlab itself does not accept external JWTs, so the exchange goes to a token exchange service
+// (RFC 8693) that trusts Vault's identity token issuer and returns an OAuth access token for Gitlab.
+type identityTokenProvider struct {
+	b *GitlabBackend
+}
+
+func (p *identityTokenProvider) name() string {
+	return "identity_token"
+}
+
+func (p *identityTokenProvider) credential(ctx context.Context, _ logical.Storage, config *ConfigStorageEntry) (*gitlabCredential, error) {
+	resp, err := p.b.System().GenerateIdentityToken(ctx, &pluginutil.IdentityTokenRequest{
+		Audience: config.IdentityTokenAudience,
+		TTL:      config.IdentityTokenTTL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a plugin identity token: %w", err)
+	}
+
+	token, err := requestOAuthToken(ctx, "exchange_identity_token", config.IdentityTokenExchangeURL, url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token":      {resp.Token.Token()},
+		"subject_token_type": {tokenTypeJWT},
+		"audience":           {config.IdentityTokenAudience},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange the plugin identity token: %w", err)
+	}
+
+	p.b.Logger().Debug("exchanged plugin identity token", "expires_at", token.expiresAt())
+	return &gitlabCredential{token: token.AccessToken, bearer: true, expiresAt: token.expiresAt()}, nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/pluginidentityutil"
+	"github.com/hashicorp/vault/sdk/helper/pluginutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testIdentityIssuer   = "https://vault.example.com/v1/identity/oidc/plugins"
+	testIdentityAudience = "gitlab-token-exchange"
+)
+
+// identityTokenSystemView signs plugin identity tokens like Vault does for its plugins
+type identityTokenSystemView struct {
+	logical.StaticSystemView
+	key *rsa.PrivateKey
+	// unsupported fails like Vault community edition, which does not issue plugin identity tokens
+	unsupported bool
+}
+
+func (v *identityTokenSystemView) GenerateIdentityToken(_ context.Context, req *pluginutil.IdentityTokenRequest) (*pluginutil.IdentityTokenResponse, error) {
+	if v.unsupported {
+		return nil, pluginidentityutil.ErrPluginWorkloadIdentityUnsupported
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: v.key}, nil)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   testIdentityIssuer,
+		Subject:  "plugin-identity:root:secret:gitlab",
+		Audience: jwt.Audience{req.Audience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(req.TTL)),
+	}).CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return &pluginutil.IdentityTokenResponse{Token: pluginutil.IdentityToken(token), TTL: req.TTL}, nil
+}
+
+// newFakeTokenExchange starts a token exchange service trusting the plugin identity tokens signed by key,
+// which issues OAuth access tokens of the fake Gitlab's backend user
+func newFakeTokenExchange(t *testing.T, fg *fakeGitlab, key *rsa.PublicKey) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != grantTypeTokenExchange ||
+			r.PostForm.Get("subject_token_type") != tokenTypeJWT {
+			fakeGitlabJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request"})
+			return
+		}
+		token, err := jwt.ParseSigned(r.PostForm.Get("subject_token"))
+		var claims jwt.Claims
+		if err == nil {
+			err = token.Claims(key, &claims)
+		}
+		if err == nil {
+			err = claims.Validate(jwt.Expected{Issuer: testIdentityIssuer, Audience: jwt.Audience{testIdentityAudience}, Time: time.Now()})
+		}
+		if err != nil {
+			fakeGitlabJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":             "invalid_grant",
+				"error_description": err.Error(),
+			})
+			return
+		}
+
+		fg.lock.Lock()
+		defer fg.lock.Unlock()
+		fakeGitlabJSON(w, http.StatusOK, fg.issueOAuthAccessToken())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newIdentityTokenBackend returns a backend whose system view signs plugin identity tokens with key
+func newIdentityTokenBackend(t *testing.T, system *identityTokenSystemView) (logical.Backend, logical.Storage) {
+	t.Helper()
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.System = system
+	backend, err := Factory(context.Background(), config)
+	require.NoError(t, err)
+	return backend, config.StorageView
+}
+
+func TestIdentityTokenIssue(t *testing.T) {
+	t.Parallel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	fg := newFakeGitlab(t)
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	exchange := newFakeTokenExchange(t, fg, &key.PublicKey)
+
+	backend, storage := newIdentityTokenBackend(t, &identityTokenSystemView{key: key})
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url":                    fg.URL,
+		"identity_token_audience":     testIdentityAudience,
+		"identity_token_exchange_url": exchange.URL,
+	})
+	testConfigRead(t, backend, storage, map[string]interface{}{
+		"base_url":                    fg.URL,
+		"max_ttl":                     int64(0),
+		"ttl_policy":                  ttlPolicyReject,
+		"inventory_retention":         int64(defaultInventoryRetention / time.Second),
+		"identity_token_audience":     testIdentityAudience,
+		"identity_token_ttl":          int64(3600),
+		"identity_token_exchange_url": exchange.URL,
+	})
+
+	mustRoleCreate(t, backend, storage, "app", map[string]interface{}{
+		"id":     1,
+		"name":   "app-ci",
+		"scopes": "read_api",
+		"verify": true,
+	})
+	resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "app", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+	assert.Len(t, fg.activeTokens(tokenTypeProject, 1), 1)
+
+	// a token for another audience is refused by the exchange
+	testConfigUpdate(t, backend, storage, map[string]interface{}{"identity_token_audience": "someone-else"})
+	resp, err = testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "app", nil)
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), "failed to exchange the plugin identity token")
+	assert.Len(t, fg.activeTokens(tokenTypeProject, 1), 1)
+}
+
+func TestIdentityTokenUnsupported(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := newIdentityTokenBackend(t, &identityTokenSystemView{unsupported: true})
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url":                    "https://gitlab.example.com",
+		"identity_token_audience":     testIdentityAudience,
+		"identity_token_exchange_url": "https://sts.example.com/token",
+	})
+	mustRoleCreate(t, backend, storage, "app", map[string]interface{}{
+		"id":     1,
+		"name":   "app-ci",
+		"scopes": "read_api",
+	})
+
+	resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "app", nil)
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), pluginidentityutil.ErrPluginWorkloadIdentityUnsupported.Error())
+}
+
+func TestConfigIdentityTokenValidation(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, false)
+	for name, data := range map[string]map[string]interface{}{
+		"with token": {
+			"token":                       "gibberish",
+			"identity_token_audience":     testIdentityAudience,
+			"identity_token_exchange_url": "https://sts.example.com/token",
+		},
+		"without exchange url": {
+			"identity_token_audience": testIdentityAudience,
+		},
+	} {
+		resp, err := backend.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      pathPatternConfig,
+			Data:      data,
+			Storage:   storage,
+		})
+		require.NoError(t, err, name)
+		assert.True(t, resp.IsError(), name)
+	}
+}
+
+func TestCredentialProvider(t *testing.T) {
+	t.Parallel()
+
+	b := &GitlabBackend{}
+	assert.Equal(t, "token", b.credentialProvider(&ConfigStorageEntry{Token: "token"}).name())
+	assert.Equal(t, "oauth", b.credentialProvider(&ConfigStorageEntry{OAuthClientID: "app"}).name())
+	assert.Equal(t, "identity_token", b.credentialProvider(&ConfigStorageEntry{IdentityTokenAudience: "aud"}).name())
+
+	// a client created without the credential of its provider fails instead of authenticating anonymously
+	_, err := NewClient(&ConfigStorageEntry{BaseURL: "https://gitlab.example.com", IdentityTokenAudience: "aud"}, nil)
+	assert.Error(t, err)
+
+	// the client is replaced before its credential expires
+	c, err := NewClient(&ConfigStorageEntry{
+		BaseURL:    "https://gitlab.example.com",
+		credential: &gitlabCredential{token: "access", bearer: true, expiresAt: time.Now().Add(credentialRefreshMargin / 2)},
+	}, nil)
+	require.NoError(t, err)
+	assert.False(t, c.Valid())
+}
@@ -0,0 +1,307 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	headerRequestID  = "X-Request-Id"
+	headerRetryAfter = "Retry-After"
+)
+
+// ErrorKind classifies a failed Gitlab API call by what the caller can do about it
+type ErrorKind string
+
+const (
+	// ErrorKindInvalid is a request Gitlab refused as invalid, such as an unknown scope
+	ErrorKindInvalid ErrorKind = "invalid"
+	// ErrorKindUnauthorized means the backend token is invalid, expired or revoked
+	ErrorKindUnauthorized ErrorKind = "unauthorized"
+	// ErrorKindForbidden means the backend token lacks the permissions for the operation
+	ErrorKindForbidden ErrorKind = "forbidden"
+	// ErrorKindNotFound means the project or group does not exist or is not visible to the backend token
+	ErrorKindNotFound ErrorKind = "not_found"
+	// ErrorKindRateLimited means Gitlab is rate limiting the backend token
+	ErrorKindRateLimited ErrorKind = "rate_limited"
+	// ErrorKindUnavailable is a Gitlab server error, or no response at all
+	ErrorKindUnavailable ErrorKind = "unavailable"
+	// ErrorKindUnknown is any other failure
+	ErrorKindUnknown ErrorKind = "unknown"
+)
+
+// apiTarget is the Gitlab resource an API call acts on, used to explain failures
+type apiTarget struct {
+	// Type is the token type, which is also the kind of resource ID refers to
+	Type string
+	ID   int
+	// Path is the full path of the resource when it is looked up by path
+	Path string
+	// AccessLevel is the access level requested for a new token, 0 if none
+	AccessLevel int
+}
+
+// APIError is a failed call to the Gitlab API. It carries what is needed to match the failure
+// with Gitlab's own logs and to tell the caller how to fix it.
+type APIError struct {
+	Operation string
+	Target    apiTarget
+	// StatusCode is 0 when no response was received
+	StatusCode int
+	// RequestID is the X-Request-Id header returned by Gitlab
+	RequestID string
+	// Message is the readable error message from the response body
+	Message string
+	// RetryAfter is the Retry-After header of a rate limited call, 0 if not set
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %v", e.Operation, e.Err)
+	}
+
+	msg := fmt.Sprintf("%s: gitlab returned %d %s", e.Operation, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += " - " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (gitlab request id %s)", e.RequestID)
+	}
+	return msg
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Kind classifies the failure by HTTP status
+func (e *APIError) Kind() ErrorKind {
+	switch {
+	case e.StatusCode == 0 || e.StatusCode >= 500:
+		return ErrorKindUnavailable
+	case e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity:
+		return ErrorKindInvalid
+	case e.StatusCode == http.StatusUnauthorized:
+		return ErrorKindUnauthorized
+	case e.StatusCode == http.StatusForbidden:
+		return ErrorKindForbidden
+	case e.StatusCode == http.StatusNotFound:
+		return ErrorKindNotFound
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrorKindRateLimited
+	default:
+		return ErrorKindUnknown
+	}
+}
+
+// Retryable reports whether the same call may succeed later without any change
+func (e *APIError) Retryable() bool {
+	switch e.Kind() {
+	case ErrorKindRateLimited, ErrorKindUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// Hint tells how the failure can be fixed, or returns an empty string if there is nothing specific to say
+func (e *APIError) Hint() string {
+	target := e.Target.describe()
+	switch e.Kind() {
+	case ErrorKindInvalid:
+		if strings.Contains(e.Message, "does not have permission to create") {
+			return fmt.Sprintf("%s access token creation is disabled by a parent group setting, or the backend token lacks Maintainer",
+				e.Target.tokenType())
+		}
+		return "check the token name, scopes, access level and expiry date"
+	case ErrorKindUnauthorized:
+		return "the backend token is invalid, expired or revoked; write a valid token to config"
+	case ErrorKindForbidden:
+		if target == "" {
+			return "the backend token lacks the permissions for this operation"
+		}
+		return fmt.Sprintf("backend token lacks %s on %s, or %s access tokens are disabled there",
+			accessLevelDisplayName(requiredAccessLevel(e.Target.AccessLevel)), target, e.Target.tokenType())
+	case ErrorKindNotFound:
+		if target == "" {
+			return ""
+		}
+		return fmt.Sprintf("%s does not exist or is not visible to the backend token", target)
+	case ErrorKindRateLimited:
+		if e.RetryAfter > 0 {
+			return fmt.Sprintf("Gitlab is rate limiting the backend token; retry after %s", e.RetryAfter)
+		}
+		return "Gitlab is rate limiting the backend token; retry later"
+	case ErrorKindUnavailable:
+		return "Gitlab is unavailable; retry later"
+	default:
+		return ""
+	}
+}
+
+func (t apiTarget) tokenType() string {
+	if t.Type == "" {
+		return tokenTypeProject
+	}
+	return t.Type
+}
+
+func (t apiTarget) describe() string {
+	if t.Path != "" {
+		return fmt.Sprintf("%s %s", t.tokenType(), t.Path)
+	}
+	if t.ID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s %d", t.tokenType(), t.ID)
+}
+
+// newAPIError wraps an error returned by go-gitlab. It returns nil if err is nil.
+func newAPIError(operation string, target apiTarget, resp *gitlab.Response, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	apiErr := &APIError{
+		Operation: operation,
+		Target:    target,
+		Err:       err,
+	}
+
+	var httpResp *http.Response
+	var errResp *gitlab.ErrorResponse
+	if errors.As(err, &errResp) {
+		httpResp = errResp.Response
+		apiErr.Message = parseErrorBody(errResp.Body, errResp.Message)
+	} else if resp != nil {
+		httpResp = resp.Response
+	}
+	if httpResp != nil {
+		apiErr.StatusCode = httpResp.StatusCode
+		apiErr.RequestID = httpResp.Header.Get(headerRequestID)
+		if seconds, err := strconv.Atoi(httpResp.Header.Get(headerRetryAfter)); err == nil && seconds > 0 {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return apiErr
+}
+
+// parseErrorBody turns a Gitlab error body into a readable message. Gitlab returns either
+// {"message": "..."}, {"message": {"field": ["problem", ...]}} or {"error": "...", "error_description": "..."}.
+// fallback is returned when the body has none of these shapes.
+func parseErrorBody(body []byte, fallback string) string {
+	var parsed struct {
+		Message          interface{} `json:"message"`
+		Error            string      `json:"error"`
+		ErrorDescription string      `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return fallback
+	}
+
+	switch msg := parsed.Message.(type) {
+	case string:
+		return msg
+	case map[string]interface{}:
+		var problems []string
+		for field, v := range msg {
+			switch v := v.(type) {
+			case []interface{}:
+				for _, p := range v {
+					problems = append(problems, fmt.Sprintf("%s %v", field, p))
+				}
+			default:
+				problems = append(problems, fmt.Sprintf("%s %v", field, v))
+			}
+		}
+		sort.Strings(problems)
+		return strings.Join(problems, ", ")
+	}
+
+	if parsed.ErrorDescription != "" {
+		return parsed.ErrorDescription
+	}
+	if parsed.Error != "" {
+		return parsed.Error
+	}
+	return fallback
+}
+
+// errorLogFields returns the structured log fields describing err, including the Gitlab request ID
+// and HTTP status for Gitlab API errors
+func errorLogFields(err error) []interface{} {
+	fields := []interface{}{"error", err}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		fields = append(fields, "gitlab_request_id", apiErr.RequestID, "http_status", apiErr.StatusCode,
+			"error_kind", apiErr.Kind(), "retryable", apiErr.Retryable())
+	}
+	return fields
+}
+
+// errorMessage describes err for the caller, with a remediation hint for Gitlab API errors
+func errorMessage(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if hint := apiErr.Hint(); hint != "" {
+			return err.Error() + "; " + hint
+		}
+	}
+	return err.Error()
+}
+
+// gitlabErrorResponse turns a failed Gitlab call into the response of a request handler, so Vault
+// answers with a status code matching the failure:
+//   - invalid requests are 400 Bad Request
+//   - missing permissions of the backend token are 403 Forbidden
+//   - unknown projects or groups are 404 Not Found
+//   - rate limiting is 429 Too Many Requests
+//   - an unusable backend token or a Gitlab outage is 502 Bad Gateway
+func gitlabErrorResponse(prefix string, err error) (*logical.Response, error) {
+	msg := prefix + " - " + errorMessage(err)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return logical.ErrorResponse(msg), nil
+	}
+	switch apiErr.Kind() {
+	case ErrorKindInvalid:
+		return logical.ErrorResponse(msg), logical.ErrInvalidRequest
+	case ErrorKindForbidden:
+		return logical.ErrorResponse(msg), logical.ErrPermissionDenied
+	case ErrorKindNotFound:
+		return nil, logical.CodedError(http.StatusNotFound, msg)
+	case ErrorKindRateLimited:
+		return nil, logical.CodedError(http.StatusTooManyRequests, msg)
+	case ErrorKindUnauthorized, ErrorKindUnavailable:
+		return nil, logical.CodedError(http.StatusBadGateway, msg)
+	default:
+		return logical.ErrorResponse(msg), nil
+	}
+}
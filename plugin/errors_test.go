@@ -0,0 +1,248 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestParseErrorBody(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "message",
+			body:     `{"message":"400 Bad request - Scopes can only contain available scopes"}`,
+			expected: "400 Bad request - Scopes can only contain available scopes",
+		},
+		{
+			name:     "validation errors",
+			body:     `{"message":{"name":["is too long","is invalid"],"scopes":["can't be blank"]}}`,
+			expected: "name is invalid, name is too long, scopes can't be blank",
+		},
+		{
+			name:     "oauth error",
+			body:     `{"error":"invalid_token","error_description":"Token was revoked. You have to re-authorize from the user."}`,
+			expected: "Token was revoked. You have to re-authorize from the user.",
+		},
+		{
+			name:     "not json",
+			body:     `<html>502 Bad Gateway</html>`,
+			expected: "fallback",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture range var
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, test.expected, parseErrorBody([]byte(test.body), "fallback"))
+		})
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	t.Parallel()
+
+	t.Run("nil", func(t *testing.T) {
+		assert.NoError(t, newAPIError("op", apiTarget{}, nil, nil))
+	})
+
+	t.Run("gitlab error response", func(t *testing.T) {
+		header := http.Header{}
+		header.Set(headerRequestID, "01FREQUESTID")
+		errResp := &gitlab.ErrorResponse{
+			Body:     []byte(`{"message":"404 Project Not Found"}`),
+			Response: &http.Response{StatusCode: http.StatusNotFound, Header: header},
+		}
+
+		err := newAPIError("create_project_access_token", apiTarget{ID: 1}, nil, errResp)
+		var apiErr *APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+		assert.Equal(t, "01FREQUESTID", apiErr.RequestID)
+		assert.Equal(t, "404 Project Not Found", apiErr.Message)
+		assert.Equal(t, "create_project_access_token: gitlab returned 404 Not Found - 404 Project Not Found (gitlab request id 01FREQUESTID)", err.Error())
+		assert.ErrorIs(t, err, errResp)
+
+		fields := errorLogFields(err)
+		assert.Contains(t, fields, "01FREQUESTID")
+		assert.Contains(t, fields, http.StatusNotFound)
+		assert.Contains(t, fields, ErrorKindNotFound)
+	})
+
+	t.Run("no response", func(t *testing.T) {
+		err := newAPIError("create_project_access_token", apiTarget{}, nil, errors.New("connection refused"))
+		assert.Equal(t, "create_project_access_token: connection refused", err.Error())
+	})
+}
+
+func TestAPIErrorClassification(t *testing.T) {
+	t.Parallel()
+
+	projectTarget := apiTarget{Type: tokenTypeProject, ID: 123, AccessLevel: accessLevelDeveloper}
+	groupTarget := apiTarget{Type: tokenTypeGroup, ID: 7, AccessLevel: accessLevelOwner}
+
+	tests := []struct {
+		name      string
+		status    int
+		header    http.Header
+		target    apiTarget
+		kind      ErrorKind
+		retryable bool
+		hint      string
+		vaultCode int
+	}{
+		{
+			name:      "invalid scope",
+			status:    http.StatusBadRequest,
+			target:    projectTarget,
+			kind:      ErrorKindInvalid,
+			hint:      "check the token name, scopes, access level and expiry date",
+			vaultCode: http.StatusBadRequest,
+		},
+		{
+			name:      "expired backend token",
+			status:    http.StatusUnauthorized,
+			target:    projectTarget,
+			kind:      ErrorKindUnauthorized,
+			hint:      "the backend token is invalid, expired or revoked; write a valid token to config",
+			vaultCode: http.StatusBadGateway,
+		},
+		{
+			name:      "missing maintainer",
+			status:    http.StatusForbidden,
+			target:    projectTarget,
+			kind:      ErrorKindForbidden,
+			hint:      "backend token lacks Maintainer on project 123, or project access tokens are disabled there",
+			vaultCode: http.StatusForbidden,
+		},
+		{
+			name:      "missing requested access level",
+			status:    http.StatusForbidden,
+			target:    groupTarget,
+			kind:      ErrorKindForbidden,
+			hint:      "backend token lacks Owner on group 7, or group access tokens are disabled there",
+			vaultCode: http.StatusForbidden,
+		},
+		{
+			name:      "wrong project id",
+			status:    http.StatusNotFound,
+			target:    projectTarget,
+			kind:      ErrorKindNotFound,
+			hint:      "project 123 does not exist or is not visible to the backend token",
+			vaultCode: http.StatusNotFound,
+		},
+		{
+			name:      "rate limited",
+			status:    http.StatusTooManyRequests,
+			header:    http.Header{headerRetryAfter: []string{"30"}},
+			target:    projectTarget,
+			kind:      ErrorKindRateLimited,
+			retryable: true,
+			hint:      "Gitlab is rate limiting the backend token; retry after 30s",
+			vaultCode: http.StatusTooManyRequests,
+		},
+		{
+			name:      "outage",
+			status:    http.StatusServiceUnavailable,
+			target:    projectTarget,
+			kind:      ErrorKindUnavailable,
+			retryable: true,
+			hint:      "Gitlab is unavailable; retry later",
+			vaultCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture range var
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			header := test.header
+			if header == nil {
+				header = http.Header{}
+			}
+			errResp := &gitlab.ErrorResponse{
+				Body:     []byte(fmt.Sprintf(`{"message":"%d %s"}`, test.status, http.StatusText(test.status))),
+				Response: &http.Response{StatusCode: test.status, Header: header},
+			}
+			err := newAPIError("create_access_token", test.target, nil, errResp)
+
+			var apiErr *APIError
+			require.True(t, errors.As(err, &apiErr))
+			assert.Equal(t, test.kind, apiErr.Kind())
+			assert.Equal(t, test.retryable, apiErr.Retryable())
+			assert.Equal(t, test.hint, apiErr.Hint())
+			assert.Equal(t, err.Error()+"; "+test.hint, errorMessage(err))
+
+			resp, respErr := gitlabErrorResponse("Failed to create a token", err)
+			code, codeErr := logical.RespondErrorCommon(&logical.Request{Operation: logical.UpdateOperation}, resp, respErr)
+			logical.AdjustErrorStatusCode(&code, codeErr)
+			assert.Equal(t, test.vaultCode, code)
+			assert.Contains(t, codeErr.Error(), test.hint)
+		})
+	}
+
+	t.Run("no response", func(t *testing.T) {
+		t.Parallel()
+		err := newAPIError("create_access_token", projectTarget, nil, errors.New("dial tcp: i/o timeout"))
+		var apiErr *APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, ErrorKindUnavailable, apiErr.Kind())
+		assert.True(t, apiErr.Retryable())
+	})
+
+	t.Run("not a gitlab error", func(t *testing.T) {
+		t.Parallel()
+		resp, err := gitlabErrorResponse("Failed to create a token", errors.New("boom"))
+		require.NoError(t, err)
+		assert.True(t, resp.IsError())
+		assert.Equal(t, "Failed to create a token - boom", resp.Data["error"])
+	})
+
+	t.Run("access token creation disabled", func(t *testing.T) {
+		t.Parallel()
+		errResp := &gitlab.ErrorResponse{
+			Body:     []byte(`{"message":"400 Bad request - User does not have permission to create project access token"}`),
+			Response: &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{}},
+		}
+		var apiErr *APIError
+		require.True(t, errors.As(newAPIError("op", projectTarget, nil, errResp), &apiErr))
+		assert.Equal(t, "project access token creation is disabled by a parent group setting, or the backend token lacks Maintainer", apiErr.Hint())
+	})
+
+	t.Run("retry after is parsed", func(t *testing.T) {
+		t.Parallel()
+		errResp := &gitlab.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{headerRetryAfter: []string{"60"}}},
+		}
+		var apiErr *APIError
+		require.True(t, errors.As(newAPIError("op", projectTarget, nil, errResp), &apiErr))
+		assert.Equal(t, time.Minute, apiErr.RetryAfter)
+	})
+}
@@ -0,0 +1,797 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeGitlabBackendToken  = "fake-backend-token"
+	fakeGitlabBackendUserID = 1
+)
+
+// fakeGitlabScopes are the scopes Gitlab accepts for project and group access tokens
+var fakeGitlabScopes = map[string]bool{
+	"api":              true,
+	"read_api":         true,
+	"read_repository":  true,
+	"write_repository": true,
+	"read_registry":    true,
+	"write_registry":   true,
+	"create_runner":    true,
+}
+
+var (
+	fakeRouteUser         = regexp.MustCompile(`^/api/v4/user$`)
+	fakeRouteUserByID     = regexp.MustCompile(`^/api/v4/users/(\d+)$`)
+	fakeRouteTarget       = regexp.MustCompile(`^/api/v4/(projects|groups)/([^/]+)$`)
+	fakeRouteMember       = regexp.MustCompile(`^/api/v4/groups/(\d+)/members/all/(\d+)$`)
+	fakeRouteAccessTokens = regexp.MustCompile(`^/api/v4/(projects|groups)/(\d+)/access_tokens$`)
+	fakeRouteAccessToken  = regexp.MustCompile(`^/api/v4/(projects|groups)/(\d+)/access_tokens/(\d+)$`)
+	fakeRouteRotateToken  = regexp.MustCompile(`^/api/v4/(projects|groups)/(\d+)/access_tokens/(\d+)/rotate$`)
+)
+
+// fakeGitlab is an in-memory Gitlab serving the API endpoints used by the backend. It keeps users,
+// projects, groups and access tokens, checks authentication, memberships, access levels and scopes the
+// way Gitlab does, and can be told to fail or rate limit requests.
+type fakeGitlab struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	users       map[string]*fakeGitlabUser // by token
+	targets     map[string]*fakeGitlabTarget
+	tokens      map[int]*fakeGitlabToken
+	faults      []*fakeGitlabFault
+	lastTokenID int
+	lastUserID  int
+	requests    int
+
+	oauthApps     map[string]*fakeGitlabOAuthApp // by client ID
+	oauthAccess   map[string]*fakeGitlabOAuthAccess
+	oauthTokenTTL time.Duration
+	lastOAuthID   int
+}
+
+// fakeGitlabOAuthApp is an OAuth application authorized by the backend user
+type fakeGitlabOAuthApp struct {
+	Secret      string
+	RedirectURI string
+	// RefreshTokens holds the refresh tokens that have not been used yet. Each can be used once.
+	RefreshTokens map[string]bool
+	Refreshes     int
+}
+
+type fakeGitlabOAuthAccess struct {
+	User      *fakeGitlabUser
+	ExpiresAt time.Time
+}
+
+type fakeGitlabUser struct {
+	ID       int
+	Username string
+	Admin    bool
+	// Token is set for the bot users of access tokens
+	Token *fakeGitlabToken
+}
+
+// fakeGitlabTarget is a project or a group
+type fakeGitlabTarget struct {
+	Type string
+	ID   int
+	Path string
+	// Members maps user IDs to their access level
+	Members map[int]int
+	// TokensDisabled refuses access token creation, as the parent group setting does
+	TokensDisabled bool
+}
+
+type fakeGitlabToken struct {
+	ID          int
+	UserID      int
+	Target      *fakeGitlabTarget
+	Name        string
+	Scopes      []string
+	AccessLevel int
+	Value       string
+	// CreatedBy is the ID of the user the token was created as
+	CreatedBy int
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+	Revoked   bool
+}
+
+// fakeGitlabFault makes the next Remaining requests matching Method and Path fail with Status
+type fakeGitlabFault struct {
+	Method     string
+	Path       *regexp.Regexp
+	Status     int
+	Message    string
+	RetryAfter string
+	Remaining  int
+}
+
+// newFakeGitlab starts a fake Gitlab, stopped at the end of the test. The backend user, authenticated by
+// fakeGitlabBackendToken, is not a member of anything yet.
+func newFakeGitlab(t *testing.T) *fakeGitlab {
+	t.Helper()
+
+	fg := &fakeGitlab{
+		users: map[string]*fakeGitlabUser{
+			fakeGitlabBackendToken: {ID: fakeGitlabBackendUserID, Username: "vault-backend"},
+		},
+		targets:       map[string]*fakeGitlabTarget{},
+		tokens:        map[int]*fakeGitlabToken{},
+		oauthApps:     map[string]*fakeGitlabOAuthApp{},
+		oauthAccess:   map[string]*fakeGitlabOAuthAccess{},
+		oauthTokenTTL: 2 * time.Hour,
+		lastUserID:    fakeGitlabBackendUserID,
+	}
+	fg.Server = httptest.NewServer(http.HandlerFunc(fg.serveHTTP))
+	t.Cleanup(fg.Close)
+	return fg
+}
+
+// config returns the backend config to talk to the fake
+func (fg *fakeGitlab) config() map[string]interface{} {
+	return map[string]interface{}{
+		"base_url": fg.URL,
+		"token":    fakeGitlabBackendToken,
+	}
+}
+
+// addUser adds a user who does not authenticate itself, but can be impersonated with the Sudo header
+func (fg *fakeGitlab) addUser(username string) *fakeGitlabUser {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	fg.lastUserID++
+	user := &fakeGitlabUser{ID: fg.lastUserID, Username: username}
+	fg.users["user:"+username] = user
+	return user
+}
+
+// userByName returns the user with the username. The caller holds the lock.
+func (fg *fakeGitlab) userByName(username string) *fakeGitlabUser {
+	for _, user := range fg.users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+func (fg *fakeGitlab) addTarget(tokenType string, id int, path string, members map[int]int) *fakeGitlabTarget {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	if members == nil {
+		members = map[int]int{}
+	}
+	target := &fakeGitlabTarget{Type: tokenType, ID: id, Path: path, Members: members}
+	fg.targets[fakeTargetKey(tokenType, id)] = target
+	return target
+}
+
+// addProject adds a project where the backend user has the given access level, 0 meaning no membership
+func (fg *fakeGitlab) addProject(id int, path string, backendAccessLevel int) *fakeGitlabTarget {
+	return fg.addTarget(tokenTypeProject, id, path, map[int]int{fakeGitlabBackendUserID: backendAccessLevel})
+}
+
+// addGroup adds a group where the backend user has the given access level, 0 meaning no membership
+func (fg *fakeGitlab) addGroup(id int, path string, backendAccessLevel int) *fakeGitlabTarget {
+	return fg.addTarget(tokenTypeGroup, id, path, map[int]int{fakeGitlabBackendUserID: backendAccessLevel})
+}
+
+// setBackendAdmin makes the backend user an instance administrator
+func (fg *fakeGitlab) setBackendAdmin(admin bool) {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	fg.users[fakeGitlabBackendToken].Admin = admin
+}
+
+// setBackendAccess changes the access level of the backend user on a project or group, 0 removing its
+// membership and hiding the project or group from it
+func (fg *fakeGitlab) setBackendAccess(tokenType string, id int, accessLevel int) {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	fg.targets[fakeTargetKey(tokenType, id)].Members[fakeGitlabBackendUserID] = accessLevel
+}
+
+// revokeToken revokes a token outside of the backend, as a Gitlab user would
+func (fg *fakeGitlab) revokeToken(id int) {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	fg.tokens[id].Revoked = true
+}
+
+// addOAuthApp adds an OAuth application authorized by the backend user, and returns its first refresh token
+func (fg *fakeGitlab) addOAuthApp(clientID, secret, redirectURI string) string {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	fg.lastOAuthID++
+	refreshToken := fmt.Sprintf("fake-refresh-%d", fg.lastOAuthID)
+	fg.oauthApps[clientID] = &fakeGitlabOAuthApp{
+		Secret:        secret,
+		RedirectURI:   redirectURI,
+		RefreshTokens: map[string]bool{refreshToken: true},
+	}
+	return refreshToken
+}
+
+// oauthRefreshes returns how many times the access token of an OAuth application was refreshed
+func (fg *fakeGitlab) oauthRefreshes(clientID string) int {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	return fg.oauthApps[clientID].Refreshes
+}
+
+// fail makes the next count requests matching method and the path pattern fail with status and message
+func (fg *fakeGitlab) fail(method, pathPattern string, count, status int, message string) {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	fg.faults = append(fg.faults, &fakeGitlabFault{
+		Method:    method,
+		Path:      regexp.MustCompile(pathPattern),
+		Status:    status,
+		Message:   message,
+		Remaining: count,
+	})
+}
+
+// rateLimit makes the next count requests matching method and the path pattern fail with 429
+func (fg *fakeGitlab) rateLimit(method, pathPattern string, count int, retryAfter time.Duration) {
+	fg.fail(method, pathPattern, count, http.StatusTooManyRequests, "Retry later")
+
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+	fg.faults[len(fg.faults)-1].RetryAfter = strconv.Itoa(int(retryAfter.Seconds()))
+}
+
+// activeTokens returns the IDs of the tokens of a project or group that are neither revoked nor expired
+func (fg *fakeGitlab) activeTokens(tokenType string, id int) []int {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	var ids []int
+	for _, token := range fg.tokens {
+		if token.Target.Type == tokenType && token.Target.ID == id && token.active(time.Now()) {
+			ids = append(ids, token.ID)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// token returns a copy of an issued token
+func (fg *fakeGitlab) token(id int) (fakeGitlabToken, bool) {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	token, ok := fg.tokens[id]
+	if !ok {
+		return fakeGitlabToken{}, false
+	}
+	return *token, true
+}
+
+// requestCount returns the number of API requests served so far, failed ones included
+func (fg *fakeGitlab) requestCount() int {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	return fg.requests
+}
+
+func fakeTargetKey(tokenType string, id int) string {
+	return fmt.Sprintf("%s/%d", tokenType, id)
+}
+
+func (token *fakeGitlabToken) active(now time.Time) bool {
+	return !token.Revoked && (token.ExpiresAt == nil || now.Before(*token.ExpiresAt))
+}
+
+func (token *fakeGitlabToken) hasScope(scopes ...string) bool {
+	for _, have := range token.Scopes {
+		for _, want := range scopes {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (token *fakeGitlabToken) json() map[string]interface{} {
+	data := map[string]interface{}{
+		"id":           token.ID,
+		"user_id":      token.UserID,
+		"name":         token.Name,
+		"scopes":       token.Scopes,
+		"access_level": token.AccessLevel,
+		"created_at":   token.CreatedAt.Format(time.RFC3339),
+		"active":       token.active(time.Now()),
+		"revoked":      token.Revoked,
+		"expires_at":   nil,
+	}
+	if token.ExpiresAt != nil {
+		data["expires_at"] = token.ExpiresAt.Format("2006-01-02")
+	}
+	return data
+}
+
+// accessLevel returns the access level of a user on a target. Bot users of access tokens only have
+// access to the target of their token.
+func (target *fakeGitlabTarget) accessLevel(user *fakeGitlabUser) int {
+	if user.Token != nil {
+		if user.Token.Target == target {
+			return user.Token.AccessLevel
+		}
+		return 0
+	}
+	return target.Members[user.ID]
+}
+
+func (fg *fakeGitlab) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	fg.requests++
+	w.Header().Set(headerRequestID, fmt.Sprintf("fake-%d", fg.requests))
+	w.Header().Set("Content-Type", "application/json")
+
+	for _, fault := range fg.faults {
+		if fault.Remaining > 0 && fault.Method == r.Method && fault.Path.MatchString(r.URL.Path) {
+			fault.Remaining--
+			if fault.RetryAfter != "" {
+				w.Header().Set(headerRetryAfter, fault.RetryAfter)
+			}
+			fakeGitlabError(w, fault.Status, fault.Message)
+			return
+		}
+	}
+
+	// go-gitlab probes the API root for rate limit headers
+	if r.URL.Path == "/api/v4/" {
+		fakeGitlabError(w, http.StatusNotFound, "404 Not Found")
+		return
+	}
+
+	if r.URL.Path == "/oauth/token" && r.Method == http.MethodPost {
+		fg.serveOAuthToken(w, r)
+		return
+	}
+
+	user, ok := fg.users[r.Header.Get("PRIVATE-TOKEN")]
+	if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); bearer != r.Header.Get("Authorization") {
+		access, found := fg.oauthAccess[bearer]
+		ok = found && time.Now().Before(access.ExpiresAt)
+		if ok {
+			user = access.User
+		}
+	}
+	if !ok || (user.Token != nil && !user.Token.active(time.Now())) {
+		fakeGitlabError(w, http.StatusUnauthorized, "401 Unauthorized")
+		return
+	}
+	if user.Token != nil {
+		write := r.Method != http.MethodGet
+		if (write && !user.Token.hasScope("api")) || (!write && !user.Token.hasScope("api", "read_api")) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":"insufficient_scope","error_description":"The request requires higher privileges than provided by the access token."}`)
+			return
+		}
+	}
+
+	// Gitlab lets administrators make requests as another user, with a token that has the sudo scope
+	if sudo := r.Header.Get("Sudo"); sudo != "" {
+		if !user.Admin {
+			fakeGitlabError(w, http.StatusForbidden, "403 Forbidden - Must be admin to use sudo")
+			return
+		}
+		if user = fg.userByName(sudo); user == nil {
+			fakeGitlabError(w, http.StatusNotFound, fmt.Sprintf("404 No user id or username for: %s Not Found", sudo))
+			return
+		}
+	}
+
+	// paths used as IDs are URL encoded
+	path := r.URL.EscapedPath()
+	switch {
+	case fakeRouteUser.MatchString(path) && r.Method == http.MethodGet:
+		fakeGitlabJSON(w, http.StatusOK, map[string]interface{}{
+			"id":       user.ID,
+			"username": user.Username,
+			"is_admin": user.Admin,
+			"bot":      user.Token != nil,
+		})
+	case fakeRouteUserByID.MatchString(path) && r.Method == http.MethodGet:
+		id, _ := strconv.Atoi(fakeRouteUserByID.FindStringSubmatch(path)[1])
+		for _, u := range fg.users {
+			if u.ID == id {
+				fakeGitlabJSON(w, http.StatusOK, map[string]interface{}{"id": u.ID, "username": u.Username, "bot": u.Token != nil})
+				return
+			}
+		}
+		fakeGitlabJSON(w, http.StatusNotFound, map[string]interface{}{"message": "404 User Not Found"})
+	case fakeRouteTarget.MatchString(path) && r.Method == http.MethodGet:
+		m := fakeRouteTarget.FindStringSubmatch(path)
+		target, ok := fg.visibleTarget(w, user, m[1], m[2])
+		if !ok {
+			return
+		}
+		fg.serveTarget(w, user, target)
+	case fakeRouteMember.MatchString(path) && r.Method == http.MethodGet:
+		m := fakeRouteMember.FindStringSubmatch(path)
+		target, ok := fg.visibleTarget(w, user, "groups", m[1])
+		if !ok {
+			return
+		}
+		userID, _ := strconv.Atoi(m[2])
+		level := target.Members[userID]
+		if level == 0 {
+			fakeGitlabError(w, http.StatusNotFound, "404 Not found")
+			return
+		}
+		fakeGitlabJSON(w, http.StatusOK, map[string]interface{}{"id": userID, "access_level": level})
+	case fakeRouteAccessTokens.MatchString(path):
+		m := fakeRouteAccessTokens.FindStringSubmatch(path)
+		target, ok := fg.maintainedTarget(w, user, m[1], m[2])
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			fg.listTokens(w, target)
+		case http.MethodPost:
+			fg.createToken(w, r, user, target)
+		default:
+			fakeGitlabError(w, http.StatusMethodNotAllowed, "405 Method Not Allowed")
+		}
+	case fakeRouteAccessToken.MatchString(path) && r.Method == http.MethodDelete:
+		m := fakeRouteAccessToken.FindStringSubmatch(path)
+		target, ok := fg.maintainedTarget(w, user, m[1], m[2])
+		if !ok {
+			return
+		}
+		tokenID, _ := strconv.Atoi(m[3])
+		token, ok := fg.tokens[tokenID]
+		if !ok || token.Target != target || token.Revoked {
+			fakeGitlabError(w, http.StatusNotFound, "404 Could not find token")
+			return
+		}
+		token.Revoked = true
+		w.WriteHeader(http.StatusNoContent)
+	case fakeRouteRotateToken.MatchString(path) && r.Method == http.MethodPost:
+		m := fakeRouteRotateToken.FindStringSubmatch(path)
+		target, ok := fg.maintainedTarget(w, user, m[1], m[2])
+		if !ok {
+			return
+		}
+		tokenID, _ := strconv.Atoi(m[3])
+		fg.rotateToken(w, r, target, tokenID)
+	default:
+		fakeGitlabError(w, http.StatusNotFound, "404 Not Found")
+	}
+}
+
+// visibleTarget looks up a project or group the user can see, answering 404 otherwise as Gitlab does
+func (fg *fakeGitlab) visibleTarget(w http.ResponseWriter, user *fakeGitlabUser, kind, rawID string) (*fakeGitlabTarget, bool) {
+	tokenType := tokenTypeProject
+	notFound := "404 Project Not Found"
+	if kind == "groups" {
+		tokenType = tokenTypeGroup
+		notFound = "404 Group Not Found"
+	}
+	var target *fakeGitlabTarget
+	var ok bool
+	if id, err := strconv.Atoi(rawID); err == nil {
+		target, ok = fg.targets[fakeTargetKey(tokenType, id)]
+	} else if path, err := url.PathUnescape(rawID); err == nil {
+		for _, t := range fg.targets {
+			if t.Type == tokenType && t.Path == path {
+				target, ok = t, true
+			}
+		}
+	}
+	if !ok || (!user.Admin && target.accessLevel(user) == 0) {
+		fakeGitlabError(w, http.StatusNotFound, notFound)
+		return nil, false
+	}
+	return target, true
+}
+
+// maintainedTarget looks up a project or group on which the user can manage access tokens
+func (fg *fakeGitlab) maintainedTarget(w http.ResponseWriter, user *fakeGitlabUser, kind, rawID string) (*fakeGitlabTarget, bool) {
+	target, ok := fg.visibleTarget(w, user, kind, rawID)
+	if !ok {
+		return nil, false
+	}
+	if !user.Admin && target.accessLevel(user) < accessLevelMaintainer {
+		fakeGitlabError(w, http.StatusForbidden, "403 Forbidden")
+		return nil, false
+	}
+	return target, true
+}
+
+func (fg *fakeGitlab) serveTarget(w http.ResponseWriter, user *fakeGitlabUser, target *fakeGitlabTarget) {
+	if target.Type == tokenTypeGroup {
+		fakeGitlabJSON(w, http.StatusOK, map[string]interface{}{"id": target.ID, "full_path": target.Path})
+		return
+	}
+
+	var projectAccess interface{}
+	if level := target.accessLevel(user); level > 0 {
+		projectAccess = map[string]interface{}{"access_level": level}
+	}
+	fakeGitlabJSON(w, http.StatusOK, map[string]interface{}{
+		"id":                  target.ID,
+		"path_with_namespace": target.Path,
+		"permissions": map[string]interface{}{
+			"project_access": projectAccess,
+			"group_access":   nil,
+		},
+	})
+}
+
+func (fg *fakeGitlab) listTokens(w http.ResponseWriter, target *fakeGitlabTarget) {
+	ids := make([]int, 0, len(fg.tokens))
+	for id, token := range fg.tokens {
+		if token.Target == target && !token.Revoked {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	list := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, fg.tokens[id].json())
+	}
+	fakeGitlabJSON(w, http.StatusOK, list)
+}
+
+func (fg *fakeGitlab) createToken(w http.ResponseWriter, r *http.Request, user *fakeGitlabUser, target *fakeGitlabTarget) {
+	var body struct {
+		Name        string   `json:"name"`
+		Scopes      []string `json:"scopes"`
+		ExpiresAt   string   `json:"expires_at"`
+		AccessLevel *int     `json:"access_level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fakeGitlabError(w, http.StatusBadRequest, "400 Bad request - "+err.Error())
+		return
+	}
+
+	switch {
+	case body.Name == "":
+		fakeGitlabError(w, http.StatusBadRequest, "400 Bad request - name is missing")
+		return
+	case len(body.Scopes) == 0:
+		fakeGitlabError(w, http.StatusBadRequest, "400 Bad request - scopes is missing")
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !fakeGitlabScopes[scope] {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"scopes does not have a valid value"}`)
+			return
+		}
+	}
+
+	level := accessLevelMaintainer
+	if body.AccessLevel != nil {
+		level = *body.AccessLevel
+	}
+	switch level {
+	case accessLevelGuest, accessLevelPlanner, accessLevelReporter, accessLevelDeveloper, accessLevelMaintainer, accessLevelOwner:
+	case accessLevelMinimalAccess:
+		if target.Type != tokenTypeGroup {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"access_level does not have a valid value"}`)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"access_level does not have a valid value"}`)
+		return
+	}
+	if !user.Admin && level > target.accessLevel(user) {
+		fakeGitlabError(w, http.StatusBadRequest, "400 Bad request - Access level of the token can't be greater the access level of the user who created the token")
+		return
+	}
+
+	if target.TokensDisabled {
+		fakeGitlabError(w, http.StatusBadRequest, fmt.Sprintf("400 Bad request - User does not have permission to create %s access token", target.Type))
+		return
+	}
+
+	now := time.Now().UTC()
+	var expiresAt *time.Time
+	if body.ExpiresAt != "" {
+		date, err := time.Parse("2006-01-02", body.ExpiresAt)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"expires_at is invalid"}`)
+			return
+		}
+		if !date.After(now) {
+			fakeGitlabJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"message": map[string]interface{}{"expires_at": []string{"must be in the future"}},
+			})
+			return
+		}
+		expiresAt = &date
+	}
+
+	fg.lastTokenID++
+	token := &fakeGitlabToken{
+		ID:          fg.lastTokenID,
+		UserID:      1000 + fg.lastTokenID,
+		Target:      target,
+		Name:        body.Name,
+		Scopes:      body.Scopes,
+		AccessLevel: level,
+		Value:       fmt.Sprintf("glpat-fake-%d", fg.lastTokenID),
+		CreatedBy:   user.ID,
+		CreatedAt:   now,
+		ExpiresAt:   expiresAt,
+	}
+	fg.tokens[token.ID] = token
+	fg.users[token.Value] = &fakeGitlabUser{
+		ID:       token.UserID,
+		Username: fmt.Sprintf("%s_%d_bot_%d", target.Type, target.ID, token.ID),
+		Token:    token,
+	}
+
+	data := token.json()
+	data["token"] = token.Value
+	fakeGitlabJSON(w, http.StatusCreated, data)
+}
+
+// rotateToken revokes a token and creates a new one with the same name, scopes, access level and bot user.
+// Like Gitlab, the new token expires after a week unless expires_at is given.
+func (fg *fakeGitlab) rotateToken(w http.ResponseWriter, r *http.Request, target *fakeGitlabTarget, tokenID int) {
+	var body struct {
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fakeGitlabError(w, http.StatusBadRequest, "400 Bad request - "+err.Error())
+		return
+	}
+	old, ok := fg.tokens[tokenID]
+	if !ok || old.Target != target {
+		fakeGitlabError(w, http.StatusNotFound, "404 Could not find token")
+		return
+	}
+	now := time.Now().UTC()
+	if !old.active(now) {
+		fakeGitlabError(w, http.StatusBadRequest, "400 Bad request - Token already revoked or expired")
+		return
+	}
+	expiresAt := now.AddDate(0, 0, 7).Truncate(24 * time.Hour)
+	if body.ExpiresAt != "" {
+		date, err := time.Parse("2006-01-02", body.ExpiresAt)
+		if err != nil || !date.After(now) {
+			fakeGitlabError(w, http.StatusBadRequest, "400 Bad request - expires_at is invalid")
+			return
+		}
+		expiresAt = date
+	}
+
+	fg.lastTokenID++
+	token := *old
+	token.ID = fg.lastTokenID
+	token.Value = fmt.Sprintf("glpat-fake-%d", fg.lastTokenID)
+	token.CreatedAt = now
+	token.ExpiresAt = &expiresAt
+	old.Revoked = true
+	fg.tokens[token.ID] = &token
+
+	bot := fg.users[old.Value]
+	delete(fg.users, old.Value)
+	bot.Token = &token
+	fg.users[token.Value] = bot
+
+	data := token.json()
+	data["token"] = token.Value
+	fakeGitlabJSON(w, http.StatusOK, data)
+}
+
+// serveOAuthToken implements the refresh token grant of the OAuth token endpoint. Like Gitlab, it
+// revokes the refresh token used and returns a new one.
+func (fg *fakeGitlab) serveOAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		fakeGitlabJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request"})
+		return
+	}
+	if grant := r.PostForm.Get("grant_type"); grant != "refresh_token" {
+		fakeGitlabJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":             "unsupported_grant_type",
+			"error_description": "The authorization grant type is not supported by the authorization server.",
+		})
+		return
+	}
+	app, ok := fg.oauthApps[r.PostForm.Get("client_id")]
+	if !ok || app.Secret != r.PostForm.Get("client_secret") {
+		fakeGitlabJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error":             "invalid_client",
+			"error_description": "Client authentication failed due to unknown client, no client authentication included, or unsupported authentication method.",
+		})
+		return
+	}
+	refreshToken := r.PostForm.Get("refresh_token")
+	if !app.RefreshTokens[refreshToken] || app.RedirectURI != r.PostForm.Get("redirect_uri") {
+		fakeGitlabJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":             "invalid_grant",
+			"error_description": "The provided authorization grant is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client.",
+		})
+		return
+	}
+
+	delete(app.RefreshTokens, refreshToken)
+	app.Refreshes++
+	response := fg.issueOAuthAccessToken()
+	refreshToken = fmt.Sprintf("fake-refresh-%d", fg.lastOAuthID)
+	app.RefreshTokens[refreshToken] = true
+	response["refresh_token"] = refreshToken
+
+	fakeGitlabJSON(w, http.StatusOK, response)
+}
+
+// issueOAuthAccessToken issues an OAuth access token of the backend user, and returns the token response.
+// The caller holds the lock.
+func (fg *fakeGitlab) issueOAuthAccessToken() map[string]interface{} {
+	fg.lastOAuthID++
+	accessToken := fmt.Sprintf("fake-access-%d", fg.lastOAuthID)
+	now := time.Now()
+	fg.oauthAccess[accessToken] = &fakeGitlabOAuthAccess{
+		User:      fg.users[fakeGitlabBackendToken],
+		ExpiresAt: now.Add(fg.oauthTokenTTL),
+	}
+
+	return map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(fg.oauthTokenTTL / time.Second),
+		"scope":        "api",
+		"created_at":   now.Unix(),
+	}
+}
+
+func fakeGitlabJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func fakeGitlabError(w http.ResponseWriter, status int, message string) {
+	fakeGitlabJSON(w, status, map[string]interface{}{"message": message})
+}
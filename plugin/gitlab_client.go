@@ -16,8 +16,10 @@ package gitlabtoken
 
 import (
 	"fmt"
+	"net/http"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/xanzy/go-gitlab"
 )
 
@@ -26,32 +28,90 @@ const (
 )
 
 type Client interface {
-	// ListProjectAccessToken(int) ([]*PAT, error)
+	// ListProjectAccessTokens returns the access tokens of a project, including revoked and expired ones
+	ListProjectAccessTokens(projectID int) ([]*PAT, error)
 	CreateProjectAccessToken(*BaseTokenStorageEntry, *time.Time) (*PAT, error)
-	// RevokeProjectAccessToken(*BaseTokenStorageEntry) error
+	RevokeProjectAccessToken(projectID int, tokenID int) error
+	CreateGroupAccessToken(*BaseTokenStorageEntry, *time.Time) (*PAT, error)
+	RevokeGroupAccessToken(groupID int, tokenID int) error
+	// RotateProjectAccessToken revokes a project access token and returns a new token with the same name,
+	// scopes and access level in its place, under a new ID
+	RotateProjectAccessToken(projectID int, tokenID int, expiresAt *time.Time) (*PAT, error)
+	RotateGroupAccessToken(groupID int, tokenID int, expiresAt *time.Time) (*PAT, error)
+	// GetTargetAccess returns what the backend identity can do on a project or group
+	GetTargetAccess(tokenType string, id int) (*TargetAccess, error)
+	// GetTargetID returns the ID of the project or group with the full path
+	GetTargetID(tokenType string, path string) (int, error)
+	// GetUsername returns the username of a user, such as the bot user of an access token
+	GetUsername(userID int) (string, error)
+	// Sudo returns a client making its calls as the Gitlab user username, so that they are attributed
+	// to and limited by that user. Gitlab only lets administrators impersonate users.
+	Sudo(username string) Client
 	Valid() bool
 }
 
+// TargetAccess is the access of the backend identity to a project or group
+type TargetAccess struct {
+	// Path is the full path of the project or group
+	Path string
+	// AccessLevel is the effective membership access level of the backend identity, including
+	// inherited membership. 0 if it is not a member
+	AccessLevel int
+	// Admin is true when the backend identity is an instance administrator
+	Admin bool
+	// AccessTokensAvailable is false when Gitlab does not serve the access tokens API of the project
+	// or group, for example because the feature is not available on the instance
+	AccessTokensAvailable bool
+}
+
 type gitlabClient struct {
 	client     *gitlab.Client
 	expiration time.Time
+	logger     hclog.Logger
+	// sudo is the username calls are made as, if any
+	sudo string
 }
 
 var _ Client = &gitlabClient{}
 
-func NewClient(config *ConfigStorageEntry) (Client, error) {
+// NewClient creates a Gitlab client from the backend configuration. API calls are logged to logger,
+// which may be nil.
+func NewClient(config *ConfigStorageEntry, logger hclog.Logger) (Client, error) {
 	if config == nil {
 		return nil, fmt.Errorf("gitlab backend configuration has not been set up")
 	}
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
 	gc := &gitlabClient{
 		expiration: time.Now().Add(clientTTL),
+		logger:     logger,
 	}
 
-	opt := gitlab.WithBaseURL(config.BaseURL)
-	if config.Token == "" {
+	// the credential is obtained by the provider of the config, except for a static token
+	credential := config.credential
+	if credential == nil {
+		if config.usesOAuth() || config.usesIdentityToken() {
+			return nil, fmt.Errorf("no credential has been obtained for the gitlab client")
+		}
+		credential = &gitlabCredential{token: config.Token}
+	}
+	if credential.token == "" {
 		return nil, fmt.Errorf("token isn't configured")
 	}
-	c, err := gitlab.NewClient(config.Token, opt)
+	// the client is replaced before its credential expires
+	if expiresAt := credential.expiresAt; !expiresAt.IsZero() && expiresAt.Add(-credentialRefreshMargin).Before(gc.expiration) {
+		gc.expiration = expiresAt.Add(-credentialRefreshMargin)
+	}
+
+	opt := gitlab.WithBaseURL(config.BaseURL)
+	var c *gitlab.Client
+	var err error
+	if credential.bearer {
+		c, err = gitlab.NewOAuthClient(credential.token, opt)
+	} else {
+		c, err = gitlab.NewClient(credential.token, opt)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Gitlab client iwht endpoint %s: %v", config.BaseURL, err)
 	}
@@ -60,14 +120,59 @@ func NewClient(config *ConfigStorageEntry) (Client, error) {
 	return gc, nil
 }
 
+func (gc *gitlabClient) Sudo(username string) Client {
+	impersonating := *gc
+	impersonating.sudo = username
+	impersonating.logger = gc.logger.With("sudo", username)
+	return &impersonating
+}
+
+// options are the request options of every call
+func (gc *gitlabClient) options() []gitlab.RequestOptionFunc {
+	if gc.sudo == "" {
+		return nil
+	}
+	return []gitlab.RequestOptionFunc{gitlab.WithSudo(gc.sudo)}
+}
+
 func (gc *gitlabClient) Valid() bool {
 	return gc != nil && time.Now().Before(gc.expiration)
 }
 
-// func (gc *gitlabClient) ListProjectAccessToken(pid int) ([]*PAT, error) {
+// observe records a Gitlab API call in metrics and logs, and wraps a failure into an *APIError
+func (gc *gitlabClient) observe(operation string, target apiTarget, start time.Time, resp *gitlab.Response, err error) error {
+	emitAPICall(operation, start, resp, err)
+
+	fields := []interface{}{"operation", operation, "duration", time.Since(start)}
+	apiErr := newAPIError(operation, target, resp, err)
+	if apiErr != nil {
+		gc.logger.Debug("gitlab api call failed", append(fields, errorLogFields(apiErr)...)...)
+		return apiErr
+	}
+	if resp != nil && resp.Response != nil {
+		fields = append(fields, "gitlab_request_id", resp.Header.Get(headerRequestID), "http_status", resp.StatusCode)
+	}
+	gc.logger.Debug("gitlab api call", fields...)
+	return nil
+}
+
+func (gc *gitlabClient) ListProjectAccessTokens(projectID int) ([]*PAT, error) {
+	opt := &gitlab.ListProjectAccessTokensOptions{PerPage: 100}
+	var pats []*PAT
+	for {
+		start := time.Now()
+		page, resp, err := gc.client.ProjectAccessTokens.ListProjectAccessTokens(projectID, opt, gc.options()...)
+		if err := gc.observe("list_project_access_tokens", apiTarget{Type: tokenTypeProject, ID: projectID}, start, resp, err); err != nil {
+			return nil, err
+		}
+		pats = append(pats, page...)
+		if resp.NextPage == 0 {
+			return pats, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
 
-// 	return nil, nil
-// }
 func (gc *gitlabClient) CreateProjectAccessToken(tokenStorage *BaseTokenStorageEntry, expiresAt *time.Time) (*PAT, error) {
 	opt := gitlab.CreateProjectAccessTokenOptions{
 		Name:   &tokenStorage.Name,
@@ -80,13 +185,245 @@ func (gc *gitlabClient) CreateProjectAccessToken(tokenStorage *BaseTokenStorageE
 	if tokenStorage.AccessLevel != 0 {
 		opt.AccessLevel = (*gitlab.AccessLevelValue)(&tokenStorage.AccessLevel)
 	}
-	pat, _, err := gc.client.ProjectAccessTokens.CreateProjectAccessToken(tokenStorage.ID, &opt)
-	if err != nil {
+	start := time.Now()
+	pat, resp, err := gc.client.ProjectAccessTokens.CreateProjectAccessToken(tokenStorage.ID, &opt, gc.options()...)
+	if err := gc.observe("create_project_access_token", tokenStorage.target(), start, resp, err); err != nil {
+		return nil, err
+	}
+	return pat, nil
+}
+
+// RevokeProjectAccessToken revokes a project access token. A token that no longer exists in Gitlab
+// is treated as revoked.
+func (gc *gitlabClient) RevokeProjectAccessToken(projectID int, tokenID int) error {
+	start := time.Now()
+	resp, err := gc.client.ProjectAccessTokens.DeleteProjectAccessToken(projectID, tokenID, gc.options()...)
+	err = gc.observe("revoke_project_access_token", apiTarget{Type: tokenTypeProject, ID: projectID}, start, resp, err)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return gc.confirmRevoked(tokenTypeProject, projectID, tokenID, err)
+	}
+	return err
+}
+
+func (gc *gitlabClient) CreateGroupAccessToken(tokenStorage *BaseTokenStorageEntry, expiresAt *time.Time) (*PAT, error) {
+	opt := gitlab.CreateGroupAccessTokenOptions{
+		Name:   &tokenStorage.Name,
+		Scopes: &tokenStorage.Scopes,
+	}
+	if expiresAt != nil {
+		expiration := gitlab.ISOTime(*expiresAt)
+		opt.ExpiresAt = &expiration
+	}
+	if tokenStorage.AccessLevel != 0 {
+		opt.AccessLevel = (*gitlab.AccessLevelValue)(&tokenStorage.AccessLevel)
+	}
+	start := time.Now()
+	gat, resp, err := gc.client.GroupAccessTokens.CreateGroupAccessToken(tokenStorage.ID, &opt, gc.options()...)
+	if err := gc.observe("create_group_access_token", tokenStorage.target(), start, resp, err); err != nil {
+		return nil, err
+	}
+	return (*PAT)(gat), nil
+}
+
+// RevokeGroupAccessToken revokes a group access token. A token that no longer exists in Gitlab
+// is treated as revoked.
+func (gc *gitlabClient) RevokeGroupAccessToken(groupID int, tokenID int) error {
+	start := time.Now()
+	resp, err := gc.client.GroupAccessTokens.DeleteGroupAccessToken(groupID, tokenID, gc.options()...)
+	err = gc.observe("revoke_group_access_token", apiTarget{Type: tokenTypeGroup, ID: groupID}, start, resp, err)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return gc.confirmRevoked(tokenTypeGroup, groupID, tokenID, err)
+	}
+	return err
+}
+
+// rotateAccessTokenOptions is the body of the rotate endpoints of project and group access tokens, which
+// go-gitlab does not implement yet
+type rotateAccessTokenOptions struct {
+	ExpiresAt *gitlab.ISOTime `url:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+func (gc *gitlabClient) RotateProjectAccessToken(projectID int, tokenID int, expiresAt *time.Time) (*PAT, error) {
+	start := time.Now()
+	pat, resp, err := gc.rotate(fmt.Sprintf("projects/%d/access_tokens/%d/rotate", projectID, tokenID), expiresAt)
+	if err := gc.observe("rotate_project_access_token", apiTarget{Type: tokenTypeProject, ID: projectID}, start, resp, err); err != nil {
+		return nil, err
+	}
+	return pat, nil
+}
+
+func (gc *gitlabClient) RotateGroupAccessToken(groupID int, tokenID int, expiresAt *time.Time) (*PAT, error) {
+	start := time.Now()
+	pat, resp, err := gc.rotate(fmt.Sprintf("groups/%d/access_tokens/%d/rotate", groupID, tokenID), expiresAt)
+	if err := gc.observe("rotate_group_access_token", apiTarget{Type: tokenTypeGroup, ID: groupID}, start, resp, err); err != nil {
 		return nil, err
 	}
 	return pat, nil
 }
 
-// func (gc *gitlabClient) RevokeProjectAccessToken(tokenStorage *BaseTokenStorageEntry) error {
-// 	return nil
-// }
+func (gc *gitlabClient) rotate(path string, expiresAt *time.Time) (*PAT, *gitlab.Response, error) {
+	var opt rotateAccessTokenOptions
+	if expiresAt != nil {
+		expiration := gitlab.ISOTime(*expiresAt)
+		opt.ExpiresAt = &expiration
+	}
+	req, err := gc.client.NewRequest(http.MethodPost, path, &opt, gc.options())
+	if err != nil {
+		return nil, nil, err
+	}
+	pat := new(PAT)
+	resp, err := gc.client.Do(req, pat)
+	if err != nil {
+		return nil, resp, err
+	}
+	return pat, resp, nil
+}
+
+// confirmRevoked checks a token whose revocation got a 404. Gitlab also answers 404 when the project
+// or group is not visible to the backend identity, so the token only counts as revoked when the
+// tokens of its project or group list it as inactive, or not at all. Otherwise notFound is returned.
+func (gc *gitlabClient) confirmRevoked(tokenType string, id int, tokenID int, notFound error) error {
+	var pats []*PAT
+	var err error
+	if tokenType == tokenTypeGroup {
+		pats, err = gc.listGroupAccessTokens(id)
+	} else {
+		pats, err = gc.ListProjectAccessTokens(id)
+	}
+	if err != nil {
+		return notFound
+	}
+	for _, pat := range pats {
+		if pat.ID == tokenID && pat.Active && !pat.Revoked {
+			return notFound
+		}
+	}
+	return nil
+}
+
+func (gc *gitlabClient) listGroupAccessTokens(groupID int) ([]*PAT, error) {
+	opt := &gitlab.ListGroupAccessTokensOptions{PerPage: 100}
+	var pats []*PAT
+	for {
+		start := time.Now()
+		page, resp, err := gc.client.GroupAccessTokens.ListGroupAccessTokens(groupID, opt, gc.options()...)
+		if err := gc.observe("list_group_access_tokens", apiTarget{Type: tokenTypeGroup, ID: groupID}, start, resp, err); err != nil {
+			return nil, err
+		}
+		for _, gat := range page {
+			pats = append(pats, (*PAT)(gat))
+		}
+		if resp.NextPage == 0 {
+			return pats, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// GetTargetAccess looks up the project or group and the membership of the backend identity in it
+func (gc *gitlabClient) GetTargetAccess(tokenType string, id int) (*TargetAccess, error) {
+	target := apiTarget{Type: tokenType, ID: id}
+
+	start := time.Now()
+	user, resp, err := gc.client.Users.CurrentUser(gc.options()...)
+	if err := gc.observe("get_current_user", apiTarget{}, start, resp, err); err != nil {
+		return nil, err
+	}
+	access := &TargetAccess{Admin: user.IsAdmin}
+
+	switch tokenType {
+	case tokenTypeGroup:
+		start = time.Now()
+		group, resp, err := gc.client.Groups.GetGroup(id, &gitlab.GetGroupOptions{WithProjects: gitlab.Bool(false)}, gc.options()...)
+		if err := gc.observe("get_group", target, start, resp, err); err != nil {
+			return nil, err
+		}
+		access.Path = group.FullPath
+
+		// the group members API has no inherited lookup in go-gitlab, so the request is built here
+		req, err := gc.client.NewRequest(http.MethodGet, fmt.Sprintf("groups/%d/members/all/%d", id, user.ID), nil, gc.options())
+		if err != nil {
+			return nil, err
+		}
+		start = time.Now()
+		var member gitlab.GroupMember
+		resp, err = gc.client.Do(req, &member)
+		// a 404 means the backend identity is not a member
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			err = nil
+		}
+		if err := gc.observe("get_group_member", target, start, resp, err); err != nil {
+			return nil, err
+		}
+		access.AccessLevel = int(member.AccessLevel)
+
+		start = time.Now()
+		_, resp, err = gc.client.GroupAccessTokens.ListGroupAccessTokens(id, &gitlab.ListGroupAccessTokensOptions{PerPage: 1}, gc.options()...)
+		access.AccessTokensAvailable, err = gc.probe("list_group_access_tokens", target, start, resp, err)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		start = time.Now()
+		project, resp, err := gc.client.Projects.GetProject(id, nil, gc.options()...)
+		if err := gc.observe("get_project", target, start, resp, err); err != nil {
+			return nil, err
+		}
+		access.Path = project.PathWithNamespace
+		if p := project.Permissions; p != nil {
+			if p.ProjectAccess != nil {
+				access.AccessLevel = int(p.ProjectAccess.AccessLevel)
+			}
+			if p.GroupAccess != nil && int(p.GroupAccess.AccessLevel) > access.AccessLevel {
+				access.AccessLevel = int(p.GroupAccess.AccessLevel)
+			}
+		}
+
+		start = time.Now()
+		_, resp, err = gc.client.ProjectAccessTokens.ListProjectAccessTokens(id, &gitlab.ListProjectAccessTokensOptions{PerPage: 1}, gc.options()...)
+		access.AccessTokensAvailable, err = gc.probe("list_project_access_tokens", target, start, resp, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return access, nil
+}
+
+func (gc *gitlabClient) GetTargetID(tokenType string, path string) (int, error) {
+	start := time.Now()
+	if tokenType == tokenTypeGroup {
+		group, resp, err := gc.client.Groups.GetGroup(path, &gitlab.GetGroupOptions{WithProjects: gitlab.Bool(false)}, gc.options()...)
+		if err := gc.observe("get_group", apiTarget{Type: tokenType, Path: path}, start, resp, err); err != nil {
+			return 0, err
+		}
+		return group.ID, nil
+	}
+	project, resp, err := gc.client.Projects.GetProject(path, nil, gc.options()...)
+	if err := gc.observe("get_project", apiTarget{Type: tokenType, Path: path}, start, resp, err); err != nil {
+		return 0, err
+	}
+	return project.ID, nil
+}
+
+func (gc *gitlabClient) GetUsername(userID int) (string, error) {
+	start := time.Now()
+	user, resp, err := gc.client.Users.GetUser(userID, gitlab.GetUsersOptions{}, gc.options()...)
+	if err := gc.observe("get_user", apiTarget{Type: "user", ID: userID}, start, resp, err); err != nil {
+		return "", err
+	}
+	return user.Username, nil
+}
+
+// probe reports whether an API call was served. A 404 means the API is not available, and a 403 is
+// left to the access level checks of the caller.
+func (gc *gitlabClient) probe(operation string, target apiTarget, start time.Time, resp *gitlab.Response, err error) (bool, error) {
+	if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden) {
+		emitAPICall(operation, start, resp, err)
+		return resp.StatusCode != http.StatusNotFound, nil
+	}
+	if err := gc.observe(operation, target, start, resp, err); err != nil {
+		return false, err
+	}
+	return true, nil
+}
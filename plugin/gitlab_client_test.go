@@ -15,23 +15,32 @@
 package gitlabtoken
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
 )
 
 func TestNewClientFail(t *testing.T) {
 	t.Parallel()
 	t.Run("no config", func(t *testing.T) {
-		c, err := NewClient(nil)
+		c, err := NewClient(nil, nil)
 		assert.Error(t, err, "nil config should thrown an error when retrieving Gitlab client")
 		assert.Nil(t, c, "NewClient should return nil client on error")
 	})
 
 	t.Run("empty config", func(t *testing.T) {
 		config := &ConfigStorageEntry{}
-		c, err := NewClient(config)
+		c, err := NewClient(config, nil)
 		assert.Error(t, err, "NewClient should return an error if config is missing auth")
 		assert.Nil(t, c, "NewClient should return nil client on error")
 
@@ -69,21 +78,297 @@ func TestValid(t *testing.T) {
 	}
 }
 
-type mockGitlabClient struct{}
+func TestClientLogging(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if len(r.URL.Path) >= 14 {
+			w.Header().Set(headerRequestID, "req-"+r.URL.Path[len(r.URL.Path)-14:])
+		}
+		if r.URL.Path == "/api/v4/projects/2/access_tokens" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"message":"400 Bad request - Scopes can only contain available scopes"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":42,"name":"logged","scopes":["api"],"token":"glpat-do-not-log-me","access_level":40}`)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger := hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Trace})
+	c, err := NewClient(&ConfigStorageEntry{BaseURL: server.URL, Token: "backend-token"}, logger)
+	require.NoError(t, err)
+
+	pat, err := c.CreateProjectAccessToken(&BaseTokenStorageEntry{ID: 1, Name: "logged", Scopes: []string{"api"}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "glpat-do-not-log-me", pat.Token)
+
+	_, err = c.CreateProjectAccessToken(&BaseTokenStorageEntry{ID: 2, Name: "logged", Scopes: []string{"read_registry"}}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Scopes can only contain available scopes")
+	assert.Contains(t, err.Error(), "gitlab request id req-/access_tokens")
+
+	output := buf.String()
+	assert.Contains(t, output, "gitlab_request_id=req-/access_tokens")
+	assert.Contains(t, output, "http_status=201")
+	assert.Contains(t, output, "http_status=400")
+	assert.NotContains(t, output, "glpat-do-not-log-me")
+	assert.NotContains(t, output, "backend-token")
+}
+
+func TestClientGetTargetAccess(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v4/user":
+			fmt.Fprint(w, `{"id":9,"username":"vault-bot","is_admin":false}`)
+		case "/api/v4/projects/1":
+			fmt.Fprint(w, `{"id":1,"path_with_namespace":"team/app","permissions":{"project_access":{"access_level":30},"group_access":{"access_level":40}}}`)
+		case "/api/v4/projects/1/access_tokens":
+			fmt.Fprint(w, `[]`)
+		case "/api/v4/groups/2":
+			fmt.Fprint(w, `{"id":2,"full_path":"team"}`)
+		case "/api/v4/groups/2/members/all/9":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"404 Not found"}`)
+		case "/api/v4/groups/2/access_tokens":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"404 Not Found"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"404 Project Not Found"}`)
+		}
+	}))
+	defer server.Close()
+
+	c, err := NewClient(&ConfigStorageEntry{BaseURL: server.URL, Token: "backend-token"}, nil)
+	require.NoError(t, err)
+
+	access, err := c.GetTargetAccess(tokenTypeProject, 1)
+	require.NoError(t, err)
+	assert.Equal(t, &TargetAccess{Path: "team/app", AccessLevel: accessLevelMaintainer, AccessTokensAvailable: true}, access)
+
+	access, err = c.GetTargetAccess(tokenTypeGroup, 2)
+	require.NoError(t, err)
+	assert.Equal(t, &TargetAccess{Path: "team"}, access)
+
+	_, err = c.GetTargetAccess(tokenTypeProject, 3)
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, ErrorKindNotFound, apiErr.Kind())
+}
+
+func TestClientListProjectAccessTokens(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/api/v4/projects/1/access_tokens" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"404 Project Not Found"}`)
+			return
+		}
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `[{"id":12,"name":"second","active":false,"revoked":true}]`)
+			return
+		}
+		w.Header().Set("X-Next-Page", "2")
+		fmt.Fprint(w, `[{"id":11,"name":"first","active":true}]`)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(&ConfigStorageEntry{BaseURL: server.URL, Token: "backend-token"}, nil)
+	require.NoError(t, err)
+
+	pats, err := c.ListProjectAccessTokens(1)
+	require.NoError(t, err)
+	require.Len(t, pats, 2)
+	assert.Equal(t, 11, pats[0].ID)
+	assert.True(t, pats[0].Active)
+	assert.Equal(t, 12, pats[1].ID)
+	assert.True(t, pats[1].Revoked)
+
+	_, err = c.ListProjectAccessTokens(2)
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, ErrorKindNotFound, apiErr.Kind())
+}
+
+type mockGitlabClient struct {
+	lock   sync.Mutex
+	lastID int
+
+	revoked     map[int]bool
+	revokeError map[int]error
+	// projectTokens are the project access tokens by project ID
+	projectTokens map[int][]*PAT
+
+	// targets is the access returned by GetTargetAccess, keyed by "<token type>/<id>". Without any
+	// targets, the backend identity is Owner everywhere.
+	targets map[string]*TargetAccess
+
+	// sudo lists the users impersonated, in order
+	sudo []string
+	// targetIDs are the IDs returned by GetTargetID, keyed by "<token type>/<path>"
+	targetIDs map[string]int
+}
 
 var _ Client = &mockGitlabClient{}
 
+// GetUsername returns the username of the bot user the mock gives access tokens
+func (ac *mockGitlabClient) GetUsername(userID int) (string, error) {
+	return fmt.Sprintf("mock_bot_%d", userID), nil
+}
+
+// Sudo records the impersonated user. Calls are made as the backend identity, as the mock has no users.
+func (ac *mockGitlabClient) Sudo(username string) Client {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	ac.sudo = append(ac.sudo, username)
+	return ac
+}
+
 func (ac *mockGitlabClient) Valid() bool {
 	return true
 }
 
-// func (ac *mockGitlabClient) ListProjectAccessToken(id int) ([]*PAT, error) {
-// 	return nil, nil
-// }
+// ListProjectAccessTokens returns the tokens created on the project, and the untracked ones
+func (ac *mockGitlabClient) ListProjectAccessTokens(projectID int) ([]*PAT, error) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	var pats []*PAT
+	for _, pat := range ac.projectTokens[projectID] {
+		listed := *pat
+		listed.Token = ""
+		listed.Revoked = ac.revoked[pat.ID]
+		listed.Active = !listed.Revoked
+		pats = append(pats, &listed)
+	}
+	return pats, nil
+}
+
+// addUntrackedToken adds a token to a project that was not created through the backend
+func (ac *mockGitlabClient) addUntrackedToken(projectID int, name string) int {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	ac.lastID++
+
+	createdAt := time.Now().UTC()
+	if ac.projectTokens == nil {
+		ac.projectTokens = map[int][]*PAT{}
+	}
+	ac.projectTokens[projectID] = append(ac.projectTokens[projectID], &PAT{ID: ac.lastID, Name: name, CreatedAt: &createdAt, Active: true})
+	return ac.lastID
+}
+
 func (ac *mockGitlabClient) CreateProjectAccessToken(tokenStorage *BaseTokenStorageEntry, expiresAt *time.Time) (*PAT, error) {
-	return nil, nil
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	ac.lastID++
+
+	createdAt := time.Now().UTC()
+	pat := &PAT{
+		ID:          ac.lastID,
+		Name:        tokenStorage.Name,
+		Scopes:      tokenStorage.Scopes,
+		CreatedAt:   &createdAt,
+		Active:      true,
+		Token:       fmt.Sprintf("mock-token-%d", ac.lastID),
+		AccessLevel: gitlab.AccessLevelValue(tokenStorage.AccessLevel),
+	}
+	if expiresAt != nil {
+		expiration := gitlab.ISOTime(*expiresAt)
+		pat.ExpiresAt = &expiration
+	}
+	if tokenStorage.tokenType() == tokenTypeProject {
+		if ac.projectTokens == nil {
+			ac.projectTokens = map[int][]*PAT{}
+		}
+		ac.projectTokens[tokenStorage.ID] = append(ac.projectTokens[tokenStorage.ID], pat)
+	}
+	return pat, nil
+}
+
+func (ac *mockGitlabClient) RevokeProjectAccessToken(projectID int, tokenID int) error {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	if err, ok := ac.revokeError[tokenID]; ok {
+		return err
+	}
+	if ac.revoked == nil {
+		ac.revoked = map[int]bool{}
+	}
+	ac.revoked[tokenID] = true
+	return nil
+}
+
+func (ac *mockGitlabClient) CreateGroupAccessToken(tokenStorage *BaseTokenStorageEntry, expiresAt *time.Time) (*PAT, error) {
+	return ac.CreateProjectAccessToken(tokenStorage, expiresAt)
+}
+
+func (ac *mockGitlabClient) RevokeGroupAccessToken(groupID int, tokenID int) error {
+	return ac.RevokeProjectAccessToken(groupID, tokenID)
 }
 
-// func (ac *mockGitlabClient) RevokeProjectAccessToken(tokenStorage *BaseTokenStorageEntry) error {
-// 	return nil
-// }
+func (ac *mockGitlabClient) RotateProjectAccessToken(projectID int, tokenID int, expiresAt *time.Time) (*PAT, error) {
+	if err := ac.RevokeProjectAccessToken(projectID, tokenID); err != nil {
+		return nil, err
+	}
+	return ac.CreateProjectAccessToken(&BaseTokenStorageEntry{ID: projectID, Name: "rotated"}, expiresAt)
+}
+
+func (ac *mockGitlabClient) RotateGroupAccessToken(groupID int, tokenID int, expiresAt *time.Time) (*PAT, error) {
+	if err := ac.RevokeGroupAccessToken(groupID, tokenID); err != nil {
+		return nil, err
+	}
+	return ac.CreateGroupAccessToken(&BaseTokenStorageEntry{ID: groupID, Name: "rotated", TokenType: tokenTypeGroup}, expiresAt)
+}
+
+func (ac *mockGitlabClient) GetTargetAccess(tokenType string, id int) (*TargetAccess, error) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	if ac.targets == nil {
+		return &TargetAccess{Path: fmt.Sprintf("mock/%d", id), AccessLevel: accessLevelOwner, AccessTokensAvailable: true}, nil
+	}
+	access, ok := ac.targets[fmt.Sprintf("%s/%d", tokenType, id)]
+	if !ok {
+		return nil, &APIError{
+			Operation:  "get_target_access",
+			Target:     apiTarget{Type: tokenType, ID: id},
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	return access, nil
+}
+
+func (ac *mockGitlabClient) GetTargetID(tokenType string, path string) (int, error) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	id, ok := ac.targetIDs[fmt.Sprintf("%s/%s", tokenType, path)]
+	if !ok {
+		return 0, &APIError{
+			Operation:  "get_target_id",
+			Target:     apiTarget{Type: tokenType, Path: path},
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	return id, nil
+}
+
+func (ac *mockGitlabClient) isRevoked(tokenID int) bool {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	return ac.revoked[tokenID]
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// identityTemplated reports whether the role has fields resolved from the requesting entity
+func (role *RoleStorageEntry) identityTemplated() bool {
+	return role.PathTemplate != "" || role.ScopesTemplate != ""
+}
+
+// assertValidIdentityTemplates checks the syntax of the identity templates of the role, and that their
+// resolved values are restricted by allow patterns
+func (role *RoleStorageEntry) assertValidIdentityTemplates() error {
+	var err *multierror.Error
+	check := func(field, template string) {
+		if _, _, e := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+			String:            template,
+			ValidityCheckOnly: true,
+			Mode:              identitytpl.ACLTemplating,
+		}); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s is not a valid identity template: %w", field, e))
+		}
+	}
+
+	if role.PathTemplate != "" {
+		check("path_template", role.PathTemplate)
+		if role.BaseTokenStorage.ID != 0 {
+			err = multierror.Append(err, errors.New("id and path_template are mutually exclusive"))
+		}
+		if len(role.AllowedPaths) == 0 {
+			err = multierror.Append(err, errors.New("allowed_paths is required with path_template"))
+		}
+	}
+	if role.ScopesTemplate != "" {
+		check("scopes_template", role.ScopesTemplate)
+		if len(role.BaseTokenStorage.Scopes) > 0 {
+			err = multierror.Append(err, errors.New("scopes and scopes_template are mutually exclusive"))
+		}
+		if len(role.AllowedScopes) == 0 {
+			err = multierror.Append(err, errors.New("allowed_scopes is required with scopes_template"))
+		}
+	}
+	return err.ErrorOrNil()
+}
+
+// resolveIdentityTemplates returns a copy of the role with its scopes resolved from the requesting
+// entity, and the resolved path of the project or group, which the caller looks up in Gitlab. Resolved
+// values that do not match the allow patterns of the role are refused.
+func (b *GitlabBackend) resolveIdentityTemplates(req *logical.Request, role *RoleStorageEntry) (*RoleStorageEntry, string, error) {
+	if req.EntityID == "" {
+		return nil, "", fmt.Errorf("role '%s' is resolved from the requesting entity, and the request has no entity", role.RoleName)
+	}
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up entity %s: %w", req.EntityID, err)
+	}
+	if entity == nil {
+		return nil, "", fmt.Errorf("entity %s does not exist", req.EntityID)
+	}
+	groups, err := b.System().GroupsForEntity(req.EntityID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up the groups of entity %s: %w", req.EntityID, err)
+	}
+	populate := func(field, template string) (string, error) {
+		_, value, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+			String: template,
+			Entity: entity,
+			Groups: groups,
+			Mode:   identitytpl.ACLTemplating,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s for entity %s: %w", field, req.EntityID, err)
+		}
+		return strings.TrimSpace(value), nil
+	}
+
+	resolved := *role
+	var path string
+	if role.PathTemplate != "" {
+		if path, err = populate("path_template", role.PathTemplate); err != nil {
+			return nil, "", err
+		}
+		if !matchesAny(role.AllowedPaths, path) {
+			return nil, "", fmt.Errorf("path '%s' resolved for entity %s is not in allowed_paths", path, req.EntityID)
+		}
+	}
+	if role.ScopesTemplate != "" {
+		value, err := populate("scopes_template", role.ScopesTemplate)
+		if err != nil {
+			return nil, "", err
+		}
+		resolved.BaseTokenStorage.Scopes = strutil.ParseDedupAndSortStrings(value, ",")
+		for _, scope := range resolved.BaseTokenStorage.Scopes {
+			if !matchesAny(role.AllowedScopes, scope) {
+				return nil, "", fmt.Errorf("scope '%s' resolved for entity %s is not in allowed_scopes", scope, req.EntityID)
+			}
+		}
+	}
+	return &resolved, path, nil
+}
+
+// matchesAny reports whether value matches one of the patterns, which may start or end with a * glob
+func matchesAny(patterns []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if strutil.GlobbedStringsMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
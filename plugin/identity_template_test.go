@@ -0,0 +1,155 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleIdentityTemplates(t *testing.T) {
+	t.Parallel()
+
+	fg := newFakeGitlab(t)
+	fg.addProject(11, "team-a/api", accessLevelMaintainer)
+	fg.addProject(12, "team-a/web", accessLevelMaintainer)
+	fg.addProject(21, "team-b/api", accessLevelMaintainer)
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.System = &entitySystemView{entities: map[string]*logical.Entity{
+		"entity-a":     {ID: "entity-a", Metadata: map[string]string{"gitlab_project": "team-a/api", "gitlab_scopes": "read_api,read_repository"}},
+		"entity-a-web": {ID: "entity-a-web", Metadata: map[string]string{"gitlab_project": "team-a/web", "gitlab_scopes": "api"}},
+		"entity-b":     {ID: "entity-b", Metadata: map[string]string{"gitlab_project": "team-b/api", "gitlab_scopes": "read_api"}},
+		"entity-none":  {ID: "entity-none"},
+	}}
+	backend, err := Factory(context.Background(), config)
+	require.NoError(t, err)
+	storage := config.StorageView
+	testConfigUpdate(t, backend, storage, fg.config())
+
+	resp, err := testRoleCreate(t, backend, storage, "team-a", map[string]interface{}{
+		"name":            "team-ci",
+		"path_template":   "{{identity.entity.metadata.gitlab_project}}",
+		"allowed_paths":   "team-a/*",
+		"scopes_template": "{{identity.entity.metadata.gitlab_scopes}}",
+		"allowed_scopes":  "read_*",
+		"verify":          true,
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+	assert.Contains(t, resp.Warnings, "the project or group of the role is resolved when a token is requested, and was not verified")
+
+	issue := func(entityID string) (*logical.Response, error) {
+		t.Helper()
+		return testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: entityID}, "team-a", nil)
+	}
+
+	t.Run("the project and scopes are resolved from the entity", func(t *testing.T) {
+		resp, err := issue("entity-a")
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, []string{"read_api", "read_repository"}, resp.Data["scopes"])
+		assert.Len(t, fg.activeTokens(tokenTypeProject, 11), 1)
+
+		entry, err := getTokenInventoryEntry(context.Background(), storage, resp.Data["id"].(int))
+		require.NoError(t, err)
+		assert.Equal(t, 11, entry.ProjectID)
+	})
+
+	t.Run("resolved values outside the allow patterns are refused", func(t *testing.T) {
+		for entityID, message := range map[string]string{
+			"entity-b":     "path 'team-b/api' resolved for entity entity-b is not in allowed_paths",
+			"entity-a-web": "scope 'api' resolved for entity entity-a-web is not in allowed_scopes",
+			"entity-none":  "no value could be found",
+			"":             "the request has no entity",
+		} {
+			resp, err := issue(entityID)
+			require.NoError(t, err)
+			require.True(t, resp.IsError(), entityID)
+			assert.Contains(t, resp.Error().Error(), message)
+		}
+		assert.Empty(t, fg.activeTokens(tokenTypeProject, 21))
+		assert.Empty(t, fg.activeTokens(tokenTypeProject, 12))
+	})
+
+	t.Run("an allowed path that does not exist in Gitlab is not found", func(t *testing.T) {
+		config.System.(*entitySystemView).entities["entity-gone"] = &logical.Entity{
+			ID:       "entity-gone",
+			Metadata: map[string]string{"gitlab_project": "team-a/gone", "gitlab_scopes": "read_api"},
+		}
+		resp, err := issue("entity-gone")
+		assert.Equal(t, http.StatusNotFound, responseStatus(resp, err))
+	})
+}
+
+func TestRoleIdentityTemplatesValidation(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+
+	for name, c := range map[string]struct {
+		data    map[string]interface{}
+		message string
+	}{
+		"unbalanced template": {
+			data:    map[string]interface{}{"path_template": "{{identity.entity.metadata.project", "allowed_paths": "*", "scopes": "api"},
+			message: "path_template is not a valid identity template",
+		},
+		"id and path template": {
+			data:    map[string]interface{}{"id": 1, "path_template": "{{identity.entity.name}}", "allowed_paths": "*", "scopes": "api"},
+			message: "id and path_template are mutually exclusive",
+		},
+		"path template without allowed paths": {
+			data:    map[string]interface{}{"path_template": "{{identity.entity.name}}", "scopes": "api"},
+			message: "allowed_paths is required with path_template",
+		},
+		"scopes template without allowed scopes": {
+			data:    map[string]interface{}{"id": 1, "scopes_template": "{{identity.entity.metadata.scopes}}"},
+			message: "allowed_scopes is required with scopes_template",
+		},
+		"scopes and scopes template": {
+			data:    map[string]interface{}{"id": 1, "scopes": "api", "scopes_template": "{{identity.entity.metadata.scopes}}", "allowed_scopes": "api"},
+			message: "scopes and scopes_template are mutually exclusive",
+		},
+	} {
+		c.data["name"] = "team-ci"
+		resp, err := testRoleCreate(t, backend, storage, "templated", c.data)
+		require.NoError(t, err, name)
+		require.True(t, resp.IsError(), name)
+		assert.Contains(t, resp.Error().Error(), c.message, name)
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	t.Parallel()
+
+	patterns := []string{"team-a/*", "*/shared", "exact/project"}
+	assert.True(t, matchesAny(patterns, "team-a/api"))
+	assert.True(t, matchesAny(patterns, "team-b/shared"))
+	assert.True(t, matchesAny(patterns, "exact/project"))
+	assert.False(t, matchesAny(patterns, "team-b/api"))
+	assert.False(t, matchesAny(patterns, "exact/project2"))
+	assert.False(t, matchesAny([]string{"*"}, ""))
+}
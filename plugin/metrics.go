@@ -0,0 +1,142 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/xanzy/go-gitlab"
+)
+
+// Metrics are emitted through go-metrics, which Vault forwards to its configured telemetry sinks.
+var (
+	metricTokenIssue    = []string{"gitlab", "token", "issue"}
+	metricTokenIssueDur = []string{"gitlab", "token", "issue", "duration"}
+	metricAPICall       = []string{"gitlab", "api", "call"}
+	metricAPICallDur    = []string{"gitlab", "api", "call", "duration"}
+	metricClientCache   = []string{"gitlab", "client", "cache"}
+	metricQuotaExceeded = []string{"gitlab", "token", "quota", "exceeded"}
+)
+
+const (
+	outcomeSuccess  = "success"
+	outcomeFailure  = "failure"
+	outcomeRejected = "rejected"
+	outcomeLimited  = "limited"
+	outcomeReused   = "reused"
+
+	statusClassNone = "none"
+	// roleLabelUnknown labels requests for roles that do not exist, so that arbitrary paths do not
+	// create new metric series
+	roleLabelUnknown = "unknown"
+)
+
+// statusClass returns the HTTP status class of a Gitlab API call such as "2xx", or "none" when no
+// response was received
+func statusClass(resp *gitlab.Response, err error) string {
+	if resp != nil && resp.Response != nil {
+		return statusClassOf(resp.StatusCode)
+	}
+	return statusClassOf(errorStatus(err))
+}
+
+// statusClassOf returns the class of an HTTP status code, or "none" for 0
+func statusClassOf(status int) string {
+	if status == 0 {
+		return statusClassNone
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// errorStatus returns the HTTP status code of a failed Gitlab API call, or 0 when no response was received
+func errorStatus(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	var errResp *gitlab.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		return errResp.Response.StatusCode
+	}
+	return 0
+}
+
+// emitAPICall records the count and latency of a Gitlab API call
+func emitAPICall(operation string, start time.Time, resp *gitlab.Response, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeFailure
+	}
+	labels := []metrics.Label{
+		{Name: "operation", Value: operation},
+		{Name: "status_class", Value: statusClass(resp, err)},
+		{Name: "outcome", Value: outcome},
+	}
+	metrics.IncrCounterWithLabels(metricAPICall, 1, labels)
+	metrics.MeasureSinceWithLabels(metricAPICallDur, start, labels)
+}
+
+// emitTokenIssue records the outcome and latency of a token issuance request. status is the HTTP status of the
+// Gitlab call that created the token, and err the failed Gitlab call, if any. Requests that made neither are
+// labelled "none".
+func emitTokenIssue(operation, roleName, outcome string, start time.Time, status int, err error) {
+	if err != nil {
+		status = errorStatus(err)
+	}
+	labels := []metrics.Label{
+		{Name: "operation", Value: operation},
+		{Name: "role", Value: roleName},
+		{Name: "status_class", Value: statusClassOf(status)},
+		{Name: "outcome", Value: outcome},
+	}
+	metrics.IncrCounterWithLabels(metricTokenIssue, 1, labels)
+	metrics.MeasureSinceWithLabels(metricTokenIssueDur, start, labels)
+}
+
+// issueOutcome classifies the result of a token issuance request. A request that fails before Gitlab reports
+// an error is rejected. A non-empty outcome set by the handler, such as outcomeLimited, takes precedence.
+func issueOutcome(resp *logical.Response, gitlabErr error, outcome string) string {
+	switch {
+	case outcome != "":
+		return outcome
+	case gitlabErr != nil:
+		return outcomeFailure
+	case resp == nil || resp.IsError():
+		return outcomeRejected
+	default:
+		return outcomeSuccess
+	}
+}
+
+// emitClientCache records whether getClient could reuse the cached Gitlab client
+func emitClientCache(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	metrics.IncrCounterWithLabels(metricClientCache, 1, []metrics.Label{{Name: "result", Value: result}})
+}
+
+// emitQuotaExceeded records a token request rejected by a role quota
+func emitQuotaExceeded(roleName, quota string) {
+	metrics.IncrCounterWithLabels(metricQuotaExceeded, 1, []metrics.Label{
+		{Name: "role", Value: roleName},
+		{Name: "quota", Value: quota},
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestStatusClass(t *testing.T) {
+	t.Parallel()
+
+	ok := &gitlab.Response{Response: &http.Response{StatusCode: http.StatusCreated}}
+	assert.Equal(t, "2xx", statusClass(ok, nil))
+
+	notFound := &gitlab.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}
+	assert.Equal(t, "4xx", statusClass(nil, notFound))
+
+	assert.Equal(t, statusClassNone, statusClass(nil, errors.New("connection refused")))
+	assert.Equal(t, statusClassNone, statusClass(nil, nil))
+
+	apiErr := &APIError{Operation: "create_project_access_token", StatusCode: http.StatusForbidden, Err: notFound}
+	assert.Equal(t, http.StatusForbidden, errorStatus(apiErr))
+	assert.Equal(t, "4xx", statusClass(nil, apiErr))
+	assert.Equal(t, 0, errorStatus(&APIError{Err: errors.New("connection refused")}))
+}
+
+// TestMetrics swaps the global metrics sink, so it only asserts on keys it emits itself
+func TestMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(conf, sink)
+	require.NoError(t, err)
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+	mustRoleCreate(t, backend, storage, "metrics", map[string]interface{}{
+		"id":     1,
+		"name":   "metrics-test",
+		"scopes": []string{"read_api"},
+	})
+
+	req := &logical.Request{Storage: storage}
+	resp, err := testIssueRoleToken(t, backend, req, "metrics", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	resp, err = testIssueRoleToken(t, backend, req, "metrics", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	mustRoleCreate(t, backend, storage, "metrics-limited", map[string]interface{}{
+		"id":                1,
+		"name":              "metrics-test",
+		"scopes":            []string{"read_api"},
+		"max_active_tokens": 1,
+	})
+	resp, err = testIssueRoleToken(t, backend, req, "metrics-limited", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	_, err = testIssueRoleToken(t, backend, req, "metrics-limited", nil)
+	require.Error(t, err)
+
+	resp, err = testIssueRoleToken(t, backend, req, "no-such-role", nil)
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	resp, err = testIssueToken(t, backend, req, map[string]interface{}{"id": -1})
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	emitAPICall("create_project_access_token", time.Now(), nil, &gitlab.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusServiceUnavailable},
+	})
+
+	counters := map[string]int{}
+	samples := map[string]int{}
+	for _, interval := range sink.Data() {
+		for key, counter := range interval.Counters {
+			counters[key] += counter.Count
+		}
+		for key, sample := range interval.Samples {
+			samples[key] += sample.Count
+		}
+	}
+
+	assert.Equal(t, 2, counters["gitlab.token.issue;operation=create_role_token;role=metrics;status_class=2xx;outcome=success"])
+	assert.Equal(t, 1, counters["gitlab.token.issue;operation=create_role_token;role=unknown;status_class=none;outcome=rejected"])
+	assert.Zero(t, counters["gitlab.token.issue;operation=create_role_token;role=no-such-role;status_class=none;outcome=rejected"])
+	assert.Equal(t, 1, counters["gitlab.token.issue;operation=create_token;role=;status_class=none;outcome=rejected"])
+	assert.Equal(t, 1, samples["gitlab.token.issue.duration;operation=create_token;role=;status_class=none;outcome=rejected"])
+	assert.Equal(t, 1, counters["gitlab.api.call;operation=create_project_access_token;status_class=5xx;outcome=failure"])
+	assert.Equal(t, 1, counters["gitlab.token.issue;operation=create_role_token;role=metrics-limited;status_class=none;outcome=limited"])
+	assert.Equal(t, 1, counters["gitlab.token.quota.exceeded;role=metrics-limited;quota=active_tokens"])
+	assert.GreaterOrEqual(t, counters["gitlab.client.cache;result=hit"], 3)
+}
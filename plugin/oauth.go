@@ -0,0 +1,140 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/xanzy/go-gitlab"
+)
+
+// oauthToken is the response of an OAuth token endpoint
+type oauthToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// expiresAt returns when the access token expires, or the zero time if it does not
+func (t *oauthToken) expiresAt() time.Time {
+	if t.ExpiresIn <= 0 {
+		return time.Time{}
+	}
+	createdAt := time.Now()
+	if t.CreatedAt > 0 {
+		createdAt = time.Unix(t.CreatedAt, 0)
+	}
+	return createdAt.Add(time.Duration(t.ExpiresIn) * time.Second)
+}
+
+// oauthProvider authenticates as a Gitlab OAuth application
+type oauthProvider struct {
+	b *GitlabBackend
+}
+
+func (p *oauthProvider) name() string {
+	return "oauth"
+}
+
+// credential obtains an access token for the OAuth application of the config, and stores the refresh
+// token Gitlab returns in place of the one it used, which Gitlab revokes. The caller holds configLock.
+func (p *oauthProvider) credential(ctx context.Context, storage logical.Storage, config *ConfigStorageEntry) (*gitlabCredential, error) {
+	// refreshing rotates the stored refresh token, which only the active node of the primary cluster
+	// can write. Vault forwards requests failing with ErrReadOnly there.
+	if p.b.System().ReplicationState().HasState(consts.ReplicationPerformanceStandby | consts.ReplicationPerformanceSecondary) {
+		return nil, logical.ErrReadOnly
+	}
+
+	token, err := requestOAuthToken(ctx, "refresh_oauth_token", oauthTokenURL(config), url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {config.OAuthRefreshToken},
+		"client_id":     {config.OAuthClientID},
+		"client_secret": {config.OAuthClientSecret},
+		"redirect_uri":  {config.OAuthRedirectURI},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh the oauth access token: %w", err)
+	}
+
+	if token.RefreshToken != "" && token.RefreshToken != config.OAuthRefreshToken {
+		config.OAuthRefreshToken = token.RefreshToken
+		if err := config.save(ctx, storage); err != nil {
+			p.b.Logger().Error("failed to store the rotated oauth refresh token", "error", err)
+			return nil, fmt.Errorf("failed to store the refresh token returned by Gitlab, write a new oauth_refresh_token to config: %w", err)
+		}
+	}
+
+	p.b.Logger().Debug("refreshed oauth access token", "expires_at", token.expiresAt())
+	return &gitlabCredential{token: token.AccessToken, bearer: true, expiresAt: token.expiresAt()}, nil
+}
+
+// oauthTokenURL is the OAuth token endpoint of the Gitlab instance of the config. Gitlab does not
+// support the client credentials grant, so a refresh token is the only way for an application to
+// authenticate without a user.
+func oauthTokenURL(config *ConfigStorageEntry) string {
+	return strings.TrimSuffix(strings.TrimSuffix(config.BaseURL, "/"), "/api/v4") + "/oauth/token"
+}
+
+// requestOAuthToken posts a token request to an OAuth token endpoint
+func requestOAuthToken(ctx context.Context, operation, tokenURL string, form url.Values) (*oauthToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	resp, err := cleanhttp.DefaultClient().Do(req)
+	if err != nil {
+		emitAPICall(operation, start, nil, err)
+		return nil, &APIError{Operation: operation, Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("gitlab returned %s", resp.Status)
+	}
+	emitAPICall(operation, start, &gitlab.Response{Response: resp}, err)
+	if err != nil {
+		return nil, &APIError{
+			Operation:  operation,
+			StatusCode: resp.StatusCode,
+			RequestID:  resp.Header.Get(headerRequestID),
+			Message:    parseErrorBody(body, resp.Status),
+			Err:        err,
+		}
+	}
+
+	var token oauthToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("%s: failed to parse response: %w", operation, err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("%s: no access token was returned", operation)
+	}
+	return &token, nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOAuthRedirectURI = "https://vault.example.com/oauth/callback"
+
+// newGitlabOAuthEnv configures a backend to authenticate to the fake Gitlab as an OAuth application
+func newGitlabOAuthEnv(t *testing.T) (*logical.Request, logical.Backend, *fakeGitlab) {
+	t.Helper()
+
+	fg := newFakeGitlab(t)
+	refreshToken := fg.addOAuthApp("vault-app", "vault-secret", testOAuthRedirectURI)
+	backend, storage := getTestBackend(t, false)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url":            fg.URL,
+		"oauth_client_id":     "vault-app",
+		"oauth_client_secret": "vault-secret",
+		"oauth_redirect_uri":  testOAuthRedirectURI,
+		"oauth_refresh_token": refreshToken,
+	})
+
+	return &logical.Request{Storage: storage}, backend, fg
+}
+
+func TestConfigOAuthValidation(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, false)
+	oauth := map[string]interface{}{
+		"base_url":            "https://gitlab.example.com",
+		"oauth_client_id":     "vault-app",
+		"oauth_client_secret": "vault-secret",
+		"oauth_redirect_uri":  testOAuthRedirectURI,
+		"oauth_refresh_token": "refresh",
+	}
+
+	write := func(data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := backend.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      pathPatternConfig,
+			Data:      data,
+			Storage:   storage,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	both := map[string]interface{}{"token": "gibberish"}
+	for k, v := range oauth {
+		both[k] = v
+	}
+	resp := write(both)
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), "token and oauth credentials are mutually exclusive")
+
+	partial := map[string]interface{}{}
+	for k, v := range oauth {
+		if k != "oauth_refresh_token" {
+			partial[k] = v
+		}
+	}
+	resp = write(partial)
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), "oauth_refresh_token")
+
+	testConfigUpdate(t, backend, storage, oauth)
+	testConfigRead(t, backend, storage, map[string]interface{}{
+		"base_url":            "https://gitlab.example.com",
+		"max_ttl":             int64(0),
+		"ttl_policy":          ttlPolicyReject,
+		"inventory_retention": int64(defaultInventoryRetention / time.Second),
+		"oauth_client_id":     "vault-app",
+		"oauth_redirect_uri":  testOAuthRedirectURI,
+	})
+}
+
+func TestOAuthTokenIssue(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabOAuthEnv(t)
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	mustRoleCreate(t, backend, req.Storage, "app", map[string]interface{}{
+		"id":     1,
+		"name":   "app-ci",
+		"scopes": "read_api",
+		"verify": true,
+	})
+
+	resp, err := testIssueRoleToken(t, backend, req, "app", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+	assert.Len(t, fg.activeTokens(tokenTypeProject, 1), 1)
+	// the access token is reused until it nears expiry
+	assert.Equal(t, 1, fg.oauthRefreshes("vault-app"))
+
+	// Gitlab revokes a refresh token once used, so the rotated one must be stored
+	config, err := getConfig(context.Background(), req.Storage)
+	require.NoError(t, err)
+	assert.Equal(t, "fake-refresh-2", config.OAuthRefreshToken)
+
+	backend.(*GitlabBackend).reset()
+	resp, err = testIssueRoleToken(t, backend, req, "app", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+	assert.Equal(t, 2, fg.oauthRefreshes("vault-app"))
+}
+
+func TestOAuthAccessTokenExpiry(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabOAuthEnv(t)
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	mustRoleCreate(t, backend, req.Storage, "app", map[string]interface{}{
+		"id":     1,
+		"name":   "app-ci",
+		"scopes": "read_api",
+	})
+
+	// an access token expiring within the refresh margin is replaced on the next request
+	fg.lock.Lock()
+	fg.oauthTokenTTL = credentialRefreshMargin / 2
+	fg.lock.Unlock()
+	for i := 1; i <= 2; i++ {
+		resp, err := testIssueRoleToken(t, backend, req, "app", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, i, fg.oauthRefreshes("vault-app"))
+	}
+}
+
+func TestOAuthRefreshOutsideClientLock(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabOAuthEnv(t)
+	b := backend.(*GitlabBackend)
+	refreshing := make(chan struct{})
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			close(refreshing)
+			<-release
+		}
+		fg.serveHTTP(w, r)
+	}))
+	t.Cleanup(slow.Close)
+	testConfigUpdate(t, backend, req.Storage, map[string]interface{}{"base_url": slow.URL})
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := b.getClient(context.Background(), req.Storage)
+		errs <- err
+	}()
+	<-refreshing
+
+	// the client lock is free while Gitlab answers the refresh
+	locked := make(chan struct{})
+	go func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client lock is held while the oauth access token is refreshed")
+	}
+
+	close(release)
+	require.NoError(t, <-errs)
+	assert.NotNil(t, b.cachedClient())
+	assert.Equal(t, 1, fg.oauthRefreshes("vault-app"))
+}
+
+func TestOAuthInvalidRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabOAuthEnv(t)
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	mustRoleCreate(t, backend, req.Storage, "app", map[string]interface{}{
+		"id":     1,
+		"name":   "app-ci",
+		"scopes": "read_api",
+	})
+	testConfigUpdate(t, backend, req.Storage, map[string]interface{}{"oauth_refresh_token": "revoked"})
+
+	resp, err := testIssueRoleToken(t, backend, req, "app", nil)
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), "failed to refresh the oauth access token")
+	assert.Contains(t, resp.Error().Error(), "The provided authorization grant is invalid")
+	assert.Empty(t, fg.activeTokens(tokenTypeProject, 1))
+}
+
+func TestOAuthReadOnlyNodes(t *testing.T) {
+	t.Parallel()
+
+	for _, state := range []consts.ReplicationState{consts.ReplicationPerformanceStandby, consts.ReplicationPerformanceSecondary} {
+		fg := newFakeGitlab(t)
+		refreshToken := fg.addOAuthApp("vault-app", "vault-secret", testOAuthRedirectURI)
+		config := logical.TestBackendConfig()
+		config.StorageView = &logical.InmemStorage{}
+		config.System = &logical.StaticSystemView{ReplicationStateVal: state}
+		backend, err := Factory(context.Background(), config)
+		require.NoError(t, err)
+
+		// the config is replicated from the primary cluster
+		entry, err := logical.StorageEntryJSON(pathPatternConfig, &ConfigStorageEntry{
+			BaseURL:           fg.URL,
+			OAuthClientID:     "vault-app",
+			OAuthClientSecret: "vault-secret",
+			OAuthRedirectURI:  testOAuthRedirectURI,
+			OAuthRefreshToken: refreshToken,
+		})
+		require.NoError(t, err)
+		require.NoError(t, config.StorageView.Put(context.Background(), entry))
+		mustRoleCreate(t, backend, config.StorageView, "app", map[string]interface{}{
+			"id":     1,
+			"name":   "app-ci",
+			"scopes": "read_api",
+		})
+
+		req := &logical.Request{Storage: config.StorageView}
+		_, err = testIssueRoleToken(t, backend, req, "app", nil)
+		assert.ErrorIs(t, err, logical.ErrReadOnly, "replication state %v", state)
+		assert.Equal(t, 0, fg.oauthRefreshes("vault-app"))
+	}
+}
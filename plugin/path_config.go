@@ -43,18 +43,80 @@ var configSchema = map[string]*framework.FieldSchema{
 		Type:        framework.TypeString,
 		Description: `gitlab token that has permissions to generate project access tokens`,
 	},
+	"oauth_client_id": {
+		Type:        framework.TypeString,
+		Description: `ID of the Gitlab OAuth application the backend authenticates as, instead of token`,
+	},
+	"oauth_client_secret": {
+		Type:        framework.TypeString,
+		Description: `Secret of the Gitlab OAuth application`,
+	},
+	"oauth_redirect_uri": {
+		Type:        framework.TypeString,
+		Description: `Redirect URI of the Gitlab OAuth application, which Gitlab requires when refreshing tokens`,
+	},
+	"oauth_refresh_token": {
+		Type: framework.TypeString,
+		Description: `Refresh token of the Gitlab OAuth application, obtained by authorizing the application once.
+It is replaced by the refresh token Gitlab returns on every refresh`,
+	},
+	"identity_token_audience": {
+		Type:        framework.TypeString,
+		Description: `Audience of the plugin identity tokens exchanged for Gitlab access, instead of token`,
+	},
+	"identity_token_ttl": {
+		Type:        framework.TypeDurationSecond,
+		Description: `Time-to-live of plugin identity tokens`,
+		Default:     3600,
+	},
+	"identity_token_exchange_url": {
+		Type: framework.TypeString,
+		Description: `URL of the token exchange service (RFC 8693) that accepts plugin identity tokens and returns
+an OAuth access token for Gitlab`,
+	},
 	"max_ttl": {
 		Type:        framework.TypeDurationSecond,
-		Description: `Maximum lifetime a generated token will be valid for. If <= 0, will use system default(0, never expire)`,
+		Description: `Maximum lifetime a generated token will be valid for. If <= 0, will use system default(0, never expire). Writing 0 unsets it`,
+		Default:     0,
+	},
+	"ttl_policy": {
+		Type: framework.TypeLowerCaseString,
+		Description: `What to do when a token is requested with a ttl beyond a role or mount maximum: "reject" the request,
+or "clamp" the ttl to the maximum and return a warning. Writing an empty value resets it to "reject"`,
+		Default: ttlPolicyReject,
+	},
+	"inventory_retention": {
+		Type:        framework.TypeDurationSecond,
+		Description: `How long revoked or expired tokens are kept in the token inventory. If <= 0, will use system default(30 days). Writing 0 unsets it`,
 		Default:     0,
 	},
 }
 
 func configDetail(config *ConfigStorageEntry) map[string]interface{} {
-	return map[string]interface{}{
-		"base_url": config.BaseURL,
-		"max_ttl":  int64(config.MaxTTL / time.Second),
+	retention := config.InventoryRetention
+	if retention <= 0 {
+		retention = defaultInventoryRetention
+	}
+	detail := map[string]interface{}{
+		"base_url":            config.BaseURL,
+		"max_ttl":             int64(config.MaxTTL / time.Second),
+		"ttl_policy":          config.ttlLimits().Policy,
+		"inventory_retention": int64(retention / time.Second),
+	}
+	if config.usesOAuth() {
+		detail["oauth_client_id"] = config.OAuthClientID
+		detail["oauth_redirect_uri"] = config.OAuthRedirectURI
+	}
+	if config.usesIdentityToken() {
+		ttl := config.IdentityTokenTTL
+		if ttl <= 0 {
+			ttl = time.Duration(configSchema["identity_token_ttl"].Default.(int)) * time.Second
+		}
+		detail["identity_token_audience"] = config.IdentityTokenAudience
+		detail["identity_token_ttl"] = int64(ttl / time.Second)
+		detail["identity_token_exchange_url"] = config.IdentityTokenExchangeURL
 	}
+	return detail
 }
 
 func (b *GitlabBackend) pathConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -72,6 +134,12 @@ func (b *GitlabBackend) pathConfigRead(ctx context.Context, req *logical.Request
 }
 
 func (b *GitlabBackend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+	// the cached client still uses the previous config. It is dropped before configLock is released, so
+	// that no client is created from the previous config meanwhile.
+	defer b.reset()
+
 	warnings := []string{}
 
 	config, err := getConfig(ctx, req.Storage)
@@ -92,15 +160,38 @@ func (b *GitlabBackend) pathConfigWrite(ctx context.Context, req *logical.Reques
 	if token, ok := data.GetOk("token"); ok {
 		config.Token = token.(string)
 	}
+	if clientID, ok := data.GetOk("oauth_client_id"); ok {
+		config.OAuthClientID = clientID.(string)
+	}
+	if clientSecret, ok := data.GetOk("oauth_client_secret"); ok {
+		config.OAuthClientSecret = clientSecret.(string)
+	}
+	if redirectURI, ok := data.GetOk("oauth_redirect_uri"); ok {
+		config.OAuthRedirectURI = redirectURI.(string)
+	}
+	if refreshToken, ok := data.GetOk("oauth_refresh_token"); ok {
+		config.OAuthRefreshToken = refreshToken.(string)
+	}
+	if audience, ok := data.GetOk("identity_token_audience"); ok {
+		config.IdentityTokenAudience = audience.(string)
+	}
+	if ttlRaw, ok := data.GetOk("identity_token_ttl"); ok {
+		config.IdentityTokenTTL = time.Duration(ttlRaw.(int)) * time.Second
+	}
+	if exchangeURL, ok := data.GetOk("identity_token_exchange_url"); ok {
+		config.IdentityTokenExchangeURL = exchangeURL.(string)
+	}
 
-	maxTTLRaw, ok := data.GetOk("max_ttl")
-	if ok && maxTTLRaw.(int) > 0 {
-		// Until Gitlab implements granular token expiry.
-		// bounce anything less than 24 hours
-		if maxTTLRaw.(int) < (24 * 3600) {
+	if maxTTLRaw, ok := data.GetOk("max_ttl"); ok {
+		switch maxTTL := time.Duration(maxTTLRaw.(int)) * time.Second; {
+		case maxTTL <= 0:
+			config.MaxTTL = 0
+		case maxTTL < 24*time.Hour:
+			// Until Gitlab implements granular token expiry.
+			// bounce anything less than 24 hours
 			warnings = append(warnings, LT24HourTTLWarning("max_ttl"))
-		} else {
-			config.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
+		default:
+			config.MaxTTL = maxTTL
 		}
 	}
 
@@ -108,6 +199,22 @@ func (b *GitlabBackend) pathConfigWrite(ctx context.Context, req *logical.Reques
 		warnings = append(warnings, NoTTLWarning("max_ttl"))
 	}
 
+	if policyRaw, ok := data.GetOk("ttl_policy"); ok {
+		if policy := policyRaw.(string); policy != "" {
+			if err := validateTTLPolicy(policy); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+		config.TTLPolicy = policyRaw.(string)
+	}
+
+	if retentionRaw, ok := data.GetOk("inventory_retention"); ok {
+		config.InventoryRetention = 0
+		if retentionRaw.(int) > 0 {
+			config.InventoryRetention = time.Duration(retentionRaw.(int)) * time.Second
+		}
+	}
+
 	// maxTTLRaw, ok := data.GetOk("max_ttl")
 	// if ok && maxTTLRaw.(int) > 0 {
 	// 	config.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
@@ -115,12 +222,11 @@ func (b *GitlabBackend) pathConfigWrite(ctx context.Context, req *logical.Reques
 	// 	config.MaxTTL = time.Duration(configSchema["max_ttl"].Default.(int)) * time.Second
 	// }
 
-	entry, err := logical.StorageEntryJSON(pathPatternConfig, config)
-	if err != nil {
-		return nil, err
+	if err := config.assertValid(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	if err := config.save(ctx, req.Storage); err != nil {
 		return nil, err
 	}
 
@@ -130,6 +236,30 @@ func (b *GitlabBackend) pathConfigWrite(ctx context.Context, req *logical.Reques
 	}, nil
 }
 
+// pathConfigDelete removes the config and with it the Gitlab token. Roles are kept, and tokens can be
+// issued again once a new config is written.
+func (b *GitlabBackend) pathConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+	defer b.reset()
+
+	active, err := findActiveTokens(ctx, req.Storage, func(*TokenInventoryEntry) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Delete(ctx, pathPatternConfig); err != nil {
+		return nil, err
+	}
+
+	if len(active) == 0 {
+		return nil, nil
+	}
+	resp := &logical.Response{}
+	resp.AddWarning(fmt.Sprintf("%d issued tokens are still active and cannot be revoked until a config is written again", len(active)))
+	return resp, nil
+}
+
 func pathConfig(b *GitlabBackend) []*framework.Path {
 	paths := []*framework.Path{
 		{
@@ -144,6 +274,9 @@ func pathConfig(b *GitlabBackend) []*framework.Path {
 					Callback: b.pathConfigWrite,
 					Examples: configExamples,
 				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathConfigDelete,
+				},
 			},
 
 			HelpSynopsis:    pathConfigHelpSyn,
@@ -159,9 +292,11 @@ Configure the Gitlab backend.
 `
 
 const pathConfigHelpDesc = `
-The Gitlab backend requires credentials for creating a project access token.
-This endpoint is used to configure those credentials as well as default values
-for the backend in general.
+The Gitlab backend requires credentials for creating a project access token:
+a token, the credentials of a Gitlab OAuth application, or plugin identity
+tokens exchanged for Gitlab access. This endpoint is used to configure those
+credentials as well as default values for the backend in general. Deleting it
+removes the credentials and keeps roles.
 `
 
 var configExamples = []framework.RequestExample{
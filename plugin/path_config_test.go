@@ -17,6 +17,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
@@ -41,8 +42,10 @@ func TestConfig(t *testing.T) {
 		testConfigUpdate(t, backend, reqStorage, conf, NoTTLWarning("max_ttl"))
 
 		expected := map[string]interface{}{
-			"base_url": "https://my.gitlab.com",
-			"max_ttl":  int64(0),
+			"base_url":            "https://my.gitlab.com",
+			"max_ttl":             int64(0),
+			"ttl_policy":          ttlPolicyReject,
+			"inventory_retention": int64(defaultInventoryRetention / time.Second),
 		}
 
 		testConfigRead(t, backend, reqStorage, expected)
@@ -70,8 +73,10 @@ func TestConfig(t *testing.T) {
 		testConfigUpdate(t, backend, reqStorage, conf)
 
 		expected := map[string]interface{}{
-			"base_url": "https://my.gitlab.com",
-			"max_ttl":  int64(30 * 24 * 3600),
+			"base_url":            "https://my.gitlab.com",
+			"max_ttl":             int64(30 * 24 * 3600),
+			"ttl_policy":          ttlPolicyReject,
+			"inventory_retention": int64(defaultInventoryRetention / time.Second),
 		}
 
 		testConfigRead(t, backend, reqStorage, expected)
@@ -89,6 +94,150 @@ func TestConfig(t *testing.T) {
 
 		testConfigRead(t, backend, reqStorage, expected)
 	})
+
+	t.Run("ttl policy", func(t *testing.T) {
+		t.Parallel()
+
+		backend, reqStorage := getTestBackend(t, true)
+
+		conf := map[string]interface{}{
+			"base_url":   "https://my.gitlab.com",
+			"token":      "mytoken",
+			"ttl_policy": "clamp",
+		}
+
+		testConfigUpdate(t, backend, reqStorage, conf)
+
+		expected := map[string]interface{}{
+			"base_url":            "https://my.gitlab.com",
+			"max_ttl":             int64(0),
+			"ttl_policy":          ttlPolicyClamp,
+			"inventory_retention": int64(defaultInventoryRetention / time.Second),
+		}
+
+		testConfigRead(t, backend, reqStorage, expected)
+
+		resp, err := backend.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      pathPatternConfig,
+			Data:      map[string]interface{}{"ttl_policy": "ignore"},
+			Storage:   reqStorage,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		testConfigRead(t, backend, reqStorage, expected)
+	})
+
+	t.Run("inventory retention", func(t *testing.T) {
+		t.Parallel()
+
+		backend, reqStorage := getTestBackend(t, true)
+
+		conf := map[string]interface{}{
+			"base_url":            "https://my.gitlab.com",
+			"token":               "mytoken",
+			"inventory_retention": fmt.Sprintf("%dh", 7*24),
+		}
+
+		testConfigUpdate(t, backend, reqStorage, conf)
+
+		expected := map[string]interface{}{
+			"base_url":            "https://my.gitlab.com",
+			"max_ttl":             int64(0),
+			"ttl_policy":          ttlPolicyReject,
+			"inventory_retention": int64(7 * 24 * 3600),
+		}
+
+		testConfigRead(t, backend, reqStorage, expected)
+	})
+}
+
+func TestConfigDelete(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "https://my.gitlab.com",
+		"token":    "mytoken",
+	})
+	mustRoleCreate(t, backend, storage, "kept", map[string]interface{}{
+		"id":     1,
+		"name":   "kept",
+		"scopes": "read_api",
+	})
+	resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "kept", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	resp, err = testConfigDelete(t, backend, storage)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	assert.Contains(t, resp.Warnings[0], "1 issued tokens are still active")
+	assert.Nil(t, backend.(*GitlabBackend).client, "the cached client is dropped")
+
+	testConfigRead(t, backend, storage, nil)
+	entry, err := storage.Get(context.Background(), pathPatternConfig)
+	require.NoError(t, err)
+	assert.Nil(t, entry, "the token is wiped from storage")
+
+	resp, err = testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "kept", nil)
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), "configuration has not been set up")
+
+	resp, err = testRoleRead(t, backend, storage, "kept")
+	require.NoError(t, err)
+	require.NotNil(t, resp, "roles are kept")
+
+	testConfigUpdate(t, backend, storage, map[string]interface{}{"token": "newtoken"})
+	resp, err = testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "kept", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+}
+
+func TestConfigClearFields(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url":            "https://my.gitlab.com",
+		"token":               "mytoken",
+		"max_ttl":             "720h",
+		"ttl_policy":          ttlPolicyClamp,
+		"inventory_retention": "168h",
+	})
+	testConfigRead(t, backend, storage, map[string]interface{}{
+		"base_url":            "https://my.gitlab.com",
+		"max_ttl":             int64(30 * 24 * 3600),
+		"ttl_policy":          ttlPolicyClamp,
+		"inventory_retention": int64(7 * 24 * 3600),
+	})
+
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"max_ttl":             0,
+		"ttl_policy":          "",
+		"inventory_retention": 0,
+	}, NoTTLWarning("max_ttl"))
+	testConfigRead(t, backend, storage, map[string]interface{}{
+		"base_url":            "https://my.gitlab.com",
+		"max_ttl":             int64(0),
+		"ttl_policy":          ttlPolicyReject,
+		"inventory_retention": int64(defaultInventoryRetention / time.Second),
+	})
+
+	config, err := getConfig(context.Background(), storage)
+	require.NoError(t, err)
+	assert.Equal(t, "mytoken", config.Token, "fields not written are kept")
+}
+
+func testConfigDelete(t *testing.T, b logical.Backend, s logical.Storage) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      pathPatternConfig,
+		Storage:   s,
+	})
 }
 
 func testConfigUpdate(t *testing.T, b logical.Backend, s logical.Storage, d map[string]interface{}, warnings ...string) {
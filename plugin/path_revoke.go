@@ -0,0 +1,208 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+var revokeMaxParallelSchema = &framework.FieldSchema{
+	Type:        framework.TypeInt,
+	Description: "Maximum number of concurrent revocation calls to Gitlab",
+	Default:     defaultRevokeParallelism,
+}
+
+// revokeMatching revokes all active tokens in the inventory for which match returns true. When untracked is set, it
+// also looks up the active tokens in Gitlab that are not in the inventory, and revokes them if include_untracked is set.
+func (b *GitlabBackend) revokeMatching(ctx context.Context, req *logical.Request, data *framework.FieldData, match func(*TokenInventoryEntry) bool,
+	untracked func(Client) ([]*TokenInventoryEntry, error)) (*logical.Response, error) {
+	parallelism := data.Get("max_parallel").(int)
+	if parallelism <= 0 {
+		return logical.ErrorResponse("max_parallel must be greater than 0"), nil
+	}
+
+	gc, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return clientErrorResponse(err)
+	}
+
+	entries, err := findActiveTokens(ctx, req.Storage, match)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	var skipped []map[string]interface{}
+	if untracked != nil {
+		extra, err := untracked(gc)
+		switch {
+		case err != nil:
+			warnings = append(warnings, fmt.Sprintf("the access tokens could not be listed in Gitlab, only tokens in the inventory were revoked - %s", errorMessage(err)))
+		case data.Get("include_untracked").(bool):
+			entries = append(entries, extra...)
+		case len(extra) > 0:
+			for _, entry := range extra {
+				skipped = append(skipped, map[string]interface{}{"token_id": entry.TokenID, "name": entry.Name})
+			}
+			warnings = append(warnings, fmt.Sprintf("%d active token(s) in Gitlab are not in the token inventory and were not revoked, "+
+				"set include_untracked to revoke them", len(extra)))
+		}
+	}
+
+	results := revokeTokens(ctx, req.Storage, b.requestLogger(req), gc, entries, parallelism)
+
+	details := make([]map[string]interface{}, 0, len(results))
+	failed, unrecorded := 0, 0
+	for _, result := range results {
+		details = append(details, result.detail())
+		if result.Err != nil {
+			failed++
+		} else if result.Warning != nil {
+			unrecorded++
+		}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"revoked": len(results) - failed,
+			"failed":  failed,
+			"tokens":  details,
+		},
+		Warnings: warnings,
+	}
+	if skipped != nil {
+		resp.Data["untracked"] = skipped
+	}
+	if failed > 0 {
+		resp.AddWarning(fmt.Sprintf("%d token(s) could not be revoked", failed))
+	}
+	if unrecorded > 0 {
+		resp.AddWarning(fmt.Sprintf("%d token(s) were revoked but the token inventory could not be updated", unrecorded))
+	}
+	return resp, nil
+}
+
+func (b *GitlabBackend) pathRevokeRole(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName := data.Get("role_name").(string)
+	b.requestLogger(req, "role_name", roleName).Info("revoking all tokens of a role")
+	return b.revokeMatching(ctx, req, data, func(entry *TokenInventoryEntry) bool {
+		return entry.RoleName == roleName
+	}, nil)
+}
+
+func (b *GitlabBackend) pathRevokeProject(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	projectID := data.Get("id").(int)
+	b.requestLogger(req, "id", projectID).Info("revoking all tokens of a project")
+	return b.revokeMatching(ctx, req, data, func(entry *TokenInventoryEntry) bool {
+		return entry.tokenType() == tokenTypeProject && entry.ProjectID == projectID
+	}, func(gc Client) ([]*TokenInventoryEntry, error) {
+		return untrackedProjectTokens(ctx, req.Storage, gc, projectID)
+	})
+}
+
+func (b *GitlabBackend) pathRevokeEntity(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entityID := data.Get("entity_id").(string)
+	b.requestLogger(req, "entity_id", entityID).Info("revoking all tokens of an entity")
+	return b.revokeMatching(ctx, req, data, func(entry *TokenInventoryEntry) bool {
+		return entry.EntityID == entityID
+	}, nil)
+}
+
+// set up the paths for bulk revocation within vault
+func pathRevoke(b *GitlabBackend) []*framework.Path {
+	paths := []*framework.Path{
+		{
+			Pattern: fmt.Sprintf("%s/role/%s", pathPatternRevoke, framework.GenericNameRegex("role_name")),
+			Fields: map[string]*framework.FieldSchema{
+				"role_name": {
+					Type:        framework.TypeString,
+					Description: "Role name",
+				},
+				"max_parallel": revokeMaxParallelSchema,
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRevokeRole,
+					Summary:  "Revoke all active tokens issued for a role",
+				},
+			},
+			HelpSynopsis:    pathRevokeHelpSyn,
+			HelpDescription: pathRevokeHelpDesc,
+		},
+		{
+			Pattern: fmt.Sprintf("%s/project/(?P<id>\\d+)", pathPatternRevoke),
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeInt,
+					Description: "Project ID",
+				},
+				"max_parallel": revokeMaxParallelSchema,
+				"include_untracked": {
+					Type:        framework.TypeBool,
+					Description: "Also revoke the active tokens of the project in Gitlab that are not in the token inventory",
+					Default:     false,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRevokeProject,
+					Summary:  "Revoke all active tokens issued for a project",
+				},
+			},
+			HelpSynopsis:    pathRevokeHelpSyn,
+			HelpDescription: pathRevokeHelpDesc,
+		},
+		{
+			Pattern: fmt.Sprintf("%s/entity/%s", pathPatternRevoke, framework.GenericNameRegex("entity_id")),
+			Fields: map[string]*framework.FieldSchema{
+				"entity_id": {
+					Type:        framework.TypeString,
+					Description: "ID of the Vault entity that requested the tokens",
+				},
+				"max_parallel": revokeMaxParallelSchema,
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRevokeEntity,
+					Summary:  "Revoke all active tokens requested by an entity",
+				},
+			},
+			HelpSynopsis:    pathRevokeHelpSyn,
+			HelpDescription: pathRevokeHelpDesc,
+		},
+	}
+
+	return paths
+}
+
+const pathRevokeHelpSyn = `Revoke all active tokens issued for a role, a project or a requesting entity.`
+const pathRevokeHelpDesc = `
+These paths revoke every active token recorded in the token inventory that matches the given role,
+project or requesting entity. Revocation calls to Gitlab run concurrently, bounded by max_parallel.
+The response reports the outcome for each token.
+
+The token inventory only knows the tokens issued since it was introduced. Revoking by project also lists
+the active access tokens of the project in Gitlab, and reports those missing from the inventory as
+untracked. They are revoked too, and recorded in the inventory, with include_untracked. Tokens revoked in
+Gitlab whose inventory entry could not be updated are reported as revoked with a warning.
+
+A token Gitlab cannot find is only recorded as revoked when the tokens of its project or group list it as
+revoked or not at all. Gitlab also answers 404 when the project or group is not visible to the backend,
+and such tokens are reported as failed and stay active in the inventory.
+`
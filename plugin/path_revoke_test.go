@@ -0,0 +1,199 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathRevoke(t *testing.T) {
+	t.Parallel()
+	a := assert.New(t)
+
+	backend, storage := getTestBackend(t, true)
+	mock := backend.(*GitlabBackend).client.(*mockGitlabClient)
+	conf := map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	}
+	testConfigUpdate(t, backend, storage, conf)
+
+	mustRoleCreate(t, backend, storage, "project1", map[string]interface{}{
+		"id":     1,
+		"name":   "revoke-test",
+		"scopes": []string{"read_api"},
+	})
+	mustRoleCreate(t, backend, storage, "project2", map[string]interface{}{
+		"id":     2,
+		"name":   "revoke-test",
+		"scopes": []string{"read_api"},
+	})
+
+	issue := func(roleName, entityID string) int {
+		req := &logical.Request{
+			Storage:  storage,
+			EntityID: entityID,
+		}
+		resp, err := testIssueRoleToken(t, backend, req, roleName, nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		return resp.Data["id"].(int)
+	}
+
+	t1 := issue("project1", "entity-a")
+	t2 := issue("project1", "entity-b")
+	t3 := issue("project2", "entity-a")
+	t4 := issue("project2", "entity-b")
+
+	t.Run("by role", func(t *testing.T) {
+		resp, err := testRevoke(t, backend, storage, "role/project1", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		a.Equal(2, resp.Data["revoked"])
+		a.Equal(0, resp.Data["failed"])
+		a.True(mock.isRevoked(t1))
+		a.True(mock.isRevoked(t2))
+		a.False(mock.isRevoked(t3))
+
+		inventory, err := testTokenInventoryRead(t, backend, storage, t1)
+		require.NoError(t, err)
+		a.Equal(true, inventory.Data["revoked"])
+		a.Equal(tokenStatusRevoked, inventory.Data["status"])
+		a.NotEmpty(inventory.Data["revoked_at"])
+	})
+
+	t.Run("by entity with a failure", func(t *testing.T) {
+		mock.lock.Lock()
+		mock.revokeError = map[int]error{t4: errors.New("gitlab is down")}
+		mock.lock.Unlock()
+
+		resp, err := testRevoke(t, backend, storage, "entity/entity-b", map[string]interface{}{"max_parallel": 1})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		a.Equal(0, resp.Data["revoked"], "already revoked tokens should not be revoked again")
+		a.Equal(1, resp.Data["failed"])
+		a.Len(resp.Warnings, 1)
+		results := resp.Data["tokens"].([]map[string]interface{})
+		require.Len(t, results, 1)
+		a.Equal(t4, results[0]["token_id"])
+		a.Equal(false, results[0]["revoked"])
+		a.Contains(results[0]["error"], "gitlab is down")
+
+		inventory, err := testTokenInventoryRead(t, backend, storage, t4)
+		require.NoError(t, err)
+		a.Equal(false, inventory.Data["revoked"])
+	})
+
+	untracked := mock.addUntrackedToken(2, "issued-before-the-inventory")
+
+	t.Run("by project", func(t *testing.T) {
+		mock.lock.Lock()
+		mock.revokeError = nil
+		mock.lock.Unlock()
+
+		resp, err := testRevoke(t, backend, storage, "project/2", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		a.Equal(2, resp.Data["revoked"])
+		a.True(mock.isRevoked(t3))
+		a.True(mock.isRevoked(t4))
+		a.False(mock.isRevoked(untracked), "untracked tokens are only revoked on request")
+		a.Equal([]map[string]interface{}{{"token_id": untracked, "name": "issued-before-the-inventory"}}, resp.Data["untracked"])
+		a.Contains(resp.Warnings, "1 active token(s) in Gitlab are not in the token inventory and were not revoked, set include_untracked to revoke them")
+	})
+
+	t.Run("by project including untracked tokens", func(t *testing.T) {
+		resp, err := testRevoke(t, backend, storage, "project/2", map[string]interface{}{"include_untracked": true})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		a.Equal(1, resp.Data["revoked"])
+		a.True(mock.isRevoked(untracked))
+		a.Empty(resp.Warnings)
+
+		inventory, err := testTokenInventoryRead(t, backend, storage, untracked)
+		require.NoError(t, err)
+		a.Equal(tokenStatusRevoked, inventory.Data["status"])
+	})
+
+	t.Run("nothing to revoke", func(t *testing.T) {
+		resp, err := testRevoke(t, backend, storage, "project/2", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		a.Equal(0, resp.Data["revoked"])
+		a.Empty(resp.Data["tokens"])
+		a.Nil(resp.Data["untracked"])
+	})
+
+	t.Run("revoked tokens whose inventory update fails", func(t *testing.T) {
+		t5 := issue("project1", "entity-c")
+		failing := &failingPutStorage{Storage: storage, prefix: pathPatternTokens + "/"}
+
+		resp, err := testRevoke(t, backend, failing, "entity/entity-c", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		a.Equal(1, resp.Data["revoked"])
+		a.Equal(0, resp.Data["failed"])
+		a.True(mock.isRevoked(t5))
+		a.Contains(resp.Warnings, "1 token(s) were revoked but the token inventory could not be updated")
+		results := resp.Data["tokens"].([]map[string]interface{})
+		require.Len(t, results, 1)
+		a.Equal(true, results[0]["revoked"])
+		a.Contains(results[0]["warning"], "storage is unavailable")
+	})
+
+	t.Run("invalid parallelism", func(t *testing.T) {
+		resp, err := testRevoke(t, backend, storage, "project/2", map[string]interface{}{"max_parallel": 0})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+func testRevoke(t *testing.T, b logical.Backend, s logical.Storage, target string, data map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/%s", pathPatternRevoke, target),
+		Data:      data,
+		Storage:   s,
+	})
+	return resp, err
+}
+
+// failingPutStorage fails to write the entries under prefix
+type failingPutStorage struct {
+	logical.Storage
+	prefix string
+}
+
+func (s *failingPutStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		return errors.New("storage is unavailable")
+	}
+	return s.Storage.Put(ctx, entry)
+}
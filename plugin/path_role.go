@@ -47,20 +47,147 @@ var roleSchema = map[string]*framework.FieldSchema{
 		Description: "The TTL of the token",
 		Default:     24 * 3600, // 24 hours, until it hits midnight UTC
 	},
+	"max_ttl": {
+		Type:        framework.TypeDurationSecond,
+		Description: "The maximum TTL a token can be requested with. If <= 0, only the mount max_ttl applies",
+	},
 	"access_level": {
+		Type: framework.TypeString,
+		Description: `access level of the access token, as a name (minimal_access, guest, planner, reporter, developer,
+maintainer, owner) or a number. minimal_access is only allowed for group access tokens`,
+	},
+	"token_type": {
+		Type:        framework.TypeLowerCaseString,
+		Description: "Type of access token to create, project or group. id refers to a group for group access tokens",
+		Default:     tokenTypeProject,
+	},
+	"revoke_on_delete": {
+		Type: framework.TypeBool,
+		Description: `Revoke outstanding tokens when the role is deleted. Can also be passed when deleting the role.
+If false, the role stops issuing tokens and is removed once its outstanding tokens have expired or been revoked`,
+	},
+	"max_active_tokens": {
 		Type:        framework.TypeInt,
-		Description: "access level of project access token",
+		Description: "Maximum number of active tokens issued for the role. 0 for no limit",
+	},
+	"issue_rate": {
+		Type: framework.TypeString,
+		Description: `Maximum rate of token issuance for the role, as <count>/<period> where period is second, minute,
+hour, day or a duration, such as 10/minute or 100/12h. Empty for no limit`,
+	},
+	"reuse_tokens": {
+		Type: framework.TypeBool,
+		Description: `Return a cached live token to repeated requests of the same entity instead of creating a new token.
+Requests without an entity, or with a ttl, always get a new token. Cached tokens are seal wrapped where Vault supports
+it. Vault open source does not seal wrap, and stores them in plaintext behind the storage barrier`,
+	},
+	"reuse_min_remaining": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Minimum remaining lifetime of a cached token for it to be reused. Defaults to 1h",
+	},
+	"reuse_max_consumers": {
+		Type:        framework.TypeInt,
+		Description: "Maximum number of requests a cached token is returned to, including the first one. 0 for no limit",
+	},
+	"sudo_metadata_key": {
+		Type: framework.TypeString,
+		Description: `Create tokens as the Gitlab user named by this metadata key of the requesting entity, so that Gitlab
+attributes them to that user and checks that user's permissions. Requires an administrator backend token`,
+	},
+	"sudo_alias_mount_accessor": {
+		Type: framework.TypeString,
+		Description: `Create tokens as the Gitlab user named by the requesting entity's alias on the auth mount with this
+accessor. Requires an administrator backend token`,
+	},
+	"path_template": {
+		Type: framework.TypeString,
+		Description: `Identity template resolved to the full path of the project or group when a token is requested, such as
+{{identity.entity.metadata.gitlab_project}}. Set instead of id, along with allowed_paths`,
+	},
+	"allowed_paths": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Paths the resolved path_template must match. A path may start or end with a * glob, such as team-a/*",
+	},
+	"scopes_template": {
+		Type: framework.TypeString,
+		Description: `Identity template resolved to comma separated scopes when a token is requested. Set instead of scopes,
+along with allowed_scopes`,
+	},
+	"allowed_scopes": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Scopes the resolved scopes_template must match. A scope may start or end with a * glob",
+	},
+	"bound_claims": {
+		Type: framework.TypeKVPairs,
+		Description: `Claims the requesting entity must carry for a token to be issued, such as project_path=group/app and
+ref_protected=true, each with comma separated values that may start or end with a * glob`,
+	},
+	"bound_claims_mount_accessor": {
+		Type: framework.TypeString,
+		Description: `Read the bound claims from the metadata of the requesting entity's alias on the auth mount with this
+accessor, such as a JWT auth mount for Gitlab CI. Defaults to the entity metadata. Vault updates the alias
+metadata on every login, so these are the claims of the entity's most recent login through the mount; map each
+CI job to its own entity, and entities with more than one alias on the mount are refused`,
+	},
+	"require_response_wrapping": {
+		Type:        framework.TypeBool,
+		Description: "Refuse token requests that do not ask for their response to be wrapped, such as with -wrap-ttl",
+	},
+	"wrap_ttl": {
+		Type: framework.TypeDurationSecond,
+		Description: `TTL of the wrapping token responses to unwrapped token requests are wrapped with, unless
+require_response_wrapping is set, and the maximum wrap TTL token requests may ask for. 0 to leave wrapping to the requests`,
+	},
+	"template": {
+		Type: framework.TypeString,
+		Description: `Name of a role template in role-templates/. Fields not set on the role are taken from the template.
+Pass token_ttl=0 to take the TTL from the template`,
+	},
+	"effective": {
+		Type:        framework.TypeBool,
+		Description: "On read, also return the effective role with its template applied and the fields taken from the template",
+	},
+	"verify": {
+		Type: framework.TypeBool,
+		Description: `Check against Gitlab that the project or group exists, that its access tokens are available and
+that the backend token has at least Maintainer and the requested access_level on it. Not stored with the role`,
 	},
 }
 
 func roleDetail(role *RoleStorageEntry) map[string]interface{} {
+	tokenType := role.BaseTokenStorage.tokenType()
+	if role.Template != "" {
+		// an unset token type is taken from the template
+		tokenType = role.BaseTokenStorage.TokenType
+	}
 	return map[string]interface{}{
-		"role_name":    role.RoleName,
-		"id":           role.BaseTokenStorage.ID,
-		"name":         role.BaseTokenStorage.Name,
-		"scopes":       role.BaseTokenStorage.Scopes,
-		"access_level": role.BaseTokenStorage.AccessLevel,
-		"token_ttl":    int64(role.TokenTTL / time.Second),
+		"role_name":                   role.RoleName,
+		"id":                          role.BaseTokenStorage.ID,
+		"name":                        role.BaseTokenStorage.Name,
+		"scopes":                      role.BaseTokenStorage.Scopes,
+		"access_level":                role.BaseTokenStorage.AccessLevel,
+		"access_level_name":           accessLevelName(role.BaseTokenStorage.AccessLevel),
+		"token_type":                  tokenType,
+		"token_ttl":                   int64(role.TokenTTL / time.Second),
+		"max_ttl":                     int64(role.MaxTTL / time.Second),
+		"revoke_on_delete":            role.RevokeOnDelete,
+		"status":                      role.status(),
+		"template":                    role.Template,
+		"max_active_tokens":           role.MaxActiveTokens,
+		"issue_rate":                  formatIssueRate(role.IssueRateLimit, role.IssueRatePeriod),
+		"reuse_tokens":                role.ReuseTokens,
+		"reuse_min_remaining":         int64(role.reuseMinRemaining() / time.Second),
+		"reuse_max_consumers":         role.ReuseMaxConsumers,
+		"sudo_metadata_key":           role.SudoMetadataKey,
+		"sudo_alias_mount_accessor":   role.SudoAliasMountAccessor,
+		"path_template":               role.PathTemplate,
+		"allowed_paths":               role.AllowedPaths,
+		"scopes_template":             role.ScopesTemplate,
+		"allowed_scopes":              role.AllowedScopes,
+		"bound_claims":                role.BoundClaims,
+		"bound_claims_mount_accessor": role.BoundClaimsMountAccessor,
+		"require_response_wrapping":   role.RequireResponseWrapping,
+		"wrap_ttl":                    int64(role.WrapTTL / time.Second),
 	}
 }
 
@@ -73,8 +200,8 @@ func (b *GitlabBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.R
 	}
 
 	lock := b.roleLock(roleName)
-	lock.RLock()
-	defer lock.RUnlock()
+	lock.Lock()
+	defer lock.Unlock()
 
 	role, err := getRoleEntry(ctx, req.Storage, roleName)
 	if err != nil {
@@ -85,8 +212,17 @@ func (b *GitlabBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.R
 		role = &RoleStorageEntry{
 			RoleName: roleName,
 		}
+	} else if role.deleting() {
+		return logical.ErrorResponse("Role '%s' is being deleted", roleName), nil
 	}
 	role.retrieve(data)
+
+	b.templateLock.RLock()
+	defer b.templateLock.RUnlock()
+	effective, _, err := effectiveRole(ctx, req.Storage, role)
+	if err != nil {
+		return logical.ErrorResponse("Failed to validate - " + err.Error()), nil
+	}
 	config, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return logical.ErrorResponse("failed to obtain artifactory config - %s", err.Error()), nil
@@ -94,24 +230,46 @@ func (b *GitlabBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.R
 	if config == nil {
 		return logical.ErrorResponse("artifactory backend configuration has not been set up"), nil
 	}
-	err = role.assertValid(config.MaxTTL)
+	validateWarnings, err := effective.validate(config)
 	if err != nil {
 		return logical.ErrorResponse("Failed to validate - " + err.Error()), nil
 	}
-	if role.TokenTTL == 0 {
-		warnings = append(warnings, NoTTLWarning("token_ttl"))
+	var verified map[string]interface{}
+	if data.Get("verify").(bool) && effective.PathTemplate != "" {
+		warnings = append(warnings, "the project or group of the role is resolved when a token is requested, and was not verified")
+	} else if data.Get("verify").(bool) {
+		gc, err := b.getClient(ctx, req.Storage)
+		if err != nil {
+			return clientErrorResponse(err)
+		}
+		verification, err := verifyTokenTarget(gc, &effective.BaseTokenStorage, effective.impersonates())
+		if err != nil {
+			return gitlabErrorResponse("Failed to verify role against Gitlab", err)
+		}
+		if err := verification.Problems.ErrorOrNil(); err != nil {
+			return logical.ErrorResponse("Failed to verify - " + err.Error()), nil
+		}
+		verified = verification.detail()
+		for _, unknown := range verification.Unknown {
+			warnings = append(warnings, "could not be verified, as Gitlab does not expose it: "+unknown)
+		}
 	}
+	warnings = append(warnings, validateWarnings...)
 
 	if err := role.save(ctx, req.Storage); err != nil {
 		return logical.ErrorResponse(err.Error()), nil
 	}
-	b.Logger().Debug("successfully create role", "role_name", roleName, "id", role.BaseTokenStorage.ID,
+	b.requestLogger(req, "role_name", roleName).Debug("successfully create role", "id", role.BaseTokenStorage.ID,
 		"name", role.BaseTokenStorage.Name, "scopes", role.BaseTokenStorage.Scopes)
 
-	return &logical.Response{
+	resp := &logical.Response{
 		Data:     roleDetail(role),
 		Warnings: warnings,
-	}, nil
+	}
+	if verified != nil {
+		resp.Data["verification"] = verified
+	}
+	return resp, nil
 }
 
 func (b *GitlabBackend) pathRoleRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -125,8 +283,18 @@ func (b *GitlabBackend) pathRoleRead(ctx context.Context, req *logical.Request,
 		return nil, nil
 	}
 
+	detail := roleDetail(role)
+	if data.Get("effective").(bool) {
+		effective, inherited, err := effectiveRole(ctx, req.Storage, role)
+		if err != nil {
+			return logical.ErrorResponse("Failed to resolve role - " + err.Error()), nil
+		}
+		detail["effective"] = roleDetail(effective)
+		detail["inherited_fields"] = inherited
+	}
+
 	return &logical.Response{
-		Data: roleDetail(role),
+		Data: detail,
 	}, nil
 }
 
@@ -137,8 +305,8 @@ func (b *GitlabBackend) pathRoleDelete(ctx context.Context, req *logical.Request
 	}
 
 	lock := b.roleLock(roleName)
-	lock.RLock()
-	defer lock.RUnlock()
+	lock.Lock()
+	defer lock.Unlock()
 
 	// get the role to make sure it exists and to get the role id
 	role, err := getRoleEntry(ctx, req.Storage, roleName)
@@ -149,14 +317,77 @@ func (b *GitlabBackend) pathRoleDelete(ctx context.Context, req *logical.Request
 		return nil, nil
 	}
 
-	if err := deleteRoleEntry(ctx, req.Storage, roleName); err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("Unable to remove role %s", roleName)), err
+	revokeOnDelete := role.RevokeOnDelete
+	if revokeOnDeleteRaw, ok := data.GetOk("revoke_on_delete"); ok {
+		revokeOnDelete = revokeOnDeleteRaw.(bool)
 	}
 
-	b.Logger().Debug("successfully deleted role", "role_name", roleName)
+	outstanding, warnings, err := b.deleteRole(ctx, req, role, revokeOnDelete)
+	if err != nil {
+		return nil, err
+	}
+	if outstanding > 0 {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"status":             roleStatusDeleting,
+				"outstanding_tokens": outstanding,
+			},
+			Warnings: warnings,
+		}, nil
+	}
 	return nil, nil
 }
 
+// deleteRole deletes a role, or marks it as deleting when it still has outstanding tokens. With revokeOnDelete,
+// outstanding tokens are revoked first and only those that could not be revoked are left. It returns the number
+// of outstanding tokens. The caller must hold the role lock.
+func (b *GitlabBackend) deleteRole(ctx context.Context, req *logical.Request, role *RoleStorageEntry, revokeOnDelete bool) (int, []string, error) {
+	roleName := role.RoleName
+	logger := b.requestLogger(req, "role_name", roleName)
+	outstanding, err := findRoleActiveTokens(ctx, req.Storage, roleName)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var warnings []string
+	if len(outstanding) > 0 && revokeOnDelete {
+		gc, err := b.getClient(ctx, req.Storage)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("failed to obtain gitlab client, outstanding tokens were not revoked - %s", err.Error()))
+		} else {
+			results := revokeTokens(ctx, req.Storage, logger, gc, outstanding, defaultRevokeParallelism)
+			outstanding = outstanding[:0]
+			for _, result := range results {
+				if result.Err != nil {
+					warnings = append(warnings, fmt.Sprintf("failed to revoke token %d - %s", result.TokenID, errorMessage(result.Err)))
+					outstanding = append(outstanding, &TokenInventoryEntry{TokenID: result.TokenID})
+				} else if result.Warning != nil {
+					warnings = append(warnings, fmt.Sprintf("token %d - %s", result.TokenID, result.Warning.Error()))
+				}
+			}
+		}
+	}
+
+	if len(outstanding) > 0 {
+		role.Status = roleStatusDeleting
+		if err := role.save(ctx, req.Storage); err != nil {
+			return 0, nil, err
+		}
+		logger.Debug("role has outstanding tokens, marked as deleting", "outstanding_tokens", len(outstanding))
+
+		warnings = append(warnings, fmt.Sprintf("Role '%s' has %d outstanding token(s). It no longer issues tokens and will be "+
+			"removed once they have expired or been revoked. Tokens without expiry have to be revoked.", roleName, len(outstanding)))
+		return len(outstanding), warnings, nil
+	}
+
+	if err := deleteRoleEntry(ctx, req.Storage, roleName); err != nil {
+		return 0, nil, fmt.Errorf("unable to remove role %s: %w", roleName, err)
+	}
+
+	logger.Debug("successfully deleted role")
+	return 0, warnings, nil
+}
+
 func (b *GitlabBackend) pathRoleList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	roles, err := listRoleEntries(ctx, req.Storage)
 	if err != nil {
@@ -172,13 +403,10 @@ func pathRole(b *GitlabBackend) []*framework.Path {
 			Pattern: fmt.Sprintf("%s/%s", pathPatternRoles, framework.GenericNameRegex("role_name")),
 			Fields:  roleSchema,
 			Operations: map[logical.Operation]framework.OperationHandler{
-				logical.CreateOperation: &framework.PathOperation{
-					Callback: b.pathRoleCreateUpdate,
-					Summary:  "Create a role",
-					Examples: roleExamples,
-				},
 				logical.UpdateOperation: &framework.PathOperation{
 					Callback: b.pathRoleCreateUpdate,
+					Summary:  "Create or update a role",
+					Examples: roleExamples,
 				},
 				logical.ReadOperation: &framework.PathOperation{
 					Callback: b.pathRoleRead,
@@ -0,0 +1,460 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	roleDocumentFormatJSON = "json"
+	roleDocumentFormatYAML = "yaml"
+)
+
+var roleNameRegex = regexp.MustCompile("^" + framework.GenericNameRegex("role_name") + "$")
+
+var roleBulkSchema = map[string]*framework.FieldSchema{
+	"format": {
+		Type:        framework.TypeLowerCaseString,
+		Description: "Format of the exported document, json or yaml",
+		Default:     roleDocumentFormatJSON,
+	},
+	"document": {
+		Type: framework.TypeString,
+		Description: `JSON or YAML document describing roles, as {"roles": {"<role_name>": {<role parameters>}}}. Each role is
+fully described by the document: parameters that are not set take their default value`,
+	},
+	"dry_run": {
+		Type:        framework.TypeBool,
+		Description: "Validate the document and return the changes without applying them",
+	},
+	"delete_missing": {
+		Type: framework.TypeBool,
+		Description: `Delete the roles that are not in the document. Roles with outstanding tokens are deleted as with
+a delete on roles/<role_name>`,
+	},
+}
+
+// roleDocument is the document imported and exported by roles-bulk
+type roleDocument struct {
+	Roles map[string]map[string]interface{} `json:"roles" yaml:"roles"`
+}
+
+// roleDocumentEntry returns the parameters of a role as they appear in a role document
+func roleDocumentEntry(role *RoleStorageEntry) map[string]interface{} {
+	if role.Template != "" {
+		return templatedRoleDocumentEntry(role)
+	}
+	d := map[string]interface{}{
+		"id":               role.BaseTokenStorage.ID,
+		"name":             role.BaseTokenStorage.Name,
+		"scopes":           role.BaseTokenStorage.Scopes,
+		"token_type":       role.BaseTokenStorage.tokenType(),
+		"token_ttl":        int64(role.TokenTTL / time.Second),
+		"revoke_on_delete": role.RevokeOnDelete,
+	}
+	if role.MaxTTL > 0 {
+		d["max_ttl"] = int64(role.MaxTTL / time.Second)
+	}
+	addRoleIssuanceOptions(d, role)
+	if level := role.BaseTokenStorage.AccessLevel; level != 0 {
+		if name := accessLevelName(level); name != "" {
+			d["access_level"] = name
+		} else {
+			d["access_level"] = level
+		}
+	}
+	return d
+}
+
+// templatedRoleDocumentEntry returns only the fields a role referencing a template sets itself
+func templatedRoleDocumentEntry(role *RoleStorageEntry) map[string]interface{} {
+	base := &role.BaseTokenStorage
+	d := map[string]interface{}{
+		"template":         role.Template,
+		"revoke_on_delete": role.RevokeOnDelete,
+	}
+	if base.ID != 0 {
+		d["id"] = base.ID
+	}
+	if base.Name != "" {
+		d["name"] = base.Name
+	}
+	if len(base.Scopes) > 0 {
+		d["scopes"] = base.Scopes
+	}
+	if base.TokenType != "" {
+		d["token_type"] = base.TokenType
+	}
+	if role.TokenTTL > 0 {
+		d["token_ttl"] = int64(role.TokenTTL / time.Second)
+	}
+	if role.MaxTTL > 0 {
+		d["max_ttl"] = int64(role.MaxTTL / time.Second)
+	}
+	addRoleIssuanceOptions(d, role)
+	if base.AccessLevel != 0 {
+		if name := accessLevelName(base.AccessLevel); name != "" {
+			d["access_level"] = name
+		} else {
+			d["access_level"] = base.AccessLevel
+		}
+	}
+	return d
+}
+
+// addRoleIssuanceOptions adds the quota, token reuse, impersonation, identity template, claim binding and response wrapping options the role sets
+func addRoleIssuanceOptions(d map[string]interface{}, role *RoleStorageEntry) {
+	if role.MaxActiveTokens > 0 {
+		d["max_active_tokens"] = role.MaxActiveTokens
+	}
+	if role.IssueRateLimit > 0 {
+		d["issue_rate"] = formatIssueRate(role.IssueRateLimit, role.IssueRatePeriod)
+	}
+	if role.ReuseTokens {
+		d["reuse_tokens"] = true
+	}
+	if role.ReuseMinRemaining > 0 {
+		d["reuse_min_remaining"] = int64(role.ReuseMinRemaining / time.Second)
+	}
+	if role.ReuseMaxConsumers > 0 {
+		d["reuse_max_consumers"] = role.ReuseMaxConsumers
+	}
+	if role.SudoMetadataKey != "" {
+		d["sudo_metadata_key"] = role.SudoMetadataKey
+	}
+	if role.SudoAliasMountAccessor != "" {
+		d["sudo_alias_mount_accessor"] = role.SudoAliasMountAccessor
+	}
+	if role.PathTemplate != "" {
+		d["path_template"] = role.PathTemplate
+	}
+	if len(role.AllowedPaths) > 0 {
+		d["allowed_paths"] = role.AllowedPaths
+	}
+	if role.ScopesTemplate != "" {
+		d["scopes_template"] = role.ScopesTemplate
+	}
+	if len(role.AllowedScopes) > 0 {
+		d["allowed_scopes"] = role.AllowedScopes
+	}
+	if len(role.BoundClaims) > 0 {
+		d["bound_claims"] = role.BoundClaims
+	}
+	if role.BoundClaimsMountAccessor != "" {
+		d["bound_claims_mount_accessor"] = role.BoundClaimsMountAccessor
+	}
+	if role.RequireResponseWrapping {
+		d["require_response_wrapping"] = true
+	}
+	if role.WrapTTL > 0 {
+		d["wrap_ttl"] = int64(role.WrapTTL / time.Second)
+	}
+}
+
+// parseRoleDocument parses a JSON or YAML role document. JSON is parsed as YAML, of which it is a subset.
+func parseRoleDocument(document string) (*roleDocument, error) {
+	dec := yaml.NewDecoder(strings.NewReader(document))
+	dec.KnownFields(true)
+	var doc roleDocument
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse document: %w", err)
+	}
+	if doc.Roles == nil {
+		return nil, fmt.Errorf("document has no roles, an empty set of roles is written as {\"roles\": {}}")
+	}
+	return &doc, nil
+}
+
+// roleFromDocument builds the role described by a role document entry
+func roleFromDocument(roleName string, params map[string]interface{}) (*RoleStorageEntry, error) {
+	if !roleNameRegex.MatchString(roleName) {
+		return nil, fmt.Errorf("invalid role name")
+	}
+
+	var merr *multierror.Error
+	raw := map[string]interface{}{"role_name": roleName}
+	for k, v := range params {
+		if _, ok := roleSchema[k]; !ok || k == "role_name" || k == "verify" || k == "effective" {
+			merr = multierror.Append(merr, fmt.Errorf("unknown parameter '%s'", k))
+			continue
+		}
+		raw[k] = v
+	}
+	data := &framework.FieldData{Raw: raw, Schema: roleSchema}
+	if err := data.Validate(); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if err := merr.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+
+	role := &RoleStorageEntry{RoleName: roleName}
+	role.retrieve(data)
+	return role, nil
+}
+
+// roleChanges is the difference between the stored roles and a role document
+type roleChanges struct {
+	create    []*RoleStorageEntry
+	update    []*RoleStorageEntry
+	delete    []*RoleStorageEntry
+	unchanged []string
+}
+
+func roleNames(roles []*RoleStorageEntry) []string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, role.RoleName)
+	}
+	return names
+}
+
+func (b *GitlabBackend) pathRoleBulkExport(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	format := data.Get("format").(string)
+	if format != roleDocumentFormatJSON && format != roleDocumentFormatYAML {
+		return logical.ErrorResponse("format must be %s or %s", roleDocumentFormatJSON, roleDocumentFormatYAML), nil
+	}
+
+	roleNames, err := listRoleEntries(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	doc := roleDocument{Roles: map[string]map[string]interface{}{}}
+	var warnings []string
+	for _, roleName := range roleNames {
+		role, err := getRoleEntry(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			continue
+		}
+		if role.deleting() {
+			warnings = append(warnings, fmt.Sprintf("Role '%s' is being deleted and is not exported", roleName))
+			continue
+		}
+		doc.Roles[roleName] = roleDocumentEntry(role)
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case roleDocumentFormatYAML:
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		err = enc.Encode(doc)
+	default:
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"format":   format,
+			"document": buf.String(),
+			"roles":    len(doc.Roles),
+		},
+		Warnings: warnings,
+	}, nil
+}
+
+func (b *GitlabBackend) pathRoleBulkImport(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	document := data.Get("document").(string)
+	if document == "" {
+		return logical.ErrorResponse("document not supplied"), nil
+	}
+	dryRun := data.Get("dry_run").(bool)
+	deleteMissing := data.Get("delete_missing").(bool)
+
+	doc, err := parseRoleDocument(document)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return logical.ErrorResponse("failed to obtain gitlab config - %s", err.Error()), nil
+	}
+	if config == nil {
+		return logical.ErrorResponse("gitlab backend configuration has not been set up"), nil
+	}
+
+	existingNames, err := listRoleEntries(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	lockNames := existingNames
+	for roleName := range doc.Roles {
+		lockNames = append(lockNames, roleName)
+	}
+	// the locks are returned in a fixed order, so concurrent bulk imports cannot deadlock
+	for _, lock := range b.roleLocksFor(lockNames) {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	b.templateLock.RLock()
+	defer b.templateLock.RUnlock()
+
+	docNames := make([]string, 0, len(doc.Roles))
+	for roleName := range doc.Roles {
+		docNames = append(docNames, roleName)
+	}
+	sort.Strings(docNames)
+
+	var changes roleChanges
+	var merr *multierror.Error
+	var warnings []string
+	for _, roleName := range docNames {
+		role, err := roleFromDocument(roleName, doc.Roles[roleName])
+		var effective *RoleStorageEntry
+		if err == nil {
+			effective, _, err = effectiveRole(ctx, req.Storage, role)
+		}
+		if err == nil {
+			var roleWarnings []string
+			roleWarnings, err = effective.validate(config)
+			for _, w := range roleWarnings {
+				warnings = append(warnings, fmt.Sprintf("role '%s': %s", roleName, w))
+			}
+		}
+		if err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("role '%s': %w", roleName, err))
+			continue
+		}
+
+		existing, err := getRoleEntry(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case existing == nil:
+			changes.create = append(changes.create, role)
+		case existing.deleting():
+			merr = multierror.Append(merr, fmt.Errorf("role '%s': role is being deleted", roleName))
+		case reflect.DeepEqual(roleDocumentEntry(existing), roleDocumentEntry(role)):
+			changes.unchanged = append(changes.unchanged, roleName)
+		default:
+			changes.update = append(changes.update, role)
+		}
+	}
+	if err := merr.ErrorOrNil(); err != nil {
+		return logical.ErrorResponse("Failed to validate - " + err.Error()), nil
+	}
+
+	if deleteMissing {
+		sort.Strings(existingNames)
+		for _, roleName := range existingNames {
+			if _, ok := doc.Roles[roleName]; ok {
+				continue
+			}
+			role, err := getRoleEntry(ctx, req.Storage, roleName)
+			if err != nil {
+				return nil, err
+			}
+			if role != nil && !role.deleting() {
+				changes.delete = append(changes.delete, role)
+			}
+		}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":   dryRun,
+			"created":   roleNames(changes.create),
+			"updated":   roleNames(changes.update),
+			"deleted":   roleNames(changes.delete),
+			"unchanged": changes.unchanged,
+		},
+		Warnings: warnings,
+	}
+	if dryRun {
+		return resp, nil
+	}
+
+	logger := b.requestLogger(req)
+	for _, role := range append(changes.create, changes.update...) {
+		if err := role.save(ctx, req.Storage); err != nil {
+			return nil, fmt.Errorf("failed to save role '%s': %w", role.RoleName, err)
+		}
+	}
+	for _, role := range changes.delete {
+		_, deleteWarnings, err := b.deleteRole(ctx, req, role, role.RevokeOnDelete)
+		if err != nil {
+			return nil, err
+		}
+		resp.Warnings = append(resp.Warnings, deleteWarnings...)
+	}
+	logger.Debug("imported roles", "created", len(changes.create), "updated", len(changes.update),
+		"deleted", len(changes.delete), "unchanged", len(changes.unchanged))
+
+	return resp, nil
+}
+
+func pathRoleBulk(b *GitlabBackend) []*framework.Path {
+	paths := []*framework.Path{
+		{
+			Pattern: pathPatternRolesBulk,
+			Fields:  roleBulkSchema,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRoleBulkExport,
+					Summary:  "Export all roles as a JSON or YAML document",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRoleBulkImport,
+					Summary:  "Create, update and delete roles from a JSON or YAML document",
+					Examples: roleBulkExamples,
+				},
+			},
+			HelpSynopsis:    pathRoleBulkHelpSyn,
+			HelpDescription: pathRoleBulkHelpDesc,
+		},
+	}
+	return paths
+}
+
+const pathRoleBulkHelpSyn = `Import and export roles in bulk.`
+const pathRoleBulkHelpDesc = `
+Reading this path exports all roles as a JSON or YAML document. Writing a document creates and updates the roles
+it describes, and deletes the other roles with delete_missing. The document is validated as a whole: if any role is
+invalid, nothing is changed. With dry_run, the changes are returned without being applied.
+`
+
+var roleBulkExamples = []framework.RequestExample{
+	{
+		Description: "Import roles",
+		Data: map[string]interface{}{
+			"document": `{"roles": {"ci-role": {"id": 1, "name": "ci", "scopes": ["read_api"], "access_level": "developer"}}}`,
+			"dry_run":  true,
+		},
+	},
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathRoleBulk(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+
+	document := `{"roles": {
+		"ci": {"id": 1, "name": "ci", "scopes": ["read_api", "read_repository"], "access_level": "developer"},
+		"deploy": {"id": 2, "name": "deploy", "scopes": "api", "token_ttl": "1h", "max_ttl": 7200}
+	}}`
+
+	t.Run("dry run", func(t *testing.T) {
+		resp, err := testRoleBulkImport(t, backend, storage, map[string]interface{}{"document": document, "dry_run": true})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, []string{"ci", "deploy"}, resp.Data["created"])
+		assert.Empty(t, resp.Data["updated"])
+
+		resp, err = testRoleList(t, backend, storage)
+		require.NoError(t, err)
+		assert.Empty(t, resp.Data["keys"], "dry run should not create roles")
+	})
+
+	t.Run("import", func(t *testing.T) {
+		resp, err := testRoleBulkImport(t, backend, storage, map[string]interface{}{"document": document})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, []string{"ci", "deploy"}, resp.Data["created"])
+
+		resp, err = testRoleRead(t, backend, storage, "deploy")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"api"}, resp.Data["scopes"])
+		assert.EqualValues(t, 3600, resp.Data["token_ttl"])
+		assert.EqualValues(t, 7200, resp.Data["max_ttl"])
+		resp, err = testRoleRead(t, backend, storage, "ci")
+		require.NoError(t, err)
+		assert.Equal(t, accessLevelDeveloper, resp.Data["access_level"])
+	})
+
+	t.Run("export round trips", func(t *testing.T) {
+		for _, format := range []string{roleDocumentFormatJSON, roleDocumentFormatYAML} {
+			resp, err := testRoleBulkExport(t, backend, storage, format)
+			require.NoError(t, err)
+			require.False(t, resp.IsError())
+			assert.Equal(t, 2, resp.Data["roles"])
+
+			resp, err = testRoleBulkImport(t, backend, storage, map[string]interface{}{"document": resp.Data["document"], "dry_run": true})
+			require.NoError(t, err)
+			require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+			assert.Equal(t, []string{"ci", "deploy"}, resp.Data["unchanged"], format)
+			assert.Empty(t, resp.Data["created"], format)
+			assert.Empty(t, resp.Data["updated"], format)
+		}
+	})
+
+	t.Run("validation is all or nothing", func(t *testing.T) {
+		resp, err := testRoleBulkImport(t, backend, storage, map[string]interface{}{"document": `
+roles:
+  ci:
+    id: 1
+    name: ci
+    scopes: [read_api]
+    access_level: maintainer
+  broken:
+    id: 3
+    name: broken
+    scopes: [not_a_scope]
+  typo:
+    id: 4
+    name: typo
+    scopes: [api]
+    acces_level: developer
+`})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		msg := resp.Error().Error()
+		assert.Contains(t, msg, "role 'broken'")
+		assert.Contains(t, msg, "role 'typo': 1 error occurred:\n\t* unknown parameter 'acces_level'")
+
+		resp, err = testRoleRead(t, backend, storage, "ci")
+		require.NoError(t, err)
+		assert.Equal(t, accessLevelDeveloper, resp.Data["access_level"], "no role should change when one is invalid")
+	})
+
+	t.Run("update and delete missing", func(t *testing.T) {
+		mustRoleCreate(t, backend, storage, "drained", map[string]interface{}{"id": 5, "name": "drained", "scopes": []string{"api"}})
+		resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "drained", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		update := `{"roles": {"ci": {"id": 1, "name": "ci", "scopes": ["read_api"], "access_level": "reporter"}}}`
+		resp, err = testRoleBulkImport(t, backend, storage, map[string]interface{}{"document": update, "delete_missing": true, "dry_run": true})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, []string{"ci"}, resp.Data["updated"])
+		assert.Equal(t, []string{"deploy", "drained"}, resp.Data["deleted"])
+
+		resp, err = testRoleBulkImport(t, backend, storage, map[string]interface{}{"document": update, "delete_missing": true})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Len(t, resp.Warnings, 1, "drained role has an outstanding token")
+
+		resp, err = testRoleRead(t, backend, storage, "deploy")
+		require.NoError(t, err)
+		assert.Nil(t, resp)
+		resp, err = testRoleRead(t, backend, storage, "drained")
+		require.NoError(t, err)
+		assert.Equal(t, roleStatusDeleting, resp.Data["status"])
+		resp, err = testRoleRead(t, backend, storage, "ci")
+		require.NoError(t, err)
+		assert.Equal(t, accessLevelReporter, resp.Data["access_level"])
+
+		resp, err = testRoleBulkExport(t, backend, storage, roleDocumentFormatJSON)
+		require.NoError(t, err)
+		assert.Equal(t, 1, resp.Data["roles"], "deleting roles are not exported")
+	})
+
+	t.Run("invalid documents", func(t *testing.T) {
+		for _, document := range []string{"", "roles: [", `{"role": {}}`, `{"roles": {"bad name!": {"id": 1}}}`} {
+			resp, err := testRoleBulkImport(t, backend, storage, map[string]interface{}{"document": document, "dry_run": true})
+			require.NoError(t, err)
+			assert.True(t, resp.IsError(), document)
+		}
+
+		resp, err := testRoleBulkExport(t, backend, storage, "xml")
+		require.NoError(t, err)
+		assert.True(t, resp.IsError())
+	})
+}
+
+func testRoleBulkImport(t *testing.T, b logical.Backend, s logical.Storage, data map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      pathPatternRolesBulk,
+		Data:      data,
+		Storage:   s,
+	})
+}
+
+func testRoleBulkExport(t *testing.T, b logical.Backend, s logical.Storage, format string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      pathPatternRolesBulk,
+		Data:      map[string]interface{}{"format": format},
+		Storage:   s,
+	})
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+var roleTemplateSchema = map[string]*framework.FieldSchema{
+	"template_name": {
+		Type:        framework.TypeString,
+		Description: "Role template name",
+	},
+	"id": {
+		Type:        framework.TypeInt,
+		Description: "Default project or group ID",
+	},
+	"name": {
+		Type:        framework.TypeString,
+		Description: "Default name of the access token",
+	},
+	"scopes": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Default list of scopes",
+	},
+	"token_ttl": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Default TTL of the token",
+	},
+	"max_ttl": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Default maximum TTL a token can be requested with",
+	},
+	"access_level": {
+		Type:        framework.TypeString,
+		Description: "Default access level of the access token, as a name or a number",
+	},
+	"token_type": {
+		Type:        framework.TypeLowerCaseString,
+		Description: "Default type of access token to create, project or group",
+	},
+}
+
+func roleTemplateDetail(tpl *RoleTemplateEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"template_name":     tpl.TemplateName,
+		"id":                tpl.BaseTokenStorage.ID,
+		"name":              tpl.BaseTokenStorage.Name,
+		"scopes":            tpl.BaseTokenStorage.Scopes,
+		"access_level":      tpl.BaseTokenStorage.AccessLevel,
+		"access_level_name": accessLevelName(tpl.BaseTokenStorage.AccessLevel),
+		"token_type":        tpl.BaseTokenStorage.TokenType,
+		"token_ttl":         int64(tpl.TokenTTL / time.Second),
+		"max_ttl":           int64(tpl.MaxTTL / time.Second),
+	}
+}
+
+func (b *GitlabBackend) pathRoleTemplateCreateUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	templateName := data.Get("template_name").(string)
+	if templateName == "" {
+		return logical.ErrorResponse("Template name not supplied"), nil
+	}
+
+	b.templateLock.Lock()
+	defer b.templateLock.Unlock()
+
+	tpl, err := getRoleTemplateEntry(ctx, req.Storage, templateName)
+	if err != nil {
+		return nil, err
+	}
+	if tpl == nil {
+		tpl = &RoleTemplateEntry{TemplateName: templateName}
+	}
+	tpl.retrieve(data)
+	if err := tpl.assertValid(); err != nil {
+		return logical.ErrorResponse("Failed to validate - " + err.Error()), nil
+	}
+
+	// the roles using the template must stay valid with the new defaults
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return logical.ErrorResponse("failed to obtain gitlab config - %s", err.Error()), nil
+	}
+	roles, err := rolesUsingTemplate(ctx, req.Storage, templateName)
+	if err != nil {
+		return nil, err
+	}
+	var merr *multierror.Error
+	for _, role := range roles {
+		merged, _ := role.withTemplate(tpl)
+		if _, err := merged.validate(config); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("role '%s': %w", role.RoleName, err))
+		}
+	}
+	if err := merr.ErrorOrNil(); err != nil {
+		return logical.ErrorResponse("Failed to validate roles using the template - " + err.Error()), nil
+	}
+
+	if err := tpl.save(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+	b.requestLogger(req, "template_name", templateName).Debug("successfully saved role template", "roles", len(roles))
+
+	return &logical.Response{
+		Data: roleTemplateDetail(tpl),
+	}, nil
+}
+
+func (b *GitlabBackend) pathRoleTemplateRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	tpl, err := getRoleTemplateEntry(ctx, req.Storage, data.Get("template_name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if tpl == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: roleTemplateDetail(tpl),
+	}, nil
+}
+
+func (b *GitlabBackend) pathRoleTemplateDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	templateName := data.Get("template_name").(string)
+
+	b.templateLock.Lock()
+	defer b.templateLock.Unlock()
+
+	roles, err := rolesUsingTemplate(ctx, req.Storage, templateName)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) > 0 {
+		return logical.ErrorResponse("Role template '%s' is used by roles: %s", templateName,
+			strings.Join(roleNames(roles), ", ")), nil
+	}
+
+	if err := deleteRoleTemplateEntry(ctx, req.Storage, templateName); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *GitlabBackend) pathRoleTemplateList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	templates, err := listRoleTemplateEntries(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(templates), nil
+}
+
+func pathRoleTemplate(b *GitlabBackend) []*framework.Path {
+	paths := []*framework.Path{
+		{
+			Pattern: fmt.Sprintf("%s/%s", pathPatternRoleTemplates, framework.GenericNameRegex("template_name")),
+			Fields:  roleTemplateSchema,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRoleTemplateCreateUpdate,
+					Summary:  "Create or update a role template",
+					Examples: roleTemplateExamples,
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRoleTemplateRead,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathRoleTemplateDelete,
+				},
+			},
+			HelpSynopsis:    pathRoleTemplateHelpSyn,
+			HelpDescription: pathRoleTemplateHelpDesc,
+		},
+	}
+	return paths
+}
+
+func pathRoleTemplateList(b *GitlabBackend) []*framework.Path {
+	paths := []*framework.Path{
+		{
+			Pattern: fmt.Sprintf("%s/?$", pathPatternRoleTemplates),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathRoleTemplateList,
+			},
+			HelpSynopsis: pathListRoleTemplateHelpSyn,
+		},
+	}
+	return paths
+}
+
+const pathRoleTemplateHelpSyn = `Create a role template holding defaults for roles.`
+const pathRoleTemplateHelpDesc = `
+This path allows you to create a role template. A role referencing the template with its template parameter takes
+every field it does not set from the template, when the role is written and when a token is issued. A template
+cannot be changed in a way that makes a role using it invalid, and cannot be deleted while roles use it.
+`
+const pathListRoleTemplateHelpSyn = `List existing role templates.`
+
+var roleTemplateExamples = []framework.RequestExample{
+	{
+		Description: "Create a role template",
+		Data: map[string]interface{}{
+			"template_name": "ci-readonly",
+			"name":          "ci",
+			"scopes":        []string{"read_api", "read_repository"},
+			"access_level":  "reporter",
+		},
+	},
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathRoleTemplate(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+
+	resp, err := testRoleTemplateWrite(t, backend, storage, "ci", map[string]interface{}{
+		"name":         "ci",
+		"scopes":       "read_api,read_repository",
+		"access_level": "reporter",
+		"token_ttl":    "2h",
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+
+	t.Run("role inherits unset fields", func(t *testing.T) {
+		mustRoleCreate(t, backend, storage, "app", map[string]interface{}{
+			"template":     "ci",
+			"id":           1,
+			"access_level": "developer",
+		})
+
+		resp, err := testRoleReadEffective(t, backend, storage, "app")
+		require.NoError(t, err)
+		assert.Equal(t, "ci", resp.Data["template"])
+		assert.Empty(t, resp.Data["name"])
+		assert.Equal(t, accessLevelDeveloper, resp.Data["access_level"])
+		assert.EqualValues(t, 0, resp.Data["token_ttl"])
+
+		effective := resp.Data["effective"].(map[string]interface{})
+		assert.Equal(t, 1, effective["id"])
+		assert.Equal(t, "ci", effective["name"])
+		assert.Equal(t, []string{"read_api", "read_repository"}, effective["scopes"])
+		assert.Equal(t, accessLevelDeveloper, effective["access_level"])
+		assert.Equal(t, tokenTypeProject, effective["token_type"])
+		assert.EqualValues(t, 7200, effective["token_ttl"])
+		assert.Equal(t, []string{"name", "scopes", "token_ttl"}, resp.Data["inherited_fields"])
+
+		resp, err = testRoleRead(t, backend, storage, "app")
+		require.NoError(t, err)
+		assert.NotContains(t, resp.Data, "effective", "effective role is only returned on request")
+	})
+
+	t.Run("tokens are issued from the effective role", func(t *testing.T) {
+		resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "app", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, "ci", resp.Data["name"])
+		assert.Equal(t, []string{"read_api", "read_repository"}, resp.Data["scopes"])
+		assert.EqualValues(t, accessLevelDeveloper, resp.Data["access_level"])
+	})
+
+	t.Run("template changes apply to roles", func(t *testing.T) {
+		resp, err := testRoleTemplateWrite(t, backend, storage, "ci", map[string]interface{}{"name": "ci-v2"})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+
+		resp, err = testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "app", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, "ci-v2", resp.Data["name"])
+	})
+
+	t.Run("template changes cannot break roles", func(t *testing.T) {
+		resp, err := testRoleTemplateWrite(t, backend, storage, "ci", map[string]interface{}{"token_type": tokenTypeGroup, "access_level": "minimal_access"})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "a group template with minimal_access is valid on its own")
+
+		resp, err = testRoleTemplateWrite(t, backend, storage, "ci", map[string]interface{}{"token_ttl": "1h", "max_ttl": "30m"})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "exceeds the template max_ttl")
+
+		mustRoleCreate(t, backend, storage, "strict", map[string]interface{}{"template": "ci", "id": 2, "max_ttl": "3h"})
+		resp, err = testRoleTemplateWrite(t, backend, storage, "ci", map[string]interface{}{"token_ttl": "4h"})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "role 'strict'")
+		mustRoleDelete(t, backend, storage, "strict")
+	})
+
+	t.Run("role needs an existing template", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, storage, "orphan", map[string]interface{}{"template": "missing", "id": 1})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "role template 'missing' does not exist")
+	})
+
+	t.Run("role must be complete with its template", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, storage, "incomplete", map[string]interface{}{"template": "ci"})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "id is empty or invalid")
+	})
+
+	t.Run("bulk export keeps inheritance", func(t *testing.T) {
+		resp, err := testRoleBulkExport(t, backend, storage, roleDocumentFormatJSON)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		assert.JSONEq(t, `{"roles": {"app": {"template": "ci", "id": 1, "access_level": "developer", "revoke_on_delete": false}}}`,
+			resp.Data["document"].(string))
+
+		resp, err = testRoleBulkImport(t, backend, storage, map[string]interface{}{"document": resp.Data["document"], "dry_run": true})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Equal(t, []string{"app"}, resp.Data["unchanged"])
+	})
+
+	t.Run("template in use cannot be deleted", func(t *testing.T) {
+		resp, err := testRoleTemplateDelete(t, backend, storage, "ci")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "is used by roles: app")
+
+		resp, err = testRevoke(t, backend, storage, "role/app", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		mustRoleDelete(t, backend, storage, "app")
+		resp, err = testRoleTemplateDelete(t, backend, storage, "ci")
+		require.NoError(t, err)
+		assert.Nil(t, resp)
+
+		resp, err = backend.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      pathPatternRoleTemplates + "/",
+			Storage:   storage,
+		})
+		require.NoError(t, err)
+		assert.Empty(t, resp.Data["keys"])
+	})
+}
+
+func testRoleTemplateWrite(t *testing.T, b logical.Backend, s logical.Storage, templateName string, data map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/%s", pathPatternRoleTemplates, templateName),
+		Data:      data,
+		Storage:   s,
+	})
+}
+
+func testRoleTemplateDelete(t *testing.T, b logical.Backend, s logical.Storage, templateName string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("%s/%s", pathPatternRoleTemplates, templateName),
+		Storage:   s,
+	})
+}
+
+func testRoleReadEffective(t *testing.T, b logical.Backend, s logical.Storage, roleName string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("%s/%s", pathPatternRoles, roleName),
+		Data:      map[string]interface{}{"effective": true},
+		Storage:   s,
+	})
+}
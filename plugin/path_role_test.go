@@ -17,7 +17,10 @@ package gitlabtoken
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/mitchellh/mapstructure"
@@ -79,6 +82,50 @@ func TestPathRole(t *testing.T) {
 		mustRoleDelete(t, backend, storage, roleName)
 	})
 
+	t.Run("named access level", func(t *testing.T) {
+		roleName := "named-access-level"
+		d := map[string]interface{}{
+			"id":           1,
+			"name":         "role-test",
+			"scopes":       []string{"api"},
+			"access_level": "owner",
+		}
+		mustRoleCreate(t, backend, storage, roleName, d)
+
+		resp, err := testRoleRead(t, backend, storage, roleName)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		a.Equal(accessLevelOwner, resp.Data["access_level"])
+		a.Equal("owner", resp.Data["access_level_name"])
+		a.Equal(tokenTypeProject, resp.Data["token_type"])
+
+		mustRoleDelete(t, backend, storage, roleName)
+	})
+
+	t.Run("access level per token type", func(t *testing.T) {
+		roleName := "group-access-level"
+		d := map[string]interface{}{
+			"id":           1,
+			"name":         "role-test",
+			"scopes":       []string{"api"},
+			"access_level": "minimal_access",
+		}
+		resp, err := testRoleCreate(t, backend, storage, roleName, d)
+		require.NoError(t, err)
+		require.True(t, resp.IsError(), "minimal_access is not allowed for project access tokens")
+		require.Contains(t, resp.Data["error"], "invalid access level 'minimal_access' for project access tokens")
+
+		d["token_type"] = tokenTypeGroup
+		mustRoleCreate(t, backend, storage, roleName, d)
+
+		resp, err = testRoleRead(t, backend, storage, roleName)
+		require.NoError(t, err)
+		a.Equal(tokenTypeGroup, resp.Data["token_type"])
+		a.Equal("minimal_access", resp.Data["access_level_name"])
+
+		mustRoleDelete(t, backend, storage, roleName)
+	})
+
 	t.Run("delete non-existing", func(t *testing.T) {
 		roleName := "non-existing"
 		resp, err := testRoleDelete(t, backend, storage, roleName)
@@ -101,7 +148,19 @@ func TestPathRole(t *testing.T) {
 		require.Contains(t, resp.Data["error"], "name is empty")
 		require.Contains(t, resp.Data["error"], "scopes are empty")
 		require.Contains(t, resp.Data["error"], "exceeds configured maximum ttl")
-		require.Contains(t, resp.Data["error"], "invalid access level")
+		require.Contains(t, resp.Data["error"], "invalid access level '31' for project access tokens")
+
+		d["access_level"] = "superuser"
+		resp, err = testRoleCreate(t, backend, storage, roleName, d)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Data["error"], "invalid access level 'superuser' for project access tokens, allowed levels are guest (10)")
+
+		d["token_type"] = "personal"
+		resp, err = testRoleCreate(t, backend, storage, roleName, d)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Data["error"], "token type 'personal' is not supported")
 	})
 }
 
@@ -158,10 +217,282 @@ func TestPathRoleList(t *testing.T) {
 	a.Equal(roleName1, returnedRoles[0], "incorrect path set")
 }
 
+func TestPathRoleDelete(t *testing.T) {
+	t.Parallel()
+	a := assert.New(t)
+
+	backend, storage := getTestBackend(t, true)
+	mock := backend.(*GitlabBackend).client.(*mockGitlabClient)
+	conf := map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	}
+	testConfigUpdate(t, backend, storage, conf)
+	data := map[string]interface{}{
+		"id":     1,
+		"name":   "role-test",
+		"scopes": []string{"api", "read_repository"},
+	}
+	issue := func(roleName string) int {
+		resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, roleName, nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		return resp.Data["id"].(int)
+	}
+
+	t.Run("outstanding tokens drain", func(t *testing.T) {
+		roleName := "drain"
+		mustRoleCreate(t, backend, storage, roleName, data)
+		tokenID := issue(roleName)
+
+		resp, err := testRoleDelete(t, backend, storage, roleName)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		a.Equal(roleStatusDeleting, resp.Data["status"])
+		a.Equal(1, resp.Data["outstanding_tokens"])
+		a.False(mock.isRevoked(tokenID))
+
+		resp, err = testRoleRead(t, backend, storage, roleName)
+		require.NoError(t, err)
+		a.Equal(roleStatusDeleting, resp.Data["status"])
+
+		resp, err = testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, roleName, nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError(), "deleting role should not issue tokens")
+
+		resp, err = testRoleCreate(t, backend, storage, roleName, data)
+		require.NoError(t, err)
+		require.True(t, resp.IsError(), "deleting role should not be updated")
+
+		resp, err = testRevoke(t, backend, storage, "role/"+roleName, nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		err = backend.(*GitlabBackend).periodicFunc(context.Background(), &logical.Request{Storage: storage})
+		require.NoError(t, err)
+
+		resp, err = testRoleRead(t, backend, storage, roleName)
+		require.NoError(t, err)
+		require.Nil(t, resp, "drained role should be removed")
+	})
+
+	t.Run("issuance in progress when the deletion starts", func(t *testing.T) {
+		roleName := "deleted-while-issuing"
+		mustRoleCreate(t, backend, storage, roleName, data)
+
+		// the deletion holds the role lock while it sweeps the outstanding tokens
+		lock := backend.(*GitlabBackend).roleLock(roleName)
+		lock.Lock()
+		done := make(chan *logical.Response)
+		go func() {
+			resp, _ := testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, roleName, nil)
+			done <- resp
+		}()
+		role, err := getRoleEntry(context.Background(), storage, roleName)
+		require.NoError(t, err)
+		role.Status = roleStatusDeleting
+		require.NoError(t, role.save(context.Background(), storage))
+		lock.Unlock()
+
+		resp := <-done
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+		a.Contains(resp.Error().Error(), "is being deleted")
+	})
+
+	t.Run("revoke on delete", func(t *testing.T) {
+		roleName := "revoke-on-delete"
+		mustRoleCreate(t, backend, storage, roleName, data)
+		tokenID := issue(roleName)
+
+		resp, err := backend.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      fmt.Sprintf("%s/%s", pathPatternRoles, roleName),
+			Data:      map[string]interface{}{"revoke_on_delete": true},
+			Storage:   storage,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		a.True(mock.isRevoked(tokenID))
+
+		resp, err = testRoleRead(t, backend, storage, roleName)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("revoke on delete with failure", func(t *testing.T) {
+		roleName := "revoke-on-delete-failure"
+		d := map[string]interface{}{
+			"id":               1,
+			"name":             "role-test",
+			"scopes":           []string{"api"},
+			"revoke_on_delete": true,
+		}
+		mustRoleCreate(t, backend, storage, roleName, d)
+		tokenID := issue(roleName)
+
+		mock.lock.Lock()
+		mock.revokeError = map[int]error{tokenID: fmt.Errorf("gitlab is down")}
+		mock.lock.Unlock()
+
+		resp, err := testRoleDelete(t, backend, storage, roleName)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		a.Equal(roleStatusDeleting, resp.Data["status"])
+		a.Contains(resp.Warnings[0], "gitlab is down")
+	})
+}
+
+func TestPathRoleVerify(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	mock := backend.(*GitlabBackend).client.(*mockGitlabClient)
+	mock.targets = map[string]*TargetAccess{
+		"project/1": {Path: "team/app", AccessLevel: accessLevelMaintainer, AccessTokensAvailable: true},
+		"project/2": {Path: "team/lib", AccessLevel: accessLevelDeveloper, AccessTokensAvailable: true},
+		"project/3": {Path: "team/legacy", AccessLevel: accessLevelOwner},
+		"project/4": {Path: "other/app", Admin: true, AccessTokensAvailable: true},
+		"group/5":   {Path: "team", AccessLevel: accessLevelMaintainer, AccessTokensAvailable: true},
+	}
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+
+	tests := []struct {
+		name   string
+		data   map[string]interface{}
+		errMsg []string
+	}{
+		{
+			name: "maintainer can create default tokens",
+			data: map[string]interface{}{"id": 1},
+		},
+		{
+			name: "maintainer can grant developer",
+			data: map[string]interface{}{"id": 1, "access_level": "developer"},
+		},
+		{
+			name:   "maintainer cannot grant owner",
+			data:   map[string]interface{}{"id": 1, "access_level": "owner"},
+			errMsg: []string{"backend token lacks Owner on project 1 (team/app), it has Maintainer"},
+		},
+		{
+			name:   "developer cannot create tokens",
+			data:   map[string]interface{}{"id": 2, "access_level": "guest"},
+			errMsg: []string{"backend token lacks Maintainer on project 2 (team/lib), it has Developer"},
+		},
+		{
+			name:   "access tokens unavailable",
+			data:   map[string]interface{}{"id": 3},
+			errMsg: []string{"project access tokens are not available on project 3 (team/legacy)"},
+		},
+		{
+			name: "admin can create any token",
+			data: map[string]interface{}{"id": 4, "access_level": "owner"},
+		},
+		{
+			name:   "unknown project",
+			data:   map[string]interface{}{"id": 42},
+			errMsg: []string{"project 42 does not exist or is not visible to the backend token"},
+		},
+		{
+			name: "group",
+			data: map[string]interface{}{"id": 5, "token_type": tokenTypeGroup, "access_level": "minimal_access"},
+		},
+		{
+			name:   "project id is not a group",
+			data:   map[string]interface{}{"id": 1, "token_type": tokenTypeGroup},
+			errMsg: []string{"group 1 does not exist or is not visible to the backend token"},
+		},
+	}
+
+	for i, test := range tests {
+		test := test // capture range var
+		roleName := fmt.Sprintf("verify-%d", i)
+		t.Run(test.name, func(t *testing.T) {
+			data := map[string]interface{}{"name": "verified", "scopes": []string{"api"}, "verify": true}
+			for k, v := range test.data {
+				data[k] = v
+			}
+			resp, err := testRoleCreate(t, backend, storage, roleName, data)
+			require.NoError(t, err)
+			if len(test.errMsg) == 0 {
+				require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+				verification := resp.Data["verification"].(map[string]interface{})
+				assert.Equal(t, "unknown", verification["status"], "the group setting disabling access tokens is not exposed")
+				assert.Len(t, verification["unknown"], 1)
+				assert.Len(t, resp.Warnings, 1)
+				return
+			}
+			require.True(t, resp.IsError())
+			for _, msg := range test.errMsg {
+				assert.Contains(t, resp.Error().Error(), msg)
+			}
+			resp, err = testRoleRead(t, backend, storage, roleName)
+			require.NoError(t, err)
+			assert.Nil(t, resp, "role failing verification should not be saved")
+		})
+	}
+
+	t.Run("verify is opt-in", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, storage, "unverified", map[string]interface{}{
+			"id": 42, "name": "unverified", "scopes": []string{"api"},
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		_, stored := resp.Data["verify"]
+		assert.False(t, stored)
+	})
+}
+
+func TestPathRoleConcurrentUpdates(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+	mustRoleCreate(t, backend, storage, "shared", map[string]interface{}{
+		"id":     1,
+		"name":   "shared",
+		"scopes": []string{"read_api"},
+	})
+
+	// each update changes a different field of the role read by the others
+	updates := []map[string]interface{}{
+		{"max_active_tokens": 3},
+		{"reuse_max_consumers": 4},
+		{"revoke_on_delete": true},
+		{"max_ttl": 172800},
+	}
+	slow := &slowGetStorage{Storage: storage, prefix: pathPatternRoles + "/", delay: 20 * time.Millisecond}
+	var wg sync.WaitGroup
+	for _, data := range updates {
+		wg.Add(1)
+		go func(data map[string]interface{}) {
+			defer wg.Done()
+			resp, err := testRoleCreate(t, backend, slow, "shared", data)
+			assert.NoError(t, err)
+			assert.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		}(data)
+	}
+	wg.Wait()
+
+	resp, err := testRoleRead(t, backend, storage, "shared")
+	require.NoError(t, err)
+	assert.Equal(t, 3, resp.Data["max_active_tokens"])
+	assert.Equal(t, 4, resp.Data["reuse_max_consumers"])
+	assert.Equal(t, true, resp.Data["revoke_on_delete"])
+	assert.Equal(t, int64(172800), resp.Data["max_ttl"])
+}
+
 func testRoleCreate(t *testing.T, b logical.Backend, s logical.Storage, roleName string, data map[string]interface{}) (*logical.Response, error) {
 	t.Helper()
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
-		Operation: logical.CreateOperation,
+		Operation: logical.UpdateOperation,
 		Path:      fmt.Sprintf("%s/%s", pathPatternRoles, roleName),
 		Data:      data,
 		Storage:   s,
@@ -221,3 +552,18 @@ func testRoleList(t *testing.T, b logical.Backend, s logical.Storage) (*logical.
 	})
 	return resp, err
 }
+
+// slowGetStorage delays returning the entries under prefix once they are read
+type slowGetStorage struct {
+	logical.Storage
+	prefix string
+	delay  time.Duration
+}
+
+func (s *slowGetStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	entry, err := s.Storage.Get(ctx, key)
+	if strings.HasPrefix(key, s.prefix) {
+		time.Sleep(s.delay)
+	}
+	return entry, err
+}
@@ -16,6 +16,7 @@ package gitlabtoken
 
 import (
 	"context"
+	"net/http"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
@@ -42,18 +43,25 @@ var accessTokenSchema = map[string]*framework.FieldSchema{
 		Description: "The token expires at midnight UTC on that date",
 	},
 	"access_level": {
-		Type:        framework.TypeInt,
-		Description: "access level of project access token",
+		Type: framework.TypeString,
+		Description: `access level of the access token, as a name (minimal_access, guest, planner, reporter, developer,
+maintainer, owner) or a number. minimal_access is only allowed for group access tokens`,
+	},
+	"token_type": {
+		Type:        framework.TypeLowerCaseString,
+		Description: "Type of access token to create, project or group. id refers to a group for group access tokens",
+		Default:     tokenTypeProject,
 	},
 }
 
 func tokenDetails(pat *PAT) map[string]interface{} {
 	d := map[string]interface{}{
-		"token":        pat.Token,
-		"id":           pat.ID,
-		"name":         pat.Name,
-		"scopes":       pat.Scopes,
-		"access_level": pat.AccessLevel,
+		"token":             pat.Token,
+		"id":                pat.ID,
+		"name":              pat.Name,
+		"scopes":            pat.Scopes,
+		"access_level":      pat.AccessLevel,
+		"access_level_name": accessLevelName(int(pat.AccessLevel)),
 	}
 	if pat.ExpiresAt != nil {
 		d["expires_at"] = time.Time(*pat.ExpiresAt)
@@ -61,10 +69,17 @@ func tokenDetails(pat *PAT) map[string]interface{} {
 	return d
 }
 
-func (b *GitlabBackend) pathTokenCreate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+func (b *GitlabBackend) pathTokenCreate(ctx context.Context, req *logical.Request, data *framework.FieldData) (resp *logical.Response, err error) {
+	start := time.Now()
+	var gitlabErr error
+	var gitlabStatus int
+	defer func() {
+		emitTokenIssue("create_token", "", issueOutcome(resp, gitlabErr, ""), start, gitlabStatus, gitlabErr)
+	}()
+
 	gc, err := b.getClient(ctx, req.Storage)
 	if err != nil {
-		return logical.ErrorResponse("failed to obtain gitlab client - %s", err.Error()), nil
+		return clientErrorResponse(err)
 	}
 
 	var tokenStorage TokenStorageEntry
@@ -77,18 +92,32 @@ func (b *GitlabBackend) pathTokenCreate(ctx context.Context, req *logical.Reques
 	if config == nil {
 		return logical.ErrorResponse("artifactory backend configuration has not been set up"), nil
 	}
-	err = tokenStorage.assertValid(config.MaxTTL)
+	err = tokenStorage.assertValid()
+	if err != nil {
+		return logical.ErrorResponse("Failed to validate - " + err.Error()), nil
+	}
+	warnings, err := tokenStorage.resolveExpiresAt(config)
 	if err != nil {
 		return logical.ErrorResponse("Failed to validate - " + err.Error()), nil
 	}
 
-	b.Logger().Debug("generating access token", "id", tokenStorage.BaseTokenStorage.ID,
-		"name", tokenStorage.BaseTokenStorage.Name, "scopes", tokenStorage.BaseTokenStorage.Scopes)
-	pat, err := gc.CreateProjectAccessToken(&tokenStorage.BaseTokenStorage, tokenStorage.ExpiresAt)
+	logger := b.requestLogger(req, "id", tokenStorage.BaseTokenStorage.ID, "token_type", tokenStorage.BaseTokenStorage.tokenType())
+	logger.Debug("generating access token", "name", tokenStorage.BaseTokenStorage.Name,
+		"scopes", tokenStorage.BaseTokenStorage.Scopes, "expires_at", tokenStorage.ExpiresAt)
+	pat, err := createAccessToken(gc, &tokenStorage.BaseTokenStorage, tokenStorage.ExpiresAt)
 	if err != nil {
-		return logical.ErrorResponse("Failed to create a token - " + err.Error()), nil
+		gitlabErr = err
+		logger.Error("failed to create a token", errorLogFields(err)...)
+		return gitlabErrorResponse("Failed to create a token", err)
 	}
-	return &logical.Response{Data: tokenDetails(pat)}, nil
+	gitlabStatus = http.StatusCreated
+	logger.Debug("generated access token", "token_id", pat.ID)
+
+	resp = &logical.Response{Data: tokenDetails(pat), Warnings: warnings}
+	if err := b.recordIssuedToken(ctx, req, pat, &tokenStorage.BaseTokenStorage, "", ""); err != nil {
+		resp.AddWarning("token was created but could not be recorded in the token inventory - " + err.Error())
+	}
+	return resp, nil
 }
 
 // set up the paths for the roles within vault
@@ -98,15 +127,11 @@ func pathToken(b *GitlabBackend) []*framework.Path {
 			Pattern: pathPatternToken,
 			Fields:  accessTokenSchema,
 			Operations: map[logical.Operation]framework.OperationHandler{
-				logical.CreateOperation: &framework.PathOperation{
-
+				logical.UpdateOperation: &framework.PathOperation{
 					Callback: b.pathTokenCreate,
 					Summary:  "Create a project access token",
 					Examples: tokenExamples,
 				},
-				logical.UpdateOperation: &framework.PathOperation{
-					Callback: b.pathTokenCreate,
-				},
 			},
 			HelpSynopsis:    pathTokenHelpSyn,
 			HelpDescription: pathTokenHelpDesc,
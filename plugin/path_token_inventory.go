@@ -0,0 +1,228 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/wrapping"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+var tokenInventorySchema = map[string]*framework.FieldSchema{
+	"token_id": {
+		Type:        framework.TypeInt,
+		Description: "ID of the token in Gitlab",
+	},
+}
+
+func tokenInventoryDetail(entry *TokenInventoryEntry) map[string]interface{} {
+	d := map[string]interface{}{
+		"token_id":          entry.TokenID,
+		"project_id":        entry.ProjectID,
+		"name":              entry.Name,
+		"scopes":            entry.Scopes,
+		"access_level":      entry.AccessLevel,
+		"access_level_name": accessLevelName(entry.AccessLevel),
+		"token_type":        entry.tokenType(),
+		"created_at":        entry.CreatedAt,
+		"entity_id":         entry.EntityID,
+		"role_name":         entry.RoleName,
+		"revoked":           entry.Revoked,
+		"status":            entry.status(time.Now().UTC()),
+	}
+	if entry.ExpiresAt != nil {
+		d["expires_at"] = *entry.ExpiresAt
+	}
+	if entry.RevokedAt != nil {
+		d["revoked_at"] = *entry.RevokedAt
+	}
+	if entry.Username != "" {
+		d["username"] = entry.Username
+	}
+	return d
+}
+
+func (b *GitlabBackend) pathTokenInventoryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	tokenID := data.Get("token_id").(int)
+	entry, err := getTokenInventoryEntry(ctx, req.Storage, tokenID)
+	if err != nil {
+		return logical.ErrorResponse("Error reading token"), err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: tokenInventoryDetail(entry),
+	}, nil
+}
+
+// pathTokenRotate rotates an active token of the inventory. Gitlab revokes the token and creates a new one
+// with the same name, scopes and access level under a new ID, which replaces it in the inventory.
+func (b *GitlabBackend) pathTokenRotate(ctx context.Context, req *logical.Request, data *framework.FieldData) (resp *logical.Response, err error) {
+	start := time.Now()
+	var gitlabErr error
+	var gitlabStatus int
+	roleLabel := ""
+	defer func() {
+		emitTokenIssue("rotate_token", roleLabel, issueOutcome(resp, gitlabErr, ""), start, gitlabStatus, gitlabErr)
+	}()
+
+	tokenID := data.Get("token_id").(int)
+	entry, err := getTokenInventoryEntry(ctx, req.Storage, tokenID)
+	if err != nil {
+		return logical.ErrorResponse("Error reading token"), err
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Token %d is not in the token inventory", tokenID)), nil
+	}
+
+	var wrapInfo *wrapping.ResponseWrapInfo
+	if entry.RoleName != "" {
+		roleLabel = entry.RoleName
+		// the role lock keeps the rotation from racing with the revocation of the role's tokens
+		lock := b.roleLock(entry.RoleName)
+		lock.Lock()
+		defer lock.Unlock()
+		if entry, err = getTokenInventoryEntry(ctx, req.Storage, tokenID); err != nil || entry == nil {
+			return logical.ErrorResponse("Error reading token"), err
+		}
+
+		role, err := getRoleEntry(ctx, req.Storage, entry.RoleName)
+		if err != nil {
+			return logical.ErrorResponse("Error reading role"), err
+		}
+		// the token is handed out as the role would, wrapped if it requires it
+		if role != nil {
+			if wrapInfo, err = role.responseWrapping(req); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	if status := entry.status(now); status != tokenStatusActive {
+		return logical.ErrorResponse(fmt.Sprintf("Token %d is %s and cannot be rotated", tokenID, status)), nil
+	}
+	// the new token lives as long as the rotated one did
+	var expiresAt *time.Time
+	if entry.ExpiresAt != nil {
+		expiration := now.Add(entry.ExpiresAt.Sub(entry.CreatedAt))
+		expiresAt = &expiration
+	}
+
+	gc, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return clientErrorResponse(err)
+	}
+	logger := b.requestLogger(req, "token_id", tokenID, "id", entry.ProjectID, "token_type", entry.tokenType())
+	pat, err := rotateAccessToken(gc, entry, expiresAt)
+	if err != nil {
+		gitlabErr = err
+		logger.Error("failed to rotate token", errorLogFields(err)...)
+		return gitlabErrorResponse("Failed to rotate the token", err)
+	}
+	gitlabStatus = http.StatusOK
+	logger.Debug("rotated token", "new_token_id", pat.ID)
+
+	resp = &logical.Response{Data: tokenDetails(pat), WrapInfo: wrapInfo}
+	resp.Data["rotated_token_id"] = tokenID
+
+	entry.Revoked = true
+	entry.RevokedAt = &now
+	if err := entry.save(ctx, req.Storage); err != nil {
+		resp.AddWarning("token was rotated but the rotated token could not be marked revoked in the token inventory - " + err.Error())
+	}
+	rotated := newTokenInventoryEntry(pat, &BaseTokenStorageEntry{ID: entry.ProjectID, TokenType: entry.TokenType},
+		entry.RoleName, entry.EntityID)
+	rotated.Username = entry.Username
+	if err := rotated.save(ctx, req.Storage); err != nil {
+		resp.AddWarning("token was rotated but could not be recorded in the token inventory - " + err.Error())
+	} else if err := rotated.indexByRole(ctx, req.Storage); err != nil {
+		resp.AddWarning("token was rotated but could not be indexed by role in the token inventory - " + err.Error())
+	}
+	return resp, nil
+}
+
+func (b *GitlabBackend) pathTokenInventoryList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	tokens, err := listTokenInventoryEntries(ctx, req.Storage)
+	if err != nil {
+		return logical.ErrorResponse("Error listing tokens"), err
+	}
+	return logical.ListResponse(tokens), nil
+}
+
+// set up the paths for the token inventory within vault
+func pathTokenInventory(b *GitlabBackend) []*framework.Path {
+	paths := []*framework.Path{
+		{
+			Pattern: fmt.Sprintf("%s/(?P<token_id>\\d+)", pathPatternTokens),
+			Fields:  tokenInventorySchema,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathTokenInventoryRead,
+					Summary:  "Read the record of an issued token",
+				},
+			},
+			HelpSynopsis:    pathTokenInventoryHelpSyn,
+			HelpDescription: pathTokenInventoryHelpDesc,
+		},
+		{
+			Pattern: fmt.Sprintf("%s/(?P<token_id>\\d+)/rotate", pathPatternTokens),
+			Fields:  tokenInventorySchema,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathTokenRotate,
+					Summary:  "Rotate an active token of the inventory",
+				},
+			},
+			HelpSynopsis:    pathTokenRotateHelpSyn,
+			HelpDescription: pathTokenRotateHelpDesc,
+		},
+		{
+			Pattern: fmt.Sprintf("%s/?$", pathPatternTokens),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathTokenInventoryList,
+			},
+			HelpSynopsis: pathListTokenInventoryHelpSyn,
+		},
+	}
+
+	return paths
+}
+
+const pathTokenInventoryHelpSyn = `Read the record of a token issued by this backend.`
+const pathTokenInventoryHelpDesc = `
+This path returns what is known about a token issued by this backend: project, scopes, access level,
+expiry, the requesting entity and role, and whether the token has been revoked. The token value itself
+is never stored. Records of revoked or expired tokens are pruned after the configured inventory_retention.
+`
+
+const pathTokenRotateHelpSyn = `Rotate an active token issued by this backend.`
+const pathTokenRotateHelpDesc = `
+This path rotates an active token of the token inventory in Gitlab. Gitlab revokes the token and creates a
+new one with the same name, scopes and access level under a new ID. The new token expires after as long as
+the rotated token was valid for, and is returned like a newly issued token, wrapped if its role requires
+response wrapping. The rotated token is marked revoked in the inventory and the new token is recorded for
+the same role and entity.
+`
+
+const pathListTokenInventoryHelpSyn = `List the IDs of tokens issued by this backend.`
@@ -0,0 +1,162 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathTokenInventory(t *testing.T) {
+	t.Parallel()
+	a := assert.New(t)
+
+	backend, storage := getTestBackend(t, true)
+	conf := map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	}
+	testConfigUpdate(t, backend, storage, conf)
+
+	data := map[string]interface{}{
+		"id":           1,
+		"name":         "inventory-test",
+		"scopes":       []string{"read_api"},
+		"access_level": 30,
+	}
+	roleName := "inventory"
+	mustRoleCreate(t, backend, storage, roleName, data)
+
+	req := &logical.Request{
+		Storage:  storage,
+		EntityID: "entity-1",
+	}
+	resp, err := testIssueRoleToken(t, backend, req, roleName, nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	tokenID := resp.Data["id"].(int)
+	tokenValue := resp.Data["token"].(string)
+
+	resp, err = testIssueToken(t, backend, req, data)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	t.Run("list", func(t *testing.T) {
+		resp, err := testTokenInventoryList(t, backend, storage)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		a.Len(resp.Data["keys"], 2, "incorrect number of tokens")
+	})
+
+	t.Run("read", func(t *testing.T) {
+		resp, err := testTokenInventoryRead(t, backend, storage, tokenID)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		a.Equal(tokenID, resp.Data["token_id"])
+		a.Equal(1, resp.Data["project_id"])
+		a.Equal([]string{"read_api"}, resp.Data["scopes"])
+		a.Equal(30, resp.Data["access_level"])
+		a.Equal("entity-1", resp.Data["entity_id"])
+		a.Equal(roleName, resp.Data["role_name"])
+		a.Equal(false, resp.Data["revoked"])
+		a.Equal(tokenStatusActive, resp.Data["status"])
+		a.NotEmpty(resp.Data["expires_at"])
+		a.NotContains(resp.Data, "token")
+	})
+
+	t.Run("read non-existing", func(t *testing.T) {
+		resp, err := testTokenInventoryRead(t, backend, storage, 999)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("token value is never stored", func(t *testing.T) {
+		entry, err := storage.Get(context.Background(), fmt.Sprintf("%s/%d", pathPatternTokens, tokenID))
+		require.NoError(t, err)
+		require.NotNil(t, entry)
+		a.False(strings.Contains(string(entry.Value), tokenValue))
+	})
+}
+
+func TestPruneTokenInventory(t *testing.T) {
+	t.Parallel()
+	a := assert.New(t)
+	ctx := context.Background()
+
+	backend, storage := getTestBackend(t, true)
+	b := backend.(*GitlabBackend)
+
+	now := time.Now().UTC()
+	longAgo := now.Add(-2 * defaultInventoryRetention)
+	recently := now.Add(-time.Hour)
+	entries := []*TokenInventoryEntry{
+		{TokenID: 1, ExpiresAt: &longAgo},
+		{TokenID: 2, ExpiresAt: &recently},
+		{TokenID: 3, Revoked: true, RevokedAt: &longAgo, RoleName: "ci"},
+		{TokenID: 4, RoleName: "ci"},
+	}
+	for _, entry := range entries {
+		require.NoError(t, entry.save(ctx, storage))
+		require.NoError(t, entry.indexByRole(ctx, storage))
+	}
+
+	require.NoError(t, b.pruneTokenInventory(ctx, storage))
+
+	ids, err := listTokenInventoryEntries(ctx, storage)
+	require.NoError(t, err)
+	a.ElementsMatch([]string{"2", "4"}, ids)
+
+	indexed, err := storage.List(ctx, pathPatternTokensByRole+"/ci/")
+	require.NoError(t, err)
+	a.Equal([]string{"4"}, indexed, "index entries are pruned with the inventory")
+}
+
+func testTokenInventoryRead(t *testing.T, b logical.Backend, s logical.Storage, tokenID int) (*logical.Response, error) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("%s/%d", pathPatternTokens, tokenID),
+		Storage:   s,
+	})
+	return resp, err
+}
+
+func testTokenRotate(t *testing.T, b logical.Backend, s logical.Storage, tokenID int) (*logical.Response, error) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/%d/rotate", pathPatternTokens, tokenID),
+		Storage:   s,
+	})
+	return resp, err
+}
+
+func testTokenInventoryList(t *testing.T, b logical.Backend, s logical.Storage) (*logical.Response, error) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      pathPatternTokens,
+		Storage:   s,
+	})
+	return resp, err
+}
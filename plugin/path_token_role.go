@@ -16,10 +16,14 @@ package gitlabtoken
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/wrapping"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -28,29 +32,273 @@ var roleTokenSchema = map[string]*framework.FieldSchema{
 		Type:        framework.TypeString,
 		Description: "Role name",
 	},
+	"ttl": {
+		Type:        framework.TypeDurationSecond,
+		Description: "The TTL of the token. If not set, the token_ttl of the role is used",
+	},
+	"minimal": {
+		Type:        framework.TypeBool,
+		Description: "Only return the token and its expiry, along with the credential of format",
+	},
+	"format": {
+		Type: framework.TypeString,
+		Description: `Also return the token as a credential in this format: git-credential, netrc, docker (a config.json),
+npmrc or pip (an index URL)`,
+	},
+	"registry_host": {
+		Type:        framework.TypeString,
+		Description: "Host of the container registry for the docker format, such as registry.gitlab.com. Defaults to the host of base_url",
+	},
+	"npm_scope": {
+		Type:        framework.TypeString,
+		Description: "Package scope, such as @team, the npmrc format sets the registry for. Defaults to setting the default registry",
+	},
 }
 
-func (b *GitlabBackend) pathRoleTokenCreate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	gc, err := b.getClient(ctx, req.Storage)
+// roleTokenOptions is the shape of the response to a role token request
+type roleTokenOptions struct {
+	wrapInfo     *wrapping.ResponseWrapInfo
+	minimal      bool
+	format       string
+	registryHost string
+	npmScope     string
+}
+
+// roleTokenResponse returns the response for a token of the project or group of base, and the username of
+// its bot user when it is known or had to be looked up for the credential. A credential that cannot be
+// formatted is reported as a warning, as the token has already been created.
+func (b *GitlabBackend) roleTokenResponse(gc Client, config *ConfigStorageEntry, pat *PAT, username string,
+	base *BaseTokenStorageEntry, opts roleTokenOptions) (*logical.Response, string) {
+	resp := &logical.Response{Data: tokenDetails(pat), WrapInfo: opts.wrapInfo}
+	if opts.minimal {
+		resp.Data = minimalTokenDetails(pat)
+	}
+	if opts.format == "" {
+		return resp, username
+	}
+
+	formatter, err := newCredentialFormatter(config.BaseURL, opts.registryHost, opts.npmScope)
 	if err != nil {
-		return logical.ErrorResponse("failed to obtain gitlab client - %s", err.Error()), nil
+		resp.AddWarning("token was created but could not be formatted - " + err.Error())
+		return resp, username
+	}
+	// the credential is for the bot user Gitlab created with the token, which is looked up once per token
+	// and only for the formats that need it
+	if username == "" && formatUsesUsername(opts.format) {
+		if username, err = gc.GetUsername(pat.UserID); err != nil {
+			resp.AddWarning("token was created but the username of its bot user could not be looked up - " + err.Error())
+			return resp, ""
+		}
 	}
+	credential, err := formatter.format(opts.format, username, pat, base)
+	if err != nil {
+		resp.AddWarning("token was created but could not be formatted - " + err.Error())
+		return resp, username
+	}
+	if username != "" {
+		resp.Data["username"] = username
+	}
+	resp.Data["credential"] = credential
+	return resp, username
+}
 
+func (b *GitlabBackend) pathRoleTokenCreate(ctx context.Context, req *logical.Request, data *framework.FieldData) (resp *logical.Response, err error) {
+	start := time.Now()
 	roleName := data.Get("role_name").(string)
+	var gitlabErr error
+	var gitlabStatus int
+	var outcome string
+	roleLabel := roleLabelUnknown
+	defer func() {
+		emitTokenIssue("create_role_token", roleLabel, issueOutcome(resp, gitlabErr, outcome), start, gitlabStatus, gitlabErr)
+	}()
+
 	// get the role by name
 	role, err := getRoleEntry(ctx, req.Storage, roleName)
 	if role == nil || err != nil {
 		return logical.ErrorResponse(fmt.Sprintf("Role name '%s' not recognised", roleName)), nil
 	}
+	roleLabel = roleName
+	if role.deleting() {
+		return logical.ErrorResponse(fmt.Sprintf("Role '%s' is being deleted and no longer issues tokens", roleName)), nil
+	}
+	// the template is applied at issuance, so template changes apply to existing roles
+	role, _, err = effectiveRole(ctx, req.Storage, role)
+	if err != nil {
+		return logical.ErrorResponse("Failed to resolve role - " + err.Error()), nil
+	}
+	// claims are checked before any call to Gitlab
+	if role.bindsClaims() {
+		if err := b.checkBoundClaims(req, role); err != nil {
+			return logical.ErrorResponse("Request does not satisfy the bound claims of the role - " + err.Error()), nil
+		}
+	}
+	wrapInfo, err := role.responseWrapping(req)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	opts := roleTokenOptions{
+		wrapInfo:     wrapInfo,
+		minimal:      data.Get("minimal").(bool),
+		format:       data.Get("format").(string),
+		registryHost: data.Get("registry_host").(string),
+		npmScope:     data.Get("npm_scope").(string),
+	}
+	if opts.format != "" && !validCredentialFormat(opts.format) {
+		return logical.ErrorResponse(fmt.Sprintf("Unknown format '%s', must be one of %s", opts.format,
+			strings.Join(credentialFormats, ", "))), nil
+	}
+	if opts.npmScope != "" && !npmScopePattern.MatchString(opts.npmScope) {
+		return logical.ErrorResponse(fmt.Sprintf("npm_scope '%s' is not an npm package scope such as @team", opts.npmScope)), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return logical.ErrorResponse("failed to obtain gitlab config - %s", err.Error()), nil
+	}
+	gc, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return clientErrorResponse(err)
+	}
+	var sudoUser string
+	if role.impersonates() {
+		if sudoUser, err = b.sudoUser(req, role); err != nil {
+			return logical.ErrorResponse("Failed to resolve the Gitlab user to create the token as - " + err.Error()), nil
+		}
+		gc = gc.Sudo(sudoUser)
+	}
+	if role.identityTemplated() {
+		var path string
+		if role, path, err = b.resolveIdentityTemplates(req, role); err != nil {
+			return logical.ErrorResponse("Failed to resolve the role for the requesting entity - " + err.Error()), nil
+		}
+		if path != "" {
+			// looked up as the impersonated user, if any, who must be able to see it
+			if role.BaseTokenStorage.ID, err = gc.GetTargetID(role.BaseTokenStorage.tokenType(), path); err != nil {
+				gitlabErr = err
+				return gitlabErrorResponse("Failed to look up "+path, err)
+			}
+		}
+		if err := role.BaseTokenStorage.assertValid(); err != nil {
+			return logical.ErrorResponse("Failed to validate - " + err.Error()), nil
+		}
+	}
+	requestedTTL := time.Duration(data.Get("ttl").(int)) * time.Second
+	// a token is only reused for the entity it was issued to, and with the TTL of the role
+	reuse := role.ReuseTokens && req.EntityID != "" && requestedTTL == 0
+	// tokens are issued under the role lock, so that none is created once a deletion has swept the outstanding
+	// tokens of the role, and concurrent requests cannot exceed the quotas or duplicate cached tokens
+	lock := b.roleLock(roleName)
+	lock.Lock()
+	defer lock.Unlock()
+	if current, err := getRoleEntry(ctx, req.Storage, roleName); err != nil {
+		return nil, err
+	} else if current == nil || current.deleting() {
+		return logical.ErrorResponse(fmt.Sprintf("Role '%s' is being deleted and no longer issues tokens", roleName)), nil
+	}
+	if reuse {
+		cached, err := b.reuseCachedToken(ctx, req, role, sudoUser)
+		if err != nil {
+			b.requestLogger(req, "role_name", roleName).Warn("failed to reuse cached token, creating a new one", "error", err)
+		} else if cached != nil {
+			outcome = outcomeReused
+			resp, username := b.roleTokenResponse(gc, config, cached.PAT, cached.Username, &role.BaseTokenStorage, opts)
+			if !opts.minimal {
+				resp.Data["reused"] = true
+			}
+			// the username is kept for the next requests the token is returned to
+			if username != cached.Username {
+				cached.Username = username
+				if err := cached.save(ctx, req.Storage, role.RoleName, req.EntityID); err != nil {
+					b.requestLogger(req, "role_name", roleName).Warn("failed to cache the username of a reused token",
+						"token_id", cached.TokenID, "error", err)
+				}
+			}
+			return resp, nil
+		}
+	}
+	if role.hasQuotas() {
+		if err := checkRoleQuotas(ctx, req.Storage, role, time.Now()); err != nil {
+			var quotaErr *quotaError
+			if !errors.As(err, &quotaErr) {
+				return nil, err
+			}
+			outcome = outcomeLimited
+			emitQuotaExceeded(roleName, quotaErr.Quota)
+			b.requestLogger(req, "role_name", roleName).Warn("token request over role quota", "quota", quotaErr.Quota)
+			return quotaErrorResponse(quotaErr)
+		}
+	}
 
-	expiresAt := time.Now().UTC().Add(role.TokenTTL)
-	b.Logger().Debug("generating access token for a role", "role_name", role.RoleName, "expires_at", expiresAt)
-	pat, err := gc.CreateProjectAccessToken(&role.BaseTokenStorage, &expiresAt)
+	// the role is checked against the current config, which may have changed since the role was written
+	ttl, warnings, err := role.ttlLimits(config, requestedTTL).resolve()
 	if err != nil {
-		return logical.ErrorResponse("Failed to create a token - " + err.Error()), nil
+		return logical.ErrorResponse("Failed to validate - " + err.Error()), nil
 	}
 
-	return &logical.Response{Data: tokenDetails(pat)}, nil
+	var expiresAt *time.Time
+	if ttl > 0 {
+		e := time.Now().UTC().Add(ttl)
+		expiresAt = &e
+	}
+	logger := b.requestLogger(req, "role_name", role.RoleName, "id", role.BaseTokenStorage.ID,
+		"token_type", role.BaseTokenStorage.tokenType(), "sudo", sudoUser)
+	logger.Debug("generating access token for a role", "expires_at", expiresAt)
+	pat, err := createAccessToken(gc, &role.BaseTokenStorage, expiresAt)
+	if err != nil {
+		gitlabErr = err
+		logger.Error("failed to create a token", errorLogFields(err)...)
+		return gitlabErrorResponse("Failed to create a token", err)
+	}
+	gitlabStatus = http.StatusCreated
+	logger.Debug("generated access token", "token_id", pat.ID)
+
+	resp, username := b.roleTokenResponse(gc, config, pat, "", &role.BaseTokenStorage, opts)
+	resp.Warnings = append(warnings, resp.Warnings...)
+	if err := b.recordIssuedToken(ctx, req, pat, &role.BaseTokenStorage, role.RoleName, username); err != nil {
+		resp.AddWarning("token was created but could not be recorded in the token inventory - " + err.Error())
+	}
+	if err := recordRoleIssue(ctx, req.Storage, role, time.Now()); err != nil {
+		resp.AddWarning("token was created but could not be counted against the role issue rate - " + err.Error())
+	}
+	if reuse {
+		if !opts.minimal {
+			resp.Data["reused"] = false
+		}
+		cached := &cachedToken{TokenID: pat.ID, PAT: pat, Base: role.BaseTokenStorage, SudoUser: sudoUser, Username: username,
+			Consumers: 1}
+		if pat.ExpiresAt != nil {
+			expiresAt := time.Time(*pat.ExpiresAt)
+			cached.ExpiresAt = &expiresAt
+		}
+		if err := cached.save(ctx, req.Storage, role.RoleName, req.EntityID); err != nil {
+			logger.Warn("failed to cache token for reuse", "token_id", pat.ID, "error", err)
+			resp.AddWarning("token was created but could not be cached for reuse - " + err.Error())
+		}
+	}
+	return resp, nil
+}
+
+// reuseCachedToken returns the cached token of the role for the requesting entity, or nil if there is none
+// that can be reused
+func (b *GitlabBackend) reuseCachedToken(ctx context.Context, req *logical.Request, role *RoleStorageEntry, sudoUser string) (*cachedToken, error) {
+	cached, err := getCachedToken(ctx, req.Storage, role.RoleName, req.EntityID)
+	if err != nil || cached == nil {
+		return nil, err
+	}
+	ok, err := cached.reusable(ctx, req.Storage, role, sudoUser, time.Now())
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	cached.Consumers++
+	if err := cached.save(ctx, req.Storage, role.RoleName, req.EntityID); err != nil {
+		return nil, err
+	}
+	b.requestLogger(req, "role_name", role.RoleName).Debug("reused cached access token", "token_id", cached.TokenID,
+		"consumers", cached.Consumers)
+
+	return cached, nil
 }
 
 // set up the paths for the roles within vault
@@ -60,15 +308,11 @@ func pathRoleToken(b *GitlabBackend) []*framework.Path {
 			Pattern: fmt.Sprintf("%s/%s", pathPatternToken, framework.GenericNameRegex("role_name")),
 			Fields:  roleTokenSchema,
 			Operations: map[logical.Operation]framework.OperationHandler{
-				logical.CreateOperation: &framework.PathOperation{
-
+				logical.UpdateOperation: &framework.PathOperation{
 					Callback: b.pathRoleTokenCreate,
 					Summary:  "Create a project access token based on a predefined role",
 					Examples: roleTokenExamples,
 				},
-				logical.UpdateOperation: &framework.PathOperation{
-					Callback: b.pathRoleTokenCreate,
-				},
 			},
 			HelpSynopsis:    pathRoleTokenHelpSyn,
 			HelpDescription: pathRoleTokenHelpDesc,
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
@@ -84,9 +85,71 @@ func TestAccRoleToken(t *testing.T) {
 
 }
 
+func TestRoleTokenTTL(t *testing.T) {
+	t.Parallel()
+	a := assert.New(t)
+
+	backend, storage := getTestBackend(t, true)
+	conf := map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+		"max_ttl":  fmt.Sprintf("%dh", 7*24),
+	}
+	testConfigUpdate(t, backend, storage, conf)
+
+	roleName := "ttl"
+	mustRoleCreate(t, backend, storage, roleName, map[string]interface{}{
+		"id":        1,
+		"name":      "role-ttl",
+		"scopes":    []string{"read_api"},
+		"token_ttl": fmt.Sprintf("%dh", 3*24),
+		"max_ttl":   fmt.Sprintf("%dh", 4*24),
+	})
+	req := &logical.Request{Storage: storage}
+
+	t.Run("role default", func(t *testing.T) {
+		resp, err := testIssueRoleToken(t, backend, req, roleName, nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		a.WithinDuration(time.Now().Add(3*24*time.Hour), resp.Data["expires_at"].(time.Time), time.Minute)
+	})
+
+	t.Run("requested ttl", func(t *testing.T) {
+		resp, err := testIssueRoleToken(t, backend, req, roleName, map[string]interface{}{"ttl": "48h"})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		a.WithinDuration(time.Now().Add(2*24*time.Hour), resp.Data["expires_at"].(time.Time), time.Minute)
+	})
+
+	t.Run("requested ttl beyond role max", func(t *testing.T) {
+		resp, err := testIssueRoleToken(t, backend, req, roleName, map[string]interface{}{"ttl": "120h"})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		a.Contains(resp.Data["error"], "exceeds configured maximum ttl")
+	})
+
+	t.Run("mount max lowered after the role was written", func(t *testing.T) {
+		conf["max_ttl"] = fmt.Sprintf("%dh", 2*24)
+		testConfigUpdate(t, backend, storage, conf)
+
+		resp, err := testIssueRoleToken(t, backend, req, roleName, nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError(), "role ttl should be rechecked against the current config")
+
+		conf["ttl_policy"] = ttlPolicyClamp
+		testConfigUpdate(t, backend, storage, conf)
+
+		resp, err = testIssueRoleToken(t, backend, req, roleName, nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		a.Len(resp.Warnings, 1)
+		a.WithinDuration(time.Now().Add(2*24*time.Hour), resp.Data["expires_at"].(time.Time), time.Minute)
+	})
+}
+
 // create the token given role name
 func testIssueRoleToken(t *testing.T, b logical.Backend, req *logical.Request, roleName string, data map[string]interface{}) (*logical.Response, error) {
-	req.Operation = logical.CreateOperation
+	req.Operation = logical.UpdateOperation
 	req.Path = fmt.Sprintf("%s/%s", pathPatternToken, roleName)
 	req.Data = data
 
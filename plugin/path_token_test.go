@@ -128,7 +128,7 @@ func TestAccToken(t *testing.T) {
 
 // create the token given the parameters
 func testIssueToken(t *testing.T, b logical.Backend, req *logical.Request, data map[string]interface{}) (*logical.Response, error) {
-	req.Operation = logical.CreateOperation
+	req.Operation = logical.UpdateOperation
 	req.Path = pathPatternToken
 	req.Data = data
 
@@ -0,0 +1,202 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	pathPatternRoleUsage = "role-usage"
+
+	quotaActiveTokens = "active_tokens"
+	quotaIssueRate    = "issue_rate"
+)
+
+var errInvalidIssueRate = errors.New("issue_rate must be formatted as <count>/<period>, such as 10/minute or 100/1h")
+
+var issueRateUnits = []struct {
+	name   string
+	period time.Duration
+}{
+	{"second", time.Second},
+	{"minute", time.Minute},
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+}
+
+// parseIssueRate parses an issuance rate such as "10/minute", "10/m" or "100/90m". An empty rate is no limit.
+func parseIssueRate(s string) (int, time.Duration, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errInvalidIssueRate
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || limit <= 0 {
+		return 0, 0, errInvalidIssueRate
+	}
+	unit := strings.ToLower(strings.TrimSpace(parts[1]))
+	for _, u := range issueRateUnits {
+		if unit == u.name || unit == u.name[:1] {
+			return limit, u.period, nil
+		}
+	}
+	period, err := time.ParseDuration(unit)
+	if err != nil || period <= 0 {
+		return 0, 0, errInvalidIssueRate
+	}
+	return limit, period, nil
+}
+
+// formatIssueRate formats an issuance rate the way parseIssueRate reads it
+func formatIssueRate(limit int, period time.Duration) string {
+	if limit <= 0 {
+		return ""
+	}
+	for _, u := range issueRateUnits {
+		if period == u.period {
+			return fmt.Sprintf("%d/%s", limit, u.name)
+		}
+	}
+	return fmt.Sprintf("%d/%s", limit, period)
+}
+
+// RoleUsageEntry holds the issuance counters of a role, stored separately from the role so that issuing
+// tokens does not rewrite the role
+type RoleUsageEntry struct {
+	// Version of the stored format, see storageKind
+	Version int `json:"version"`
+	// Issued holds the times tokens were issued within the last issue rate period, oldest first
+	Issued []time.Time `json:"issued"`
+}
+
+// trim drops the issuance times older than period
+func (u *RoleUsageEntry) trim(now time.Time, period time.Duration) {
+	i := 0
+	for i < len(u.Issued) && !u.Issued[i].After(now.Add(-period)) {
+		i++
+	}
+	u.Issued = u.Issued[i:]
+}
+
+func getRoleUsageEntry(ctx context.Context, storage logical.Storage, roleName string) (*RoleUsageEntry, error) {
+	var result RoleUsageEntry
+	if entry, err := storage.Get(ctx, fmt.Sprintf("%s/%s", pathPatternRoleUsage, roleName)); err != nil {
+		return nil, err
+	} else if entry == nil {
+		return &result, nil
+	} else if _, err := storageRoleUsage.decode(entry, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (u *RoleUsageEntry) save(ctx context.Context, storage logical.Storage, roleName string) error {
+	u.Version = storageRoleUsage.version()
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", pathPatternRoleUsage, roleName), u)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+func deleteRoleUsageEntry(ctx context.Context, storage logical.Storage, roleName string) error {
+	return storage.Delete(ctx, fmt.Sprintf("%s/%s", pathPatternRoleUsage, roleName))
+}
+
+// hasQuotas reports whether the role limits its active tokens or issuance rate
+func (role *RoleStorageEntry) hasQuotas() bool {
+	return role.MaxActiveTokens > 0 || role.IssueRateLimit > 0
+}
+
+// quotaError is returned when issuing a token would exceed a quota of the role
+type quotaError struct {
+	Quota   string
+	Message string
+}
+
+func (e *quotaError) Error() string {
+	return e.Message
+}
+
+// checkRoleQuotas returns a *quotaError when issuing a token for the role at now would exceed one of its quotas
+func checkRoleQuotas(ctx context.Context, storage logical.Storage, role *RoleStorageEntry, now time.Time) error {
+	if role.MaxActiveTokens > 0 {
+		active, err := findRoleActiveTokens(ctx, storage, role.RoleName)
+		if err != nil {
+			return err
+		}
+		if len(active) >= role.MaxActiveTokens {
+			return &quotaError{
+				Quota: quotaActiveTokens,
+				Message: fmt.Sprintf("Role '%s' has reached its max_active_tokens limit of %d active token(s); revoke tokens or wait for them to expire",
+					role.RoleName, role.MaxActiveTokens),
+			}
+		}
+	}
+
+	if role.IssueRateLimit > 0 {
+		usage, err := getRoleUsageEntry(ctx, storage, role.RoleName)
+		if err != nil {
+			return err
+		}
+		usage.trim(now, role.IssueRatePeriod)
+		if len(usage.Issued) >= role.IssueRateLimit {
+			retryIn := usage.Issued[len(usage.Issued)-role.IssueRateLimit].Add(role.IssueRatePeriod).Sub(now)
+			return &quotaError{
+				Quota: quotaIssueRate,
+				Message: fmt.Sprintf("Role '%s' has reached its issue rate of %s; retry in %s", role.RoleName,
+					formatIssueRate(role.IssueRateLimit, role.IssueRatePeriod), retryIn.Round(time.Second)),
+			}
+		}
+	}
+	return nil
+}
+
+// recordRoleIssue counts a token issued for the role at now against its issue rate
+func recordRoleIssue(ctx context.Context, storage logical.Storage, role *RoleStorageEntry, now time.Time) error {
+	if role.IssueRateLimit <= 0 {
+		return nil
+	}
+	usage, err := getRoleUsageEntry(ctx, storage, role.RoleName)
+	if err != nil {
+		return err
+	}
+	usage.trim(now, role.IssueRatePeriod)
+	usage.Issued = append(usage.Issued, now)
+	return usage.save(ctx, storage, role.RoleName)
+}
+
+// quotaErrorResponse rejects a request over a quota of the role, so Vault answers with 429 Too Many Requests.
+// The active tokens quota is the role's own, and is not reported as a Vault lease count quota.
+func quotaErrorResponse(err *quotaError) (*logical.Response, error) {
+	if err.Quota == quotaActiveTokens {
+		return nil, logical.CodedError(http.StatusTooManyRequests, err.Message)
+	}
+	return logical.ErrorResponse(err.Message), logical.ErrRateLimitQuotaExceeded
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIssueRate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		rate      string
+		limit     int
+		period    time.Duration
+		formatted string
+		err       bool
+	}{
+		{rate: ""},
+		{rate: "10/minute", limit: 10, period: time.Minute, formatted: "10/minute"},
+		{rate: "10/m", limit: 10, period: time.Minute, formatted: "10/minute"},
+		{rate: "5 / Hour", limit: 5, period: time.Hour, formatted: "5/hour"},
+		{rate: "100/d", limit: 100, period: 24 * time.Hour, formatted: "100/day"},
+		{rate: "3/90s", limit: 3, period: 90 * time.Second, formatted: "3/1m30s"},
+		{rate: "10", err: true},
+		{rate: "0/minute", err: true},
+		{rate: "ten/minute", err: true},
+		{rate: "10/fortnight", err: true},
+		{rate: "10/-1m", err: true},
+	}
+
+	for _, test := range tests {
+		limit, period, err := parseIssueRate(test.rate)
+		if test.err {
+			assert.ErrorIs(t, err, errInvalidIssueRate, test.rate)
+			continue
+		}
+		require.NoError(t, err, test.rate)
+		assert.Equal(t, test.limit, limit, test.rate)
+		assert.Equal(t, test.period, period, test.rate)
+		assert.Equal(t, test.formatted, formatIssueRate(limit, period), test.rate)
+	}
+}
+
+func TestRoleQuotas(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+	req := &logical.Request{Storage: storage}
+	issue := func(roleName string) (*logical.Response, error) {
+		return testIssueRoleToken(t, backend, req, roleName, nil)
+	}
+
+	t.Run("invalid quotas", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, storage, "invalid", map[string]interface{}{
+			"id": 1, "name": "quota", "scopes": "api", "max_active_tokens": -1, "issue_rate": "lots",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "max_active_tokens must not be negative")
+		assert.Contains(t, resp.Error().Error(), errInvalidIssueRate.Error())
+	})
+
+	t.Run("max active tokens", func(t *testing.T) {
+		mustRoleCreate(t, backend, storage, "active", map[string]interface{}{
+			"id": 1, "name": "quota", "scopes": "api", "max_active_tokens": 2,
+		})
+		resp, err := testRoleRead(t, backend, storage, "active")
+		require.NoError(t, err)
+		assert.Equal(t, 2, resp.Data["max_active_tokens"])
+
+		for i := 0; i < 2; i++ {
+			resp, err := issue("active")
+			require.NoError(t, err)
+			require.False(t, resp.IsError())
+		}
+
+		resp, err = issue("active")
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, logical.ErrLeaseCountQuotaExceeded, "not a Vault lease count quota")
+		assert.Equal(t, http.StatusTooManyRequests, responseStatus(resp, err))
+		assert.Equal(t, "Role 'active' has reached its max_active_tokens limit of 2 active token(s); revoke tokens or wait for them to expire",
+			err.Error())
+
+		resp, err = testRevoke(t, backend, storage, "role/active", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		resp, err = issue("active")
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "revoked tokens do not count against the quota")
+	})
+
+	t.Run("tokens recorded before the role index", func(t *testing.T) {
+		mustRoleCreate(t, backend, storage, "unindexed", map[string]interface{}{
+			"id": 1, "name": "quota", "scopes": "api", "max_active_tokens": 1,
+		})
+		entry := &TokenInventoryEntry{TokenID: 9001, ProjectID: 1, RoleName: "unindexed", CreatedAt: time.Now()}
+		require.NoError(t, entry.save(context.Background(), storage))
+
+		require.NoError(t, backend.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage}))
+		_, err := issue("unindexed")
+		require.Error(t, err, "the token is indexed when the mount is initialized")
+		assert.Contains(t, err.Error(), "Role 'unindexed' has reached its max_active_tokens limit of 1")
+	})
+
+	t.Run("issue rate", func(t *testing.T) {
+		mustRoleCreate(t, backend, storage, "rate", map[string]interface{}{
+			"id": 1, "name": "quota", "scopes": "api", "issue_rate": "2/hour",
+		})
+		resp, err := testRoleRead(t, backend, storage, "rate")
+		require.NoError(t, err)
+		assert.Equal(t, "2/hour", resp.Data["issue_rate"])
+
+		for i := 0; i < 2; i++ {
+			resp, err := issue("rate")
+			require.NoError(t, err)
+			require.False(t, resp.IsError())
+		}
+
+		resp, err = issue("rate")
+		require.ErrorIs(t, err, logical.ErrRateLimitQuotaExceeded)
+		assert.Equal(t, http.StatusTooManyRequests, responseStatus(resp, err))
+		assert.Contains(t, resp.Error().Error(), "Role 'rate' has reached its issue rate of 2/hour; retry in ")
+
+		role, err := getRoleEntry(context.Background(), storage, "rate")
+		require.NoError(t, err)
+		assert.NoError(t, checkRoleQuotas(context.Background(), storage, role, time.Now().Add(time.Hour)),
+			"issuances older than the period do not count")
+	})
+
+	t.Run("counters are deleted with the role", func(t *testing.T) {
+		resp, err := testRevoke(t, backend, storage, "role/rate", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		mustRoleDelete(t, backend, storage, "rate")
+
+		entry, err := storage.Get(context.Background(), pathPatternRoleUsage+"/rate")
+		require.NoError(t, err)
+		assert.Nil(t, entry)
+	})
+}
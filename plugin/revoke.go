@@ -0,0 +1,176 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const defaultRevokeParallelism = 5
+
+// revocationResult is the outcome of revoking a single token
+type revocationResult struct {
+	TokenID   int
+	ProjectID int
+	RoleName  string
+	Err       error
+	// Warning is set when the token was revoked in Gitlab but the revocation could not be recorded
+	Warning error
+}
+
+func (r *revocationResult) detail() map[string]interface{} {
+	d := map[string]interface{}{
+		"token_id":   r.TokenID,
+		"project_id": r.ProjectID,
+		"role_name":  r.RoleName,
+		"revoked":    r.Err == nil,
+	}
+	if r.Err != nil {
+		d["error"] = errorMessage(r.Err)
+		var apiErr *APIError
+		d["retryable"] = errors.As(r.Err, &apiErr) && apiErr.Retryable()
+	}
+	if r.Warning != nil {
+		d["warning"] = r.Warning.Error()
+	}
+	return d
+}
+
+// findActiveTokens returns the inventory entries of active tokens for which match returns true
+func findActiveTokens(ctx context.Context, storage logical.Storage, match func(*TokenInventoryEntry) bool) ([]*TokenInventoryEntry, error) {
+	ids, err := listTokenInventoryEntries(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var entries []*TokenInventoryEntry
+	for _, idRaw := range ids {
+		id, err := strconv.Atoi(idRaw)
+		if err != nil {
+			continue
+		}
+		entry, err := getTokenInventoryEntry(ctx, storage, id)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || entry.status(now) != tokenStatusActive || !match(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// untrackedProjectTokens returns the active access tokens of a project in Gitlab that are not in the inventory,
+// such as tokens issued before the inventory existed
+func untrackedProjectTokens(ctx context.Context, storage logical.Storage, gc Client, projectID int) ([]*TokenInventoryEntry, error) {
+	pats, err := gc.ListProjectAccessTokens(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*TokenInventoryEntry
+	for _, pat := range pats {
+		if !pat.Active || pat.Revoked {
+			continue
+		}
+		entry, err := getTokenInventoryEntry(ctx, storage, pat.ID)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			continue
+		}
+		entries = append(entries, newTokenInventoryEntry(pat, &BaseTokenStorageEntry{ID: projectID, TokenType: tokenTypeProject}, "", ""))
+	}
+	return entries, nil
+}
+
+// revokeTokens revokes the given tokens in Gitlab with at most parallelism concurrent calls,
+// and marks the successfully revoked ones in the inventory. A token revoked in Gitlab whose inventory entry
+// could not be updated is still reported as revoked, with a warning.
+func revokeTokens(ctx context.Context, storage logical.Storage, logger hclog.Logger, gc Client, entries []*TokenInventoryEntry, parallelism int) []*revocationResult {
+	if parallelism <= 0 {
+		parallelism = defaultRevokeParallelism
+	}
+
+	results := make([]*revocationResult, len(entries))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		wg.Add(1)
+		go func(i int, entry *TokenInventoryEntry) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result := &revocationResult{
+				TokenID:   entry.TokenID,
+				ProjectID: entry.ProjectID,
+				RoleName:  entry.RoleName,
+			}
+			results[i] = result
+
+			tokenLogger := logger.With("token_id", entry.TokenID, "id", entry.ProjectID, "role_name", entry.RoleName)
+			if err := revokeAccessToken(gc, entry); err != nil {
+				tokenLogger.Error("failed to revoke token", errorLogFields(err)...)
+				result.Err = err
+				return
+			}
+
+			revokedAt := time.Now().UTC()
+			entry.Revoked = true
+			entry.RevokedAt = &revokedAt
+			if err := entry.save(ctx, storage); err != nil {
+				tokenLogger.Error("token revoked but inventory could not be updated", "error", err)
+				result.Warning = fmt.Errorf("token revoked in Gitlab but the inventory could not be updated: %w", err)
+				return
+			}
+			tokenLogger.Debug("revoked token")
+		}(i, entry)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].TokenID < results[j].TokenID })
+	return results
+}
+
+// revokeAccessToken revokes a project or group access token depending on the token type
+func revokeAccessToken(gc Client, entry *TokenInventoryEntry) error {
+	if entry.tokenType() == tokenTypeGroup {
+		return gc.RevokeGroupAccessToken(entry.ProjectID, entry.TokenID)
+	}
+	return gc.RevokeProjectAccessToken(entry.ProjectID, entry.TokenID)
+}
+
+// rotateAccessToken rotates a project or group access token depending on the token type
+func rotateAccessToken(gc Client, entry *TokenInventoryEntry, expiresAt *time.Time) (*PAT, error) {
+	if entry.tokenType() == tokenTypeGroup {
+		return gc.RotateGroupAccessToken(entry.ProjectID, entry.TokenID, expiresAt)
+	}
+	return gc.RotateProjectAccessToken(entry.ProjectID, entry.TokenID, expiresAt)
+}
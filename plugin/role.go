@@ -29,41 +29,211 @@ import (
 type RoleStorageEntry struct {
 	// `json:"" structs:"" mapstructure:""`
 	RoleName string `json:"role_name" structs:"role_name" mapstructure:"role_name"`
+	// Version of the stored format, see storageKind
+	Version int `json:"version" structs:"version" mapstructure:"version"`
 	// The TTL for your token
-	TokenTTL         time.Duration `json:"token_ttl" structs:"token_ttl" mapstructure:"token_ttl"`
-	BaseTokenStorage BaseTokenStorageEntry
+	TokenTTL time.Duration `json:"token_ttl" structs:"token_ttl" mapstructure:"token_ttl"`
+	// The maximum TTL a token can be requested with
+	MaxTTL           time.Duration         `json:"max_ttl" structs:"max_ttl" mapstructure:"max_ttl"`
+	BaseTokenStorage BaseTokenStorageEntry `json:"base_token_storage" structs:"base_token_storage" mapstructure:"base_token_storage"`
+	// Revoke outstanding tokens when the role is deleted
+	RevokeOnDelete bool `json:"revoke_on_delete" structs:"revoke_on_delete" mapstructure:"revoke_on_delete"`
+	// Empty for an active role, roleStatusDeleting while waiting for outstanding tokens to drain
+	Status string `json:"status,omitempty" structs:"status" mapstructure:"status"`
+	// Name of the role template the fields not set on the role are taken from
+	Template string `json:"template,omitempty" structs:"template" mapstructure:"template"`
+	// Maximum number of active tokens issued for the role, 0 for no limit
+	MaxActiveTokens int `json:"max_active_tokens,omitempty" structs:"max_active_tokens" mapstructure:"max_active_tokens"`
+	// Maximum number of tokens issued for the role within IssueRatePeriod, 0 for no limit
+	IssueRateLimit  int           `json:"issue_rate_limit,omitempty" structs:"issue_rate_limit" mapstructure:"issue_rate_limit"`
+	IssueRatePeriod time.Duration `json:"issue_rate_period,omitempty" structs:"issue_rate_period" mapstructure:"issue_rate_period"`
+	// Return a cached live token to repeated requests of the same entity instead of creating a new one
+	ReuseTokens bool `json:"reuse_tokens,omitempty" structs:"reuse_tokens" mapstructure:"reuse_tokens"`
+	// Minimum remaining lifetime of a cached token for it to be reused, defaultReuseMinRemaining if 0
+	ReuseMinRemaining time.Duration `json:"reuse_min_remaining,omitempty" structs:"reuse_min_remaining" mapstructure:"reuse_min_remaining"`
+	// Maximum number of requests a cached token is returned to, 0 for no limit
+	ReuseMaxConsumers int `json:"reuse_max_consumers,omitempty" structs:"reuse_max_consumers" mapstructure:"reuse_max_consumers"`
+	// Create tokens as the Gitlab user named by this entity metadata key, with the Sudo header
+	SudoMetadataKey string `json:"sudo_metadata_key,omitempty" structs:"sudo_metadata_key" mapstructure:"sudo_metadata_key"`
+	// Create tokens as the Gitlab user named by the entity alias on the auth mount with this accessor
+	SudoAliasMountAccessor string `json:"sudo_alias_mount_accessor,omitempty" structs:"sudo_alias_mount_accessor" mapstructure:"sudo_alias_mount_accessor"`
+	// Identity template resolved from the requesting entity to the full path of the project or group,
+	// instead of the ID, and the patterns the resolved path must match
+	PathTemplate string   `json:"path_template,omitempty" structs:"path_template" mapstructure:"path_template"`
+	AllowedPaths []string `json:"allowed_paths,omitempty" structs:"allowed_paths" mapstructure:"allowed_paths"`
+	// Identity template resolved from the requesting entity to comma separated scopes, instead of the
+	// scopes, and the patterns the resolved scopes must match
+	ScopesTemplate string   `json:"scopes_template,omitempty" structs:"scopes_template" mapstructure:"scopes_template"`
+	AllowedScopes  []string `json:"allowed_scopes,omitempty" structs:"allowed_scopes" mapstructure:"allowed_scopes"`
+	// Claims of the requesting entity, by name, and the comma separated values each must match
+	BoundClaims map[string]string `json:"bound_claims,omitempty" structs:"bound_claims" mapstructure:"bound_claims"`
+	// Read the bound claims from the metadata of the entity alias on the auth mount with this accessor,
+	// instead of the entity metadata
+	BoundClaimsMountAccessor string `json:"bound_claims_mount_accessor,omitempty" structs:"bound_claims_mount_accessor" mapstructure:"bound_claims_mount_accessor"`
+	// Refuse token requests that do not ask for their response to be wrapped
+	RequireResponseWrapping bool `json:"require_response_wrapping,omitempty" structs:"require_response_wrapping" mapstructure:"require_response_wrapping"`
+	// TTL responses to unwrapped requests are wrapped with, and the maximum wrap TTL requests may ask for
+	WrapTTL time.Duration `json:"wrap_ttl,omitempty" structs:"wrap_ttl" mapstructure:"wrap_ttl"`
 }
 
-func (role *RoleStorageEntry) assertValid(maxTTL time.Duration) error {
+const (
+	roleStatusActive   = "active"
+	roleStatusDeleting = "deleting"
+)
+
+func (role *RoleStorageEntry) status() string {
+	if role.Status == "" {
+		return roleStatusActive
+	}
+	return role.Status
+}
+
+func (role *RoleStorageEntry) deleting() bool {
+	return role.Status == roleStatusDeleting
+}
+
+func (role *RoleStorageEntry) assertValid() error {
 	var err *multierror.Error
-	if e := role.BaseTokenStorage.assertValid(); e != nil {
+	if e := role.BaseTokenStorage.assertValidTemplated(role.PathTemplate != "", role.ScopesTemplate != ""); e != nil {
+		err = multierror.Append(err, e)
+	}
+	if e := role.assertValidIdentityTemplates(); e != nil {
+		err = multierror.Append(err, e)
+	}
+	if e := role.assertValidBoundClaims(); e != nil {
 		err = multierror.Append(err, e)
 	}
 
-	if maxTTL > time.Duration(0) {
-		if role.TokenTTL > maxTTL {
-			errMsg := fmt.Sprintf("Requested token ttl '%v' exceeds configured maximum ttl of '%v's. ",
-				role.TokenTTL, int64(maxTTL/time.Second))
-			err = multierror.Append(err, errors.New(errMsg))
-		}
+	if role.MaxTTL > time.Duration(0) && role.TokenTTL > role.MaxTTL {
+		err = multierror.Append(err, fmt.Errorf("token_ttl '%v' exceeds the role max_ttl of '%v'", role.TokenTTL, role.MaxTTL))
+	}
+	if role.MaxActiveTokens < 0 {
+		err = multierror.Append(err, errors.New("max_active_tokens must not be negative"))
+	}
+	if role.IssueRateLimit < 0 {
+		err = multierror.Append(err, errInvalidIssueRate)
+	}
+	if role.WrapTTL < 0 {
+		err = multierror.Append(err, errors.New("wrap_ttl must not be negative"))
+	}
+	if role.ReuseMaxConsumers < 0 {
+		err = multierror.Append(err, errors.New("reuse_max_consumers must not be negative"))
+	}
+	if role.SudoMetadataKey != "" && role.SudoAliasMountAccessor != "" {
+		err = multierror.Append(err, errSudoBothSources)
+	}
+	if role.ReuseTokens && role.TokenTTL > 0 && role.reuseMinRemaining() >= role.TokenTTL {
+		err = multierror.Append(err, fmt.Errorf("reuse_min_remaining '%v' must be less than token_ttl '%v', or tokens are never reused",
+			role.reuseMinRemaining(), role.TokenTTL))
 	}
 
 	return err.ErrorOrNil()
 }
 
+// validate checks the role and its TTLs against the mount configuration, and returns the warnings to report
+func (role *RoleStorageEntry) validate(config *ConfigStorageEntry) ([]string, error) {
+	var merr *multierror.Error
+	if err := role.assertValid(); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	_, warnings, err := role.ttlLimits(config, 0).resolve()
+	if err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if err := merr.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+	if role.TokenTTL == 0 {
+		warnings = append(warnings, NoTTLWarning("token_ttl"))
+	}
+	return warnings, nil
+}
+
+// ttlLimits returns the TTL limits for issuing a token with the role under the given mount config
+func (role *RoleStorageEntry) ttlLimits(config *ConfigStorageEntry, requested time.Duration) ttlLimits {
+	limits := config.ttlLimits()
+	limits.Requested = requested
+	limits.RoleDefault = role.TokenTTL
+	limits.RoleMax = role.MaxTTL
+	return limits
+}
+
 func (role *RoleStorageEntry) retrieve(data *framework.FieldData) {
+	if templateRaw, ok := data.GetOk("template"); ok {
+		role.Template = templateRaw.(string)
+	}
 	role.BaseTokenStorage.retrieve(data)
 	ttlRaw, ok := data.GetOk("token_ttl")
 	if ok && ttlRaw.(int) > 0 {
 		role.TokenTTL = time.Duration(ttlRaw.(int)) * time.Second
-	} else if role.TokenTTL == time.Duration(0) {
+	} else if ok && role.Template != "" {
+		// token_ttl=0 takes the TTL from the template
+		role.TokenTTL = 0
+	}
+	if role.TokenTTL == time.Duration(0) && role.Template == "" {
 		role.TokenTTL = time.Duration(roleSchema["token_ttl"].Default.(int)) * time.Second
 	}
-
+	if maxTTLRaw, ok := data.GetOk("max_ttl"); ok && maxTTLRaw.(int) >= 0 {
+		role.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
+	}
+	if revokeOnDeleteRaw, ok := data.GetOk("revoke_on_delete"); ok {
+		role.RevokeOnDelete = revokeOnDeleteRaw.(bool)
+	}
+	if maxActiveRaw, ok := data.GetOk("max_active_tokens"); ok {
+		role.MaxActiveTokens = maxActiveRaw.(int)
+	}
+	if reuseRaw, ok := data.GetOk("reuse_tokens"); ok {
+		role.ReuseTokens = reuseRaw.(bool)
+	}
+	if minRemainingRaw, ok := data.GetOk("reuse_min_remaining"); ok && minRemainingRaw.(int) >= 0 {
+		role.ReuseMinRemaining = time.Duration(minRemainingRaw.(int)) * time.Second
+	}
+	if maxConsumersRaw, ok := data.GetOk("reuse_max_consumers"); ok {
+		role.ReuseMaxConsumers = maxConsumersRaw.(int)
+	}
+	if metadataKeyRaw, ok := data.GetOk("sudo_metadata_key"); ok {
+		role.SudoMetadataKey = metadataKeyRaw.(string)
+	}
+	if accessorRaw, ok := data.GetOk("sudo_alias_mount_accessor"); ok {
+		role.SudoAliasMountAccessor = accessorRaw.(string)
+	}
+	if pathTemplateRaw, ok := data.GetOk("path_template"); ok {
+		role.PathTemplate = pathTemplateRaw.(string)
+	}
+	if allowedPathsRaw, ok := data.GetOk("allowed_paths"); ok {
+		role.AllowedPaths = allowedPathsRaw.([]string)
+	}
+	if scopesTemplateRaw, ok := data.GetOk("scopes_template"); ok {
+		role.ScopesTemplate = scopesTemplateRaw.(string)
+	}
+	if allowedScopesRaw, ok := data.GetOk("allowed_scopes"); ok {
+		role.AllowedScopes = allowedScopesRaw.([]string)
+	}
+	if boundClaimsRaw, ok := data.GetOk("bound_claims"); ok {
+		role.BoundClaims = boundClaimsRaw.(map[string]string)
+	}
+	if accessorRaw, ok := data.GetOk("bound_claims_mount_accessor"); ok {
+		role.BoundClaimsMountAccessor = accessorRaw.(string)
+	}
+	if requireWrappingRaw, ok := data.GetOk("require_response_wrapping"); ok {
+		role.RequireResponseWrapping = requireWrappingRaw.(bool)
+	}
+	if wrapTTLRaw, ok := data.GetOk("wrap_ttl"); ok {
+		role.WrapTTL = time.Duration(wrapTTLRaw.(int)) * time.Second
+	}
+	if issueRateRaw, ok := data.GetOk("issue_rate"); ok {
+		limit, period, err := parseIssueRate(issueRateRaw.(string))
+		if err != nil {
+			// an unparsable rate is kept as -1 and reported by assertValid
+			limit = -1
+		}
+		role.IssueRateLimit, role.IssueRatePeriod = limit, period
+	}
 }
 
 // save saves a role to storage
 func (role *RoleStorageEntry) save(ctx context.Context, storage logical.Storage) error {
+	role.Version = storageRole.version()
 	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", pathPatternRoles, role.RoleName), role)
 	if err != nil {
 		return err
@@ -77,13 +247,24 @@ func (b *GitlabBackend) roleLock(roleName string) *locksutil.LockEntry {
 	return locksutil.LockForKey(b.roleLocks, roleName)
 }
 
+// roleLocksFor returns the locks of the given roles, without duplicates and in a fixed order
+func (b *GitlabBackend) roleLocksFor(roleNames []string) []*locksutil.LockEntry {
+	return locksutil.LocksForKeys(b.roleLocks, roleNames)
+}
+
 // deleteRoleEntry will remove the role with specified name from storage
 func deleteRoleEntry(ctx context.Context, storage logical.Storage, roleName string) error {
 	if roleName == "" {
 		return fmt.Errorf("missing role name")
 	}
 
-	return storage.Delete(ctx, fmt.Sprintf("%s/%s", pathPatternRoles, roleName))
+	if err := storage.Delete(ctx, fmt.Sprintf("%s/%s", pathPatternRoles, roleName)); err != nil {
+		return err
+	}
+	if err := deleteCachedTokens(ctx, storage, roleName); err != nil {
+		return err
+	}
+	return deleteRoleUsageEntry(ctx, storage, roleName)
 }
 
 // getRoleEntry fetches a role from the storage
@@ -93,7 +274,7 @@ func getRoleEntry(ctx context.Context, storage logical.Storage, roleName string)
 		return nil, err
 	} else if entry == nil {
 		return nil, nil
-	} else if err := entry.DecodeJSON(&result); err != nil {
+	} else if _, err := storageRole.decode(entry, &result); err != nil {
 		return nil, err
 	}
 
@@ -108,3 +289,46 @@ func listRoleEntries(ctx context.Context, storage logical.Storage) ([]string, er
 	}
 	return roles, nil
 }
+
+// finalizeDeletingRoles removes roles in the deleting state once they have no outstanding tokens
+func (b *GitlabBackend) finalizeDeletingRoles(ctx context.Context, storage logical.Storage) error {
+	roleNames, err := listRoleEntries(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	for _, roleName := range roleNames {
+		if err := b.finalizeDeletingRole(ctx, storage, roleName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *GitlabBackend) finalizeDeletingRole(ctx context.Context, storage logical.Storage, roleName string) error {
+	lock := b.roleLock(roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getRoleEntry(ctx, storage, roleName)
+	if err != nil {
+		return err
+	}
+	if role == nil || !role.deleting() {
+		return nil
+	}
+
+	outstanding, err := findRoleActiveTokens(ctx, storage, roleName)
+	if err != nil {
+		return err
+	}
+	if len(outstanding) > 0 {
+		return nil
+	}
+
+	if err := deleteRoleEntry(ctx, storage, roleName); err != nil {
+		return err
+	}
+	b.Logger().Debug("outstanding tokens drained, deleted role", "role_name", roleName)
+	return nil
+}
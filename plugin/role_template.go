@@ -0,0 +1,181 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// RoleTemplateEntry holds defaults for roles. A role referencing a template takes every field it does not
+// set from the template. Fields left unset in the template have their zero value.
+type RoleTemplateEntry struct {
+	// Version of the stored format, see storageKind
+	Version          int                   `json:"version" structs:"version" mapstructure:"version"`
+	TemplateName     string                `json:"template_name" structs:"template_name" mapstructure:"template_name"`
+	TokenTTL         time.Duration         `json:"token_ttl" structs:"token_ttl" mapstructure:"token_ttl"`
+	MaxTTL           time.Duration         `json:"max_ttl" structs:"max_ttl" mapstructure:"max_ttl"`
+	BaseTokenStorage BaseTokenStorageEntry `json:"base_token_storage" structs:"base_token_storage" mapstructure:"base_token_storage"`
+}
+
+func (tpl *RoleTemplateEntry) retrieve(data *framework.FieldData) {
+	tpl.BaseTokenStorage.retrieve(data)
+	if ttlRaw, ok := data.GetOk("token_ttl"); ok && ttlRaw.(int) >= 0 {
+		tpl.TokenTTL = time.Duration(ttlRaw.(int)) * time.Second
+	}
+	if maxTTLRaw, ok := data.GetOk("max_ttl"); ok && maxTTLRaw.(int) >= 0 {
+		tpl.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
+	}
+}
+
+// assertValid checks the fields set in the template. Whether the roles using it are complete is checked
+// on the roles.
+func (tpl *RoleTemplateEntry) assertValid() error {
+	var err *multierror.Error
+	base := &tpl.BaseTokenStorage
+	if base.ID < 0 {
+		err = multierror.Append(err, errors.New("id is invalid"))
+	}
+	if len(base.Scopes) > 0 {
+		if e := validateScopes(base.Scopes); e != nil {
+			err = multierror.Append(err, e)
+		}
+	}
+	if e := validateTokenType(base.tokenType()); e != nil {
+		err = multierror.Append(err, e)
+	} else if e := validateAccessLevel(base.tokenType(), base.AccessLevel, base.accessLevelInput); e != nil {
+		err = multierror.Append(err, e)
+	}
+	if tpl.MaxTTL > 0 && tpl.TokenTTL > tpl.MaxTTL {
+		err = multierror.Append(err, fmt.Errorf("token_ttl '%v' exceeds the template max_ttl of '%v'", tpl.TokenTTL, tpl.MaxTTL))
+	}
+	return err.ErrorOrNil()
+}
+
+func (tpl *RoleTemplateEntry) save(ctx context.Context, storage logical.Storage) error {
+	tpl.Version = storageRoleTemplate.version()
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", pathPatternRoleTemplates, tpl.TemplateName), tpl)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+// getRoleTemplateEntry fetches a role template from the storage
+func getRoleTemplateEntry(ctx context.Context, storage logical.Storage, templateName string) (*RoleTemplateEntry, error) {
+	var result RoleTemplateEntry
+	if entry, err := storage.Get(ctx, fmt.Sprintf("%s/%s", pathPatternRoleTemplates, templateName)); err != nil {
+		return nil, err
+	} else if entry == nil {
+		return nil, nil
+	} else if _, err := storageRoleTemplate.decode(entry, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func deleteRoleTemplateEntry(ctx context.Context, storage logical.Storage, templateName string) error {
+	return storage.Delete(ctx, fmt.Sprintf("%s/%s", pathPatternRoleTemplates, templateName))
+}
+
+func listRoleTemplateEntries(ctx context.Context, storage logical.Storage) ([]string, error) {
+	return storage.List(ctx, fmt.Sprintf("%s/", pathPatternRoleTemplates))
+}
+
+// withTemplate returns a copy of the role where the fields the role does not set are taken from the
+// template, and the names of those fields
+func (role *RoleStorageEntry) withTemplate(tpl *RoleTemplateEntry) (*RoleStorageEntry, []string) {
+	merged := *role
+	base, tplBase := &merged.BaseTokenStorage, &tpl.BaseTokenStorage
+	var inherited []string
+	if base.ID == 0 && tplBase.ID != 0 {
+		base.ID = tplBase.ID
+		inherited = append(inherited, "id")
+	}
+	if base.Name == "" && tplBase.Name != "" {
+		base.Name = tplBase.Name
+		inherited = append(inherited, "name")
+	}
+	if len(base.Scopes) == 0 && len(tplBase.Scopes) > 0 {
+		base.Scopes = append([]string(nil), tplBase.Scopes...)
+		inherited = append(inherited, "scopes")
+	}
+	if base.AccessLevel == 0 && tplBase.AccessLevel != 0 {
+		base.AccessLevel = tplBase.AccessLevel
+		inherited = append(inherited, "access_level")
+	}
+	if base.TokenType == "" && tplBase.TokenType != "" {
+		base.TokenType = tplBase.TokenType
+		inherited = append(inherited, "token_type")
+	}
+	if merged.TokenTTL == 0 && tpl.TokenTTL != 0 {
+		merged.TokenTTL = tpl.TokenTTL
+		inherited = append(inherited, "token_ttl")
+	}
+	if merged.MaxTTL == 0 && tpl.MaxTTL != 0 {
+		merged.MaxTTL = tpl.MaxTTL
+		inherited = append(inherited, "max_ttl")
+	}
+	// defaults of fields neither the role nor the template set
+	base.TokenType = base.tokenType()
+	if merged.TokenTTL == 0 {
+		merged.TokenTTL = time.Duration(roleSchema["token_ttl"].Default.(int)) * time.Second
+	}
+	return &merged, inherited
+}
+
+// effectiveRole returns the role with its template applied, and the names of the fields taken from the
+// template. A role without template is returned as is.
+func effectiveRole(ctx context.Context, storage logical.Storage, role *RoleStorageEntry) (*RoleStorageEntry, []string, error) {
+	if role.Template == "" {
+		return role, nil, nil
+	}
+	tpl, err := getRoleTemplateEntry(ctx, storage, role.Template)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tpl == nil {
+		return nil, nil, fmt.Errorf("role template '%s' does not exist", role.Template)
+	}
+	merged, inherited := role.withTemplate(tpl)
+	return merged, inherited, nil
+}
+
+// rolesUsingTemplate returns the roles referencing a template
+func rolesUsingTemplate(ctx context.Context, storage logical.Storage, templateName string) ([]*RoleStorageEntry, error) {
+	roleNames, err := listRoleEntries(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	var roles []*RoleStorageEntry
+	for _, roleName := range roleNames {
+		role, err := getRoleEntry(ctx, storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil && role.Template == templateName {
+			roles = append(roles, role)
+		}
+	}
+	return roles, nil
+}
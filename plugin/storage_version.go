@@ -0,0 +1,216 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// storageMigration upgrades the raw JSON of a stored entry by one version
+type storageMigration func(raw map[string]interface{}) error
+
+// storageKind is a kind of entry stored by the backend. Every entry carries the version of its format in
+// a "version" field. Entries written before versioning have none and are version 0.
+type storageKind struct {
+	name string
+	// key is the storage key of a single entry, or the prefix of all entries when it ends with a slash
+	key string
+	// local kinds are not replicated, and are migrated on performance secondaries
+	local bool
+	// first is the version of the first format of the kind. Kinds stored before versioning start at 0,
+	// later kinds at 1.
+	first int
+	// migrations[i] upgrades an entry from version first+i to version first+i+1
+	migrations []storageMigration
+}
+
+var (
+	storageConfig       = &storageKind{name: "config", key: pathPatternConfig, migrations: []storageMigration{stampVersion}}
+	storageRole         = &storageKind{name: "role", key: pathPatternRoles + "/", migrations: []storageMigration{renameBaseTokenStorage}}
+	storageRoleTemplate = &storageKind{name: "role template", key: pathPatternRoleTemplates + "/", first: 1}
+	storageToken        = &storageKind{name: "token", key: pathPatternTokens + "/", local: true, first: 1}
+	storageRoleUsage    = &storageKind{name: "role usage", key: pathPatternRoleUsage + "/", local: true, first: 1}
+	storageTokenCache   = &storageKind{name: "cached token", key: pathPatternTokenCache + "/", local: true, first: 1}
+
+	// storageKinds lists the kinds in the order they are migrated. The entries indexing tokens by role are
+	// empty and have no version.
+	storageKinds = []*storageKind{storageConfig, storageRoleTemplate, storageRole, storageToken, storageRoleUsage, storageTokenCache}
+)
+
+// version is the current version of the format of the kind
+func (kind *storageKind) version() int {
+	return kind.first + len(kind.migrations)
+}
+
+// stampVersion is the migration of formats that did not change when versioning was introduced
+func stampVersion(raw map[string]interface{}) error {
+	return nil
+}
+
+// renameBaseTokenStorage moves the token parameters of roles, stored under the Go field name, to a snake
+// case key like every other field
+func renameBaseTokenStorage(raw map[string]interface{}) error {
+	if base, ok := raw["BaseTokenStorage"]; ok {
+		raw["base_token_storage"] = base
+		delete(raw, "BaseTokenStorage")
+	}
+	return nil
+}
+
+// decode decodes a stored entry into out, upgrading it to the current version first. It reports whether
+// the entry was upgraded and so should be written back. Entries of a newer version than this backend
+// supports are refused rather than decoded with fields missing.
+func (kind *storageKind) decode(entry *logical.StorageEntry, out interface{}) (bool, error) {
+	var raw map[string]interface{}
+	if err := jsonutil.DecodeJSON(entry.Value, &raw); err != nil {
+		return false, err
+	}
+
+	version := 0
+	if v, ok := raw["version"]; ok {
+		n, ok := v.(json.Number)
+		if !ok {
+			return false, fmt.Errorf("%s entry %q has an invalid version %v", kind.name, entry.Key, v)
+		}
+		parsed, err := n.Int64()
+		if err != nil {
+			return false, fmt.Errorf("%s entry %q has an invalid version %v", kind.name, entry.Key, v)
+		}
+		version = int(parsed)
+	}
+	if version > kind.version() {
+		return false, fmt.Errorf("%s entry %q has version %d, newer than version %d supported by this plugin", kind.name, entry.Key, version, kind.version())
+	}
+	if version < kind.first {
+		return false, fmt.Errorf("%s entry %q has version %d, but the format starts at version %d", kind.name, entry.Key, version, kind.first)
+	}
+
+	for v := version; v < kind.version(); v++ {
+		if err := kind.migrations[v-kind.first](raw); err != nil {
+			return false, fmt.Errorf("failed to upgrade %s entry %q to version %d: %w", kind.name, entry.Key, v+1, err)
+		}
+	}
+	raw["version"] = kind.version()
+
+	upgraded, err := json.Marshal(raw)
+	if err != nil {
+		return false, err
+	}
+	if err := jsonutil.DecodeJSON(upgraded, out); err != nil {
+		return false, err
+	}
+	return version < kind.version(), nil
+}
+
+// migrate upgrades every stored entry of the kind to the current version
+func (kind *storageKind) migrate(ctx context.Context, storage logical.Storage, lockFor func(key string) func()) (int, error) {
+	keys := []string{kind.key}
+	if strings.HasSuffix(kind.key, "/") {
+		var err error
+		if keys, err = logical.CollectKeysWithPrefix(ctx, storage, kind.key); err != nil {
+			return 0, err
+		}
+	}
+
+	migrated := 0
+	for _, key := range keys {
+		upgraded, err := kind.migrateEntry(ctx, storage, key, lockFor)
+		if err != nil {
+			return migrated, err
+		}
+		if upgraded {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+func (kind *storageKind) migrateEntry(ctx context.Context, storage logical.Storage, key string, lockFor func(key string) func()) (bool, error) {
+	if lockFor != nil {
+		defer lockFor(key)()
+	}
+
+	entry, err := storage.Get(ctx, key)
+	if err != nil || entry == nil {
+		return false, err
+	}
+	var raw map[string]interface{}
+	upgraded, err := kind.decode(entry, &raw)
+	if err != nil || !upgraded {
+		return false, err
+	}
+
+	entry, err = logical.StorageEntryJSON(key, raw)
+	if err != nil {
+		return false, err
+	}
+	return true, storage.Put(ctx, entry)
+}
+
+// initialize upgrades all stored entries to the current version of their format when the mount is set
+// up. Entries are also upgraded in memory when read, so a node that cannot write its storage still reads
+// entries of older versions.
+func (b *GitlabBackend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+	secondary := replicationState.HasState(consts.ReplicationPerformanceSecondary)
+
+	for _, kind := range storageKinds {
+		if secondary && !kind.local {
+			continue
+		}
+		migrated, err := kind.migrate(ctx, req.Storage, b.storageLockFor(kind))
+		if err != nil {
+			return fmt.Errorf("failed to upgrade stored %s entries: %w", kind.name, err)
+		}
+		if migrated > 0 {
+			b.Logger().Info("upgraded stored entries", "kind", kind.name, "count", migrated, "version", kind.version())
+		}
+	}
+	if err := b.indexTokenInventory(ctx, req.Storage); err != nil {
+		return fmt.Errorf("failed to index tokens by role: %w", err)
+	}
+	return nil
+}
+
+// storageLockFor returns the function locking an entry of the kind while it is upgraded, the same way it
+// is locked while it is written by requests
+func (b *GitlabBackend) storageLockFor(kind *storageKind) func(key string) func() {
+	switch kind {
+	case storageRole, storageRoleUsage, storageTokenCache:
+		return func(key string) func() {
+			roleName := strings.SplitN(strings.TrimPrefix(key, kind.key), "/", 2)[0]
+			lock := b.roleLock(roleName)
+			lock.Lock()
+			return lock.Unlock
+		}
+	case storageRoleTemplate:
+		return func(string) func() {
+			b.templateLock.Lock()
+			return b.templateLock.Unlock
+		}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storageFixtures maps the fixtures of entries written before storage versioning to their storage key
+var storageFixtures = map[string]string{
+	"config-original.json": "config",
+	"role-original.json":   "roles/legacy",
+}
+
+// putStorageFixture writes a fixture from testdata/storage to its storage key
+func putStorageFixture(t *testing.T, storage logical.Storage, version, name string) {
+	t.Helper()
+	value, err := os.ReadFile(filepath.Join("testdata", "storage", version, name))
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(context.Background(), &logical.StorageEntry{Key: storageFixtures[name], Value: value}))
+}
+
+func TestStorageFixturesV0(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	read := map[string]func(storage logical.Storage) (interface{}, error){
+		"config-original.json": func(storage logical.Storage) (interface{}, error) {
+			return getConfig(ctx, storage)
+		},
+		"role-original.json": func(storage logical.Storage) (interface{}, error) {
+			return getRoleEntry(ctx, storage, "legacy")
+		},
+	}
+	expected := map[string]interface{}{
+		"config-original.json": &ConfigStorageEntry{
+			Version: 1,
+			BaseURL: "https://gitlab.example.com",
+			Token:   "glpat-backend",
+		},
+		"role-original.json": &RoleStorageEntry{
+			Version:  1,
+			RoleName: "legacy",
+			TokenTTL: 24 * time.Hour,
+			BaseTokenStorage: BaseTokenStorageEntry{
+				ID:     7,
+				Name:   "legacy-token",
+				Scopes: []string{"api"},
+			},
+		},
+	}
+
+	for name := range storageFixtures {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			backend, storage := getTestBackend(t, true)
+			putStorageFixture(t, storage, "v0", name)
+
+			got, err := read[name](storage)
+			require.NoError(t, err)
+			assert.Equal(t, expected[name], got, "upgraded on read")
+
+			require.NoError(t, backend.Initialize(ctx, &logical.InitializationRequest{Storage: storage}))
+			entry, err := storage.Get(ctx, storageFixtures[name])
+			require.NoError(t, err)
+			var raw map[string]interface{}
+			require.NoError(t, json.Unmarshal(entry.Value, &raw))
+			assert.Equal(t, float64(1), raw["version"], "written back by initialize")
+			assert.NotContains(t, raw, "BaseTokenStorage")
+
+			got, err = read[name](storage)
+			require.NoError(t, err)
+			assert.Equal(t, expected[name], got, "unchanged by initialize")
+		})
+	}
+}
+
+func TestStorageFixtureRoleIssuesTokens(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	putStorageFixture(t, storage, "v0", "config-original.json")
+	putStorageFixture(t, storage, "v0", "role-original.json")
+
+	resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage}, "legacy", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+	assert.Equal(t, "legacy-token", resp.Data["name"])
+	assert.Equal(t, []string{"api"}, resp.Data["scopes"])
+}
+
+func TestStorageVersionTooNew(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	_, storage := getTestBackend(t, true)
+	require.NoError(t, storage.Put(ctx, &logical.StorageEntry{
+		Key:   "roles/future",
+		Value: []byte(`{"version":99,"role_name":"future"}`),
+	}))
+
+	_, err := getRoleEntry(ctx, storage, "future")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "newer than version 1 supported by this plugin")
+}
+
+func TestStorageVersionMissing(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	_, storage := getTestBackend(t, true)
+	require.NoError(t, storage.Put(ctx, &logical.StorageEntry{
+		Key:   "tokens/42",
+		Value: []byte(`{"token_id":42}`),
+	}))
+
+	_, err := getTokenInventoryEntry(ctx, storage, 42)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has version 0, but the format starts at version 1")
+}
+
+func TestStorageInitializeReadOnly(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.System = &logical.StaticSystemView{ReplicationStateVal: consts.ReplicationPerformanceSecondary}
+	backend, err := Factory(ctx, config)
+	require.NoError(t, err)
+	putStorageFixture(t, config.StorageView, "v0", "role-original.json")
+
+	require.NoError(t, backend.Initialize(ctx, &logical.InitializationRequest{Storage: config.StorageView}))
+
+	entry, err := config.StorageView.Get(ctx, "roles/legacy")
+	require.NoError(t, err)
+	assert.Contains(t, string(entry.Value), `"BaseTokenStorage"`, "replicated entries are left to the primary")
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+var errSudoBothSources = errors.New("sudo_metadata_key and sudo_alias_mount_accessor are mutually exclusive")
+
+// impersonates reports whether tokens of the role are created as the Gitlab user of the requesting entity
+func (role *RoleStorageEntry) impersonates() bool {
+	return role.SudoMetadataKey != "" || role.SudoAliasMountAccessor != ""
+}
+
+// sudoUser returns the Gitlab username the requesting entity maps to under the role: the value of the
+// entity metadata key, or the name of the entity's alias on the auth mount. Requests that cannot be
+// mapped are refused rather than made as the backend identity.
+func (b *GitlabBackend) sudoUser(req *logical.Request, role *RoleStorageEntry) (string, error) {
+	if req.EntityID == "" {
+		return "", fmt.Errorf("role '%s' creates tokens as the Gitlab user of the requesting entity, and the request has no entity", role.RoleName)
+	}
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up entity %s: %w", req.EntityID, err)
+	}
+	if entity == nil {
+		return "", fmt.Errorf("entity %s does not exist", req.EntityID)
+	}
+
+	if role.SudoMetadataKey != "" {
+		if username := entity.Metadata[role.SudoMetadataKey]; username != "" {
+			return username, nil
+		}
+		return "", fmt.Errorf("entity %s has no '%s' metadata naming its Gitlab user", req.EntityID, role.SudoMetadataKey)
+	}
+	for _, alias := range entity.Aliases {
+		if alias.MountAccessor == role.SudoAliasMountAccessor {
+			return alias.Name, nil
+		}
+	}
+	return "", fmt.Errorf("entity %s has no alias on auth mount %s naming its Gitlab user", req.EntityID, role.SudoAliasMountAccessor)
+}
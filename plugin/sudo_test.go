@@ -0,0 +1,179 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOIDCAccessor = "auth_oidc_1234"
+
+// entitySystemView returns the entities of its map by ID
+type entitySystemView struct {
+	logical.StaticSystemView
+	entities map[string]*logical.Entity
+}
+
+func (v *entitySystemView) EntityInfo(entityID string) (*logical.Entity, error) {
+	return v.entities[entityID], nil
+}
+
+// newSudoEnv returns a backend talking to a fake Gitlab with users alice, a Maintainer of project 1, and
+// bob, a Reporter, and Vault entities mapping to them: alice through an alias, bob through metadata
+func newSudoEnv(t *testing.T) (logical.Backend, logical.Storage, *fakeGitlab, map[string]*fakeGitlabUser) {
+	t.Helper()
+
+	fg := newFakeGitlab(t)
+	users := map[string]*fakeGitlabUser{"alice": fg.addUser("alice"), "bob": fg.addUser("bob")}
+	fg.addTarget(tokenTypeProject, 1, "team/app", map[int]int{
+		users["alice"].ID: accessLevelMaintainer,
+		users["bob"].ID:   accessLevelReporter,
+	})
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.System = &entitySystemView{entities: map[string]*logical.Entity{
+		"entity-alice": {ID: "entity-alice", Aliases: []*logical.Alias{
+			{MountAccessor: "auth_userpass_5678", Name: "alice.smith"},
+			{MountAccessor: testOIDCAccessor, Name: "alice"},
+		}},
+		"entity-bob": {ID: "entity-bob", Metadata: map[string]string{"gitlab_user": "bob"}},
+	}}
+	backend, err := Factory(context.Background(), config)
+	require.NoError(t, err)
+	testConfigUpdate(t, backend, config.StorageView, fg.config())
+	return backend, config.StorageView, fg, users
+}
+
+func TestRoleSudo(t *testing.T) {
+	t.Parallel()
+
+	backend, storage, fg, users := newSudoEnv(t)
+	fg.setBackendAdmin(true)
+	mustRoleCreate(t, backend, storage, "metadata", map[string]interface{}{
+		"id":                1,
+		"name":              "app-ci",
+		"scopes":            "read_api",
+		"access_level":      "developer",
+		"sudo_metadata_key": "gitlab_user",
+		"verify":            true,
+	})
+	mustRoleCreate(t, backend, storage, "alias", map[string]interface{}{
+		"id":                        1,
+		"name":                      "app-ci",
+		"scopes":                    "read_api",
+		"access_level":              "reporter",
+		"sudo_alias_mount_accessor": testOIDCAccessor,
+	})
+
+	issue := func(roleName, entityID string) (*logical.Response, error) {
+		t.Helper()
+		return testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: entityID}, roleName, nil)
+	}
+
+	t.Run("tokens are created as the user of the entity metadata", func(t *testing.T) {
+		fg.addProject(2, "team/docs", accessLevelMaintainer)
+		fg.lock.Lock()
+		fg.targets[fakeTargetKey(tokenTypeProject, 2)].Members[users["bob"].ID] = accessLevelMaintainer
+		fg.lock.Unlock()
+		mustRoleCreate(t, backend, storage, "docs", map[string]interface{}{
+			"id":                2,
+			"name":              "docs-ci",
+			"scopes":            "read_api",
+			"sudo_metadata_key": "gitlab_user",
+		})
+
+		resp, err := issue("docs", "entity-bob")
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		token, ok := fg.token(resp.Data["id"].(int))
+		require.True(t, ok)
+		assert.Equal(t, users["bob"].ID, token.CreatedBy)
+	})
+
+	t.Run("tokens are limited by the permissions of the user", func(t *testing.T) {
+		// bob is only a Reporter of project 1, and Gitlab requires Maintainer to create access tokens
+		resp, err := issue("metadata", "entity-bob")
+		assert.Equal(t, http.StatusForbidden, responseStatus(resp, err))
+		assert.Empty(t, fg.activeTokens(tokenTypeProject, 1))
+	})
+
+	t.Run("tokens are created as the user of the entity alias", func(t *testing.T) {
+		resp, err := issue("alias", "entity-alice")
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		token, ok := fg.token(resp.Data["id"].(int))
+		require.True(t, ok)
+		assert.Equal(t, users["alice"].ID, token.CreatedBy)
+	})
+
+	t.Run("requests that do not map to a user are refused", func(t *testing.T) {
+		for _, c := range []struct{ role, entity, message string }{
+			{"metadata", "", "the request has no entity"},
+			{"metadata", "entity-alice", "has no 'gitlab_user' metadata"},
+			{"alias", "entity-bob", "has no alias on auth mount " + testOIDCAccessor},
+			{"metadata", "entity-unknown", "does not exist"},
+		} {
+			resp, err := issue(c.role, c.entity)
+			require.NoError(t, err)
+			require.True(t, resp.IsError(), "%s for %q", c.role, c.entity)
+			assert.Contains(t, resp.Error().Error(), c.message)
+		}
+	})
+
+	t.Run("roles set a single source", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, storage, "both", map[string]interface{}{
+			"id":                        1,
+			"name":                      "app-ci",
+			"scopes":                    "read_api",
+			"sudo_metadata_key":         "gitlab_user",
+			"sudo_alias_mount_accessor": testOIDCAccessor,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), errSudoBothSources.Error())
+	})
+}
+
+func TestRoleSudoRequiresAdmin(t *testing.T) {
+	t.Parallel()
+
+	backend, storage, fg, _ := newSudoEnv(t)
+	fg.addProject(2, "team/backend", accessLevelMaintainer)
+	data := map[string]interface{}{
+		"id":                2,
+		"name":              "app-ci",
+		"scopes":            "read_api",
+		"sudo_metadata_key": "gitlab_user",
+		"verify":            true,
+	}
+
+	resp, err := testRoleCreate(t, backend, storage, "app", data)
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), "backend token is not an administrator")
+
+	delete(data, "verify")
+	mustRoleCreate(t, backend, storage, "app", data)
+	resp, err = testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: "entity-bob"}, "app", nil)
+	assert.Equal(t, http.StatusForbidden, responseStatus(resp, err))
+	assert.Empty(t, fg.activeTokens(tokenTypeProject, 2))
+}
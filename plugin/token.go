@@ -36,45 +36,91 @@ type BaseTokenStorageEntry struct {
 	Name        string   `json:"name" structs:"name" mapstructure:"name"`
 	Scopes      []string `json:"scopes" structs:"scopes" mapstructure:"scopes"`
 	AccessLevel int      `json:"access_level" structs:"access_level" mapstructure:"access_level,omitempty"`
+	// Whether ID refers to a project or a group. Empty means project.
+	TokenType string `json:"token_type,omitempty" structs:"token_type" mapstructure:"token_type,omitempty"`
+	// The access_level as given to retrieve, so that an invalid one can be echoed back
+	accessLevelInput string
 }
 
-func (tokenStorage *TokenStorageEntry) assertValid(maxTTL time.Duration) error {
+// tokenType returns the type of token to create, defaulting to a project access token
+func (baseTokenStorage *BaseTokenStorageEntry) tokenType() string {
+	if baseTokenStorage.TokenType == "" {
+		return tokenTypeProject
+	}
+	return baseTokenStorage.TokenType
+}
+
+// target returns the Gitlab resource a token is created on
+func (baseTokenStorage *BaseTokenStorageEntry) target() apiTarget {
+	return apiTarget{
+		Type:        baseTokenStorage.tokenType(),
+		ID:          baseTokenStorage.ID,
+		AccessLevel: baseTokenStorage.AccessLevel,
+	}
+}
+
+func (tokenStorage *TokenStorageEntry) assertValid() error {
 	var err *multierror.Error
 	if e := tokenStorage.BaseTokenStorage.assertValid(); e != nil {
 		err = multierror.Append(err, e)
 	}
 
-	if maxTTL > time.Duration(0) && tokenStorage.ExpiresAt != nil {
-		maxExpiresAt := time.Now().UTC().Add(maxTTL)
-		if maxExpiresAt.Before(*tokenStorage.ExpiresAt) {
-			errMsg := fmt.Sprintf("Requested expires_at '%v' exceeds configured maximum ttl of '%v's. Expires at or before '%v'",
-				*tokenStorage.ExpiresAt, int64(maxTTL/time.Second), maxExpiresAt)
-			err = multierror.Append(err, errors.New(errMsg))
-		}
+	if tokenStorage.ExpiresAt != nil && !tokenStorage.ExpiresAt.After(time.Now()) {
+		err = multierror.Append(err, fmt.Errorf("expires_at '%v' is in the past", *tokenStorage.ExpiresAt))
 	}
 
 	return err.ErrorOrNil()
 }
 
+// resolveExpiresAt runs the requested expires_at through the TTL resolution of the mount config and
+// updates it with the result
+func (tokenStorage *TokenStorageEntry) resolveExpiresAt(config *ConfigStorageEntry) ([]string, error) {
+	now := time.Now().UTC()
+	limits := config.ttlLimits()
+	if tokenStorage.ExpiresAt != nil {
+		limits.Requested = tokenStorage.ExpiresAt.Sub(now)
+	}
+
+	ttl, warnings, err := limits.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		tokenStorage.ExpiresAt = &expiresAt
+	}
+	return warnings, nil
+}
+
 func (baseTokenStorage *BaseTokenStorageEntry) assertValid() error {
+	return baseTokenStorage.assertValidTemplated(false, false)
+}
+
+// assertValidTemplated checks the token parameters, except the ID and the scopes when they are resolved
+// from identity templates when a token is issued
+func (baseTokenStorage *BaseTokenStorageEntry) assertValidTemplated(templatedID, templatedScopes bool) error {
 	var err *multierror.Error
-	if baseTokenStorage.ID <= 0 {
+	if baseTokenStorage.ID <= 0 && !templatedID {
 		err = multierror.Append(err, errors.New("id is empty or invalid"))
 	}
 	if baseTokenStorage.Name == "" {
 		err = multierror.Append(err, errors.New("name is empty"))
 	}
-	if len(baseTokenStorage.Scopes) == 0 {
+	switch {
+	case templatedScopes:
+	case len(baseTokenStorage.Scopes) == 0:
 		err = multierror.Append(err, errors.New("scopes are empty"))
-	} else if e := validateScopes(baseTokenStorage.Scopes); e != nil {
-		err = multierror.Append(err, e)
+	default:
+		if e := validateScopes(baseTokenStorage.Scopes); e != nil {
+			err = multierror.Append(err, e)
+		}
 	}
 
-	// check validity of access level. allowed values are 0(zero value), 10, 20, 30 and 40
-	if d := baseTokenStorage.AccessLevel / 10; d > 4 || d < 0 {
-		err = multierror.Append(err, errInvalidAccessLevel)
-	} else if baseTokenStorage.AccessLevel%10 != 0 {
-		err = multierror.Append(err, errInvalidAccessLevel)
+	if e := validateTokenType(baseTokenStorage.tokenType()); e != nil {
+		err = multierror.Append(err, e)
+	} else if e := validateAccessLevel(baseTokenStorage.tokenType(), baseTokenStorage.AccessLevel, baseTokenStorage.accessLevelInput); e != nil {
+		// 0(zero value) lets Gitlab pick the default access level
+		err = multierror.Append(err, e)
 	}
 
 	return err.ErrorOrNil()
@@ -99,6 +145,19 @@ func (baseTokenStorage *BaseTokenStorageEntry) retrieve(data *framework.FieldDat
 		baseTokenStorage.Scopes = scopesRaw.([]string)
 	}
 	if accessLevelRaw, ok := data.GetOk("access_level"); ok {
-		baseTokenStorage.AccessLevel = accessLevelRaw.(int)
+		// an unparsable level is kept as accessLevelInvalid and reported by assertValid
+		baseTokenStorage.accessLevelInput = accessLevelRaw.(string)
+		baseTokenStorage.AccessLevel, _ = parseAccessLevel(baseTokenStorage.accessLevelInput)
+	}
+	if tokenTypeRaw, ok := data.GetOk("token_type"); ok {
+		baseTokenStorage.TokenType = tokenTypeRaw.(string)
+	}
+}
+
+// createAccessToken creates a project or group access token depending on the token type
+func createAccessToken(gc Client, baseTokenStorage *BaseTokenStorageEntry, expiresAt *time.Time) (*PAT, error) {
+	if baseTokenStorage.tokenType() == tokenTypeGroup {
+		return gc.CreateGroupAccessToken(baseTokenStorage, expiresAt)
 	}
+	return gc.CreateProjectAccessToken(baseTokenStorage, expiresAt)
 }
@@ -0,0 +1,165 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	pathPatternTokenCache = "token-cache"
+
+	defaultReuseMinRemaining = time.Hour
+)
+
+// cachedToken is a token kept for reuse by the same role and entity. It holds the token value, so the
+// token cache is seal wrapped.
+type cachedToken struct {
+	// Version of the stored format, see storageKind
+	Version int  `json:"version"`
+	TokenID int  `json:"token_id"`
+	PAT     *PAT `json:"pat"`
+	// Base is the effective role token parameters the token was issued for. The token is not reused once
+	// they change.
+	Base      BaseTokenStorageEntry `json:"base"`
+	ExpiresAt *time.Time            `json:"expires_at,omitempty"`
+	// SudoUser is the Gitlab user the token was created as, if the role impersonates users
+	SudoUser string `json:"sudo_user,omitempty"`
+	// Username is the bot user of the token, once it has been looked up for a credential format
+	Username string `json:"username,omitempty"`
+	// Consumers is the number of requests the token was returned to, including the one that created it
+	Consumers int `json:"consumers"`
+}
+
+func tokenCachePath(roleName, entityID string) string {
+	return fmt.Sprintf("%s/%s/%s", pathPatternTokenCache, roleName, entityID)
+}
+
+// getCachedToken returns the cached token of a role and entity, or nil if there is none
+func getCachedToken(ctx context.Context, storage logical.Storage, roleName, entityID string) (*cachedToken, error) {
+	entry, err := storage.Get(ctx, tokenCachePath(roleName, entityID))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var cached cachedToken
+	if _, err := storageTokenCache.decode(entry, &cached); err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+func (cached *cachedToken) save(ctx context.Context, storage logical.Storage, roleName, entityID string) error {
+	cached.Version = storageTokenCache.version()
+	entry, err := logical.StorageEntryJSON(tokenCachePath(roleName, entityID), cached)
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, entry)
+}
+
+// deleteCachedTokens removes the cached tokens of a role
+func deleteCachedTokens(ctx context.Context, storage logical.Storage, roleName string) error {
+	prefix := fmt.Sprintf("%s/%s/", pathPatternTokenCache, roleName)
+	entityIDs, err := storage.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, entityID := range entityIDs {
+		if err := storage.Delete(ctx, prefix+entityID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneTokenCache removes the cached tokens that have expired or are no longer active in the inventory
+func (b *GitlabBackend) pruneTokenCache(ctx context.Context, storage logical.Storage) error {
+	roles, err := storage.List(ctx, pathPatternTokenCache+"/")
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if err := b.pruneRoleTokenCache(ctx, storage, strings.TrimSuffix(role, "/")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *GitlabBackend) pruneRoleTokenCache(ctx context.Context, storage logical.Storage, roleName string) error {
+	lock := b.roleLock(roleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entityIDs, err := storage.List(ctx, fmt.Sprintf("%s/%s/", pathPatternTokenCache, roleName))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, entityID := range entityIDs {
+		cached, err := getCachedToken(ctx, storage, roleName, entityID)
+		if err != nil {
+			return err
+		}
+		if cached != nil && (cached.ExpiresAt == nil || now.Before(*cached.ExpiresAt)) {
+			inventory, err := getTokenInventoryEntry(ctx, storage, cached.TokenID)
+			if err != nil {
+				return err
+			}
+			if inventory != nil && inventory.status(now) == tokenStatusActive {
+				continue
+			}
+		}
+		if err := storage.Delete(ctx, tokenCachePath(roleName, entityID)); err != nil {
+			return err
+		}
+		b.Logger().Debug("pruned cached token", "role_name", roleName, "entity_id", entityID)
+	}
+	return nil
+}
+
+// reusable reports whether the cached token can be returned for another request of role at now, made as
+// the Gitlab user sudoUser
+func (cached *cachedToken) reusable(ctx context.Context, storage logical.Storage, role *RoleStorageEntry, sudoUser string, now time.Time) (bool, error) {
+	if !reflect.DeepEqual(cached.Base, role.BaseTokenStorage) || cached.SudoUser != sudoUser {
+		return false, nil
+	}
+	if role.ReuseMaxConsumers > 0 && cached.Consumers >= role.ReuseMaxConsumers {
+		return false, nil
+	}
+	if cached.ExpiresAt != nil && cached.ExpiresAt.Sub(now) < role.reuseMinRemaining() {
+		return false, nil
+	}
+	// a token revoked through Vault is marked in the inventory
+	inventory, err := getTokenInventoryEntry(ctx, storage, cached.TokenID)
+	if err != nil {
+		return false, err
+	}
+	return inventory != nil && inventory.status(now) == tokenStatusActive, nil
+}
+
+// reuseMinRemaining returns the minimum remaining lifetime of a token for it to be reused
+func (role *RoleStorageEntry) reuseMinRemaining() time.Duration {
+	if role.ReuseMinRemaining > 0 {
+		return role.ReuseMinRemaining
+	}
+	return defaultReuseMinRemaining
+}
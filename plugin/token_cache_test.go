@@ -0,0 +1,193 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenCacheStorage(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	_, storage := getTestBackend(t, true)
+	cached := &cachedToken{TokenID: 7, PAT: &PAT{ID: 7, Token: "glpat-cached-secret"}, Consumers: 1}
+	require.NoError(t, cached.save(ctx, storage, "role", "entity"))
+
+	got, err := getCachedToken(ctx, storage, "role", "entity")
+	require.NoError(t, err)
+	assert.Equal(t, cached, got)
+
+	got, err = getCachedToken(ctx, storage, "role", "missing")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestPruneTokenCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	backend, storage := getTestBackend(t, true)
+	b := backend.(*GitlabBackend)
+
+	now := time.Now().UTC()
+	expired := now.Add(-time.Minute)
+	live := now.Add(time.Hour)
+	for _, entry := range []*TokenInventoryEntry{
+		{TokenID: 1, ExpiresAt: &live, RoleName: "ci"},
+		{TokenID: 2, ExpiresAt: &expired, RoleName: "ci"},
+		{TokenID: 3, ExpiresAt: &live, RoleName: "ci", Revoked: true, RevokedAt: &now},
+	} {
+		require.NoError(t, entry.save(ctx, storage))
+	}
+	for entityID, cached := range map[string]*cachedToken{
+		"live":    {TokenID: 1, PAT: &PAT{ID: 1}, ExpiresAt: &live},
+		"expired": {TokenID: 2, PAT: &PAT{ID: 2}, ExpiresAt: &expired},
+		"revoked": {TokenID: 3, PAT: &PAT{ID: 3}, ExpiresAt: &live},
+		"missing": {TokenID: 4, PAT: &PAT{ID: 4}, ExpiresAt: &live},
+	} {
+		require.NoError(t, cached.save(ctx, storage, "ci", entityID))
+	}
+
+	require.NoError(t, b.pruneTokenCache(ctx, storage))
+
+	keys, err := storage.List(ctx, pathPatternTokenCache+"/ci/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"live"}, keys)
+}
+
+func TestRoleTokenReuse(t *testing.T) {
+	t.Parallel()
+
+	backend, storage := getTestBackend(t, true)
+	testConfigUpdate(t, backend, storage, map[string]interface{}{
+		"base_url": "http://randomhost",
+		"token":    "gibberish",
+	})
+	mustRoleCreate(t, backend, storage, "reuse", map[string]interface{}{
+		"id":                  1,
+		"name":                "reuse",
+		"scopes":              "read_api",
+		"reuse_tokens":        true,
+		"reuse_max_consumers": 3,
+	})
+	issue := func(entityID string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: entityID}, "reuse", data)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		return resp
+	}
+
+	first := issue("entity-1", nil)
+	assert.Equal(t, false, first.Data["reused"])
+	tokenID := first.Data["id"]
+
+	t.Run("same entity reuses the token up to the consumer limit", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			resp := issue("entity-1", nil)
+			assert.Equal(t, true, resp.Data["reused"])
+			assert.Equal(t, tokenID, resp.Data["id"])
+			assert.Equal(t, first.Data["token"], resp.Data["token"])
+		}
+		resp := issue("entity-1", nil)
+		assert.Equal(t, false, resp.Data["reused"])
+		assert.NotEqual(t, tokenID, resp.Data["id"])
+		tokenID = resp.Data["id"]
+	})
+
+	t.Run("other entities get their own token", func(t *testing.T) {
+		resp := issue("entity-2", nil)
+		assert.Equal(t, false, resp.Data["reused"])
+		assert.NotEqual(t, tokenID, resp.Data["id"])
+
+		resp = issue("", nil)
+		assert.NotContains(t, resp.Data, "reused", "requests without entity are not cached")
+	})
+
+	t.Run("requests with a ttl get a new token", func(t *testing.T) {
+		resp := issue("entity-1", map[string]interface{}{"ttl": "2h"})
+		assert.NotEqual(t, tokenID, resp.Data["id"])
+	})
+
+	t.Run("revoked tokens are not reused", func(t *testing.T) {
+		resp, err := backend.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "revoke/entity/entity-1",
+			Storage:   storage,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		resp = issue("entity-1", nil)
+		assert.Equal(t, false, resp.Data["reused"])
+		tokenID = resp.Data["id"]
+	})
+
+	t.Run("role changes invalidate cached tokens", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, storage, "reuse", map[string]interface{}{"scopes": "read_api,read_repository"})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		resp = issue("entity-1", nil)
+		assert.Equal(t, false, resp.Data["reused"])
+		assert.Equal(t, []string{"read_api", "read_repository"}, resp.Data["scopes"])
+	})
+
+	t.Run("tokens close to expiry are not reused", func(t *testing.T) {
+		ctx := context.Background()
+		role, err := getRoleEntry(ctx, storage, "reuse")
+		require.NoError(t, err)
+		cached, err := getCachedToken(ctx, storage, "reuse", "entity-1")
+		require.NoError(t, err)
+		require.NotNil(t, cached.ExpiresAt)
+
+		ok, err := cached.reusable(ctx, storage, role, "", cached.ExpiresAt.Add(-2*time.Hour))
+		require.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = cached.reusable(ctx, storage, role, "", cached.ExpiresAt.Add(-30*time.Minute))
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("min remaining must be below token ttl", func(t *testing.T) {
+		resp, err := testRoleCreate(t, backend, storage, "never-reused", map[string]interface{}{
+			"id": 1, "name": "reuse", "scopes": "read_api", "reuse_tokens": true, "token_ttl": "1h",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "tokens are never reused")
+	})
+
+	t.Run("cached tokens are deleted with the role", func(t *testing.T) {
+		resp, err := testRoleDelete(t, backend, storage, "reuse")
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		resp, err = testRevoke(t, backend, storage, "role/reuse", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.NoError(t, backend.(*GitlabBackend).finalizeDeletingRoles(context.Background(), storage))
+
+		keys, err := storage.List(context.Background(), pathPatternTokenCache+"/reuse/")
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+}
@@ -0,0 +1,290 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// pathPatternTokensByRole indexes the inventory entries by role, so that the tokens of a role are found
+	// without reading the whole inventory. Index entries are empty.
+	pathPatternTokensByRole = "tokens-by-role"
+
+	defaultInventoryRetention = 30 * 24 * time.Hour
+	inventoryPruneInterval    = time.Hour
+
+	tokenStatusActive  = "active"
+	tokenStatusExpired = "expired"
+	tokenStatusRevoked = "revoked"
+)
+
+// TokenInventoryEntry is the record of a token issued by this mount. The token value itself is never stored.
+// ProjectID holds the group ID for group access tokens.
+type TokenInventoryEntry struct {
+	// Version of the stored format, see storageKind
+	Version     int        `json:"version" structs:"version" mapstructure:"version"`
+	TokenID     int        `json:"token_id" structs:"token_id" mapstructure:"token_id"`
+	ProjectID   int        `json:"project_id" structs:"project_id" mapstructure:"project_id"`
+	Name        string     `json:"name" structs:"name" mapstructure:"name"`
+	Scopes      []string   `json:"scopes" structs:"scopes" mapstructure:"scopes"`
+	AccessLevel int        `json:"access_level" structs:"access_level" mapstructure:"access_level"`
+	TokenType   string     `json:"token_type" structs:"token_type" mapstructure:"token_type"`
+	ExpiresAt   *time.Time `json:"expires_at" structs:"expires_at" mapstructure:"expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" structs:"created_at" mapstructure:"created_at"`
+	EntityID    string     `json:"entity_id" structs:"entity_id" mapstructure:"entity_id"`
+	RoleName    string     `json:"role_name" structs:"role_name" mapstructure:"role_name"`
+	Revoked     bool       `json:"revoked" structs:"revoked" mapstructure:"revoked"`
+	RevokedAt   *time.Time `json:"revoked_at" structs:"revoked_at" mapstructure:"revoked_at,omitempty"`
+
+	// Username is the bot user of the token, if it was looked up when the token was issued
+	Username string `json:"username,omitempty" structs:"username" mapstructure:"username"`
+}
+
+func newTokenInventoryEntry(pat *PAT, baseTokenStorage *BaseTokenStorageEntry, roleName, entityID string) *TokenInventoryEntry {
+	entry := &TokenInventoryEntry{
+		TokenID:     pat.ID,
+		ProjectID:   baseTokenStorage.ID,
+		Name:        pat.Name,
+		Scopes:      pat.Scopes,
+		AccessLevel: int(pat.AccessLevel),
+		TokenType:   baseTokenStorage.tokenType(),
+		CreatedAt:   time.Now().UTC(),
+		EntityID:    entityID,
+		RoleName:    roleName,
+	}
+	if pat.CreatedAt != nil {
+		entry.CreatedAt = pat.CreatedAt.UTC()
+	}
+	if pat.ExpiresAt != nil {
+		expiresAt := time.Time(*pat.ExpiresAt)
+		entry.ExpiresAt = &expiresAt
+	}
+	return entry
+}
+
+// status reports whether the token is active, expired or revoked at the given time
+func (entry *TokenInventoryEntry) status(now time.Time) string {
+	if entry.Revoked {
+		return tokenStatusRevoked
+	}
+	if entry.ExpiresAt != nil && !now.Before(*entry.ExpiresAt) {
+		return tokenStatusExpired
+	}
+	return tokenStatusActive
+}
+
+// prunable reports whether the entry has been inactive for longer than the retention period
+func (entry *TokenInventoryEntry) prunable(now time.Time, retention time.Duration) bool {
+	switch {
+	case entry.Revoked && entry.RevokedAt != nil:
+		return now.After(entry.RevokedAt.Add(retention))
+	case entry.ExpiresAt != nil:
+		return now.After(entry.ExpiresAt.Add(retention))
+	default:
+		return false
+	}
+}
+
+// save saves an inventory entry to storage
+func (entry *TokenInventoryEntry) save(ctx context.Context, storage logical.Storage) error {
+	entry.Version = storageToken.version()
+	e, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%d", pathPatternTokens, entry.TokenID), entry)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, e)
+}
+
+// getTokenInventoryEntry fetches an inventory entry from the storage
+func getTokenInventoryEntry(ctx context.Context, storage logical.Storage, tokenID int) (*TokenInventoryEntry, error) {
+	var result TokenInventoryEntry
+	if entry, err := storage.Get(ctx, fmt.Sprintf("%s/%d", pathPatternTokens, tokenID)); err != nil {
+		return nil, err
+	} else if entry == nil {
+		return nil, nil
+	} else if _, err := storageToken.decode(entry, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// deleteTokenInventoryEntry removes an inventory entry from storage
+func deleteTokenInventoryEntry(ctx context.Context, storage logical.Storage, tokenID int) error {
+	return storage.Delete(ctx, fmt.Sprintf("%s/%d", pathPatternTokens, tokenID))
+}
+
+// listTokenInventoryEntries gets the IDs of all recorded tokens
+func listTokenInventoryEntries(ctx context.Context, storage logical.Storage) ([]string, error) {
+	tokens, err := storage.List(ctx, fmt.Sprintf("%s/", pathPatternTokens))
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// tokenType returns the type of the recorded token. Entries recorded before group access tokens were
+// supported have no type and are project access tokens.
+func (entry *TokenInventoryEntry) tokenType() string {
+	if entry.TokenType == "" {
+		return tokenTypeProject
+	}
+	return entry.TokenType
+}
+
+// roleIndexKey is the key of the entry indexing the token for its role
+func roleIndexKey(roleName string, tokenID int) string {
+	return fmt.Sprintf("%s/%s/%d", pathPatternTokensByRole, roleName, tokenID)
+}
+
+// indexByRole adds the entry to the index of the tokens of its role. Tokens issued without a role are not indexed.
+func (entry *TokenInventoryEntry) indexByRole(ctx context.Context, storage logical.Storage) error {
+	if entry.RoleName == "" {
+		return nil
+	}
+	return storage.Put(ctx, &logical.StorageEntry{Key: roleIndexKey(entry.RoleName, entry.TokenID)})
+}
+
+// findRoleActiveTokens returns the inventory entries of the active tokens issued for a role
+func findRoleActiveTokens(ctx context.Context, storage logical.Storage, roleName string) ([]*TokenInventoryEntry, error) {
+	ids, err := storage.List(ctx, fmt.Sprintf("%s/%s/", pathPatternTokensByRole, roleName))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var entries []*TokenInventoryEntry
+	for _, idRaw := range ids {
+		id, err := strconv.Atoi(idRaw)
+		if err != nil {
+			continue
+		}
+		entry, err := getTokenInventoryEntry(ctx, storage, id)
+		if err != nil {
+			return nil, err
+		}
+		// the index is only pruned with the inventory, and a role may have been recreated since
+		if entry == nil || entry.RoleName != roleName || entry.status(now) != tokenStatusActive {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// indexTokenInventory adds the active tokens of roles missing from the role index, such as tokens recorded
+// before the index existed
+func (b *GitlabBackend) indexTokenInventory(ctx context.Context, storage logical.Storage) error {
+	ids, err := listTokenInventoryEntries(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	indexed := 0
+	for _, idRaw := range ids {
+		id, err := strconv.Atoi(idRaw)
+		if err != nil {
+			continue
+		}
+		entry, err := getTokenInventoryEntry(ctx, storage, id)
+		if err != nil {
+			return err
+		}
+		if entry == nil || entry.RoleName == "" || entry.status(now) != tokenStatusActive {
+			continue
+		}
+		if existing, err := storage.Get(ctx, roleIndexKey(entry.RoleName, id)); err != nil {
+			return err
+		} else if existing != nil {
+			continue
+		}
+		if err := entry.indexByRole(ctx, storage); err != nil {
+			return err
+		}
+		indexed++
+	}
+	if indexed > 0 {
+		b.Logger().Info("indexed tokens by role", "count", indexed)
+	}
+	return nil
+}
+
+// recordIssuedToken adds a newly issued token to the inventory, along with the username of its bot user if
+// it is known
+func (b *GitlabBackend) recordIssuedToken(ctx context.Context, req *logical.Request, pat *PAT, baseTokenStorage *BaseTokenStorageEntry,
+	roleName, username string) error {
+	entry := newTokenInventoryEntry(pat, baseTokenStorage, roleName, req.EntityID)
+	entry.Username = username
+	if err := entry.save(ctx, req.Storage); err != nil {
+		b.requestLogger(req, "role_name", roleName).Error("failed to record issued token", "token_id", pat.ID, "error", err)
+		return err
+	}
+	if err := entry.indexByRole(ctx, req.Storage); err != nil {
+		b.requestLogger(req, "role_name", roleName).Error("failed to index issued token by role", "token_id", pat.ID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// pruneTokenInventory removes entries that have been revoked or expired for longer than the retention period
+func (b *GitlabBackend) pruneTokenInventory(ctx context.Context, storage logical.Storage) error {
+	config, err := getConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+	retention := defaultInventoryRetention
+	if config != nil && config.InventoryRetention > 0 {
+		retention = config.InventoryRetention
+	}
+
+	ids, err := listTokenInventoryEntries(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, idRaw := range ids {
+		id, err := strconv.Atoi(idRaw)
+		if err != nil {
+			continue
+		}
+		entry, err := getTokenInventoryEntry(ctx, storage, id)
+		if err != nil {
+			return err
+		}
+		if entry == nil || !entry.prunable(now, retention) {
+			continue
+		}
+		if entry.RoleName != "" {
+			if err := storage.Delete(ctx, roleIndexKey(entry.RoleName, id)); err != nil {
+				return err
+			}
+		}
+		if err := deleteTokenInventoryEntry(ctx, storage, id); err != nil {
+			return err
+		}
+		b.Logger().Debug("pruned token from inventory", "token_id", id)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ttlPolicyReject rejects a request whose TTL exceeds a maximum
+	ttlPolicyReject = "reject"
+	// ttlPolicyClamp lowers a TTL that exceeds a maximum to that maximum and warns about it
+	ttlPolicyClamp = "clamp"
+)
+
+func validateTTLPolicy(policy string) error {
+	switch policy {
+	case ttlPolicyReject, ttlPolicyClamp:
+		return nil
+	default:
+		return fmt.Errorf("ttl policy '%s' is not supported", policy)
+	}
+}
+
+// ttlLimits holds the inputs of the TTL resolution. A zero value means unset.
+type ttlLimits struct {
+	Requested   time.Duration
+	RoleDefault time.Duration
+	RoleMax     time.Duration
+	MountMax    time.Duration
+	Policy      string
+}
+
+func (c *ConfigStorageEntry) ttlLimits() ttlLimits {
+	limits := ttlLimits{
+		Policy: ttlPolicyReject,
+	}
+	if c != nil {
+		limits.MountMax = c.MaxTTL
+		if c.TTLPolicy != "" {
+			limits.Policy = c.TTLPolicy
+		}
+	}
+	return limits
+}
+
+// resolve returns the TTL of a token to issue, 0 meaning the token never expires. The requested TTL
+// is used if set, the role default otherwise. The result is then checked against the role maximum and
+// the mount maximum in turn; a maximum also applies when nothing else sets a TTL. A TTL beyond a
+// maximum is clamped with a warning or rejected, depending on the policy.
+func (limits ttlLimits) resolve() (time.Duration, []string, error) {
+	var warnings []string
+
+	ttl := limits.Requested
+	if ttl <= 0 {
+		ttl = limits.RoleDefault
+	}
+
+	maximums := []struct {
+		name string
+		max  time.Duration
+	}{
+		{name: "role max_ttl", max: limits.RoleMax},
+		{name: "max_ttl", max: limits.MountMax},
+	}
+	for _, m := range maximums {
+		if m.max <= 0 {
+			continue
+		}
+		if ttl <= 0 {
+			ttl = m.max
+			continue
+		}
+		if ttl <= m.max {
+			continue
+		}
+		if limits.Policy == ttlPolicyClamp {
+			warnings = append(warnings, fmt.Sprintf("Requested token ttl '%v' exceeds configured %s of '%v's. It is clamped to '%v'",
+				ttl, m.name, int64(m.max/time.Second), m.max))
+			ttl = m.max
+			continue
+		}
+		return 0, nil, fmt.Errorf("requested token ttl '%v' exceeds configured maximum ttl of '%v's (%s)",
+			ttl, int64(m.max/time.Second), m.name)
+	}
+
+	return ttl, warnings, nil
+}
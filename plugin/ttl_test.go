@@ -0,0 +1,95 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveTTL(t *testing.T) {
+	t.Parallel()
+
+	day := 24 * time.Hour
+	tests := []struct {
+		name     string
+		limits   ttlLimits
+		expected time.Duration
+		warnings int
+		err      bool
+	}{
+		{
+			name:     "nothing set never expires",
+			limits:   ttlLimits{Policy: ttlPolicyReject},
+			expected: 0,
+		},
+		{
+			name:     "role default",
+			limits:   ttlLimits{RoleDefault: day, MountMax: 7 * day, Policy: ttlPolicyReject},
+			expected: day,
+		},
+		{
+			name:     "request overrides role default",
+			limits:   ttlLimits{Requested: 2 * day, RoleDefault: day, MountMax: 7 * day, Policy: ttlPolicyReject},
+			expected: 2 * day,
+		},
+		{
+			name:     "mount max applies when nothing is set",
+			limits:   ttlLimits{MountMax: 7 * day, Policy: ttlPolicyReject},
+			expected: 7 * day,
+		},
+		{
+			name:   "role max rejects",
+			limits: ttlLimits{Requested: 3 * day, RoleMax: 2 * day, Policy: ttlPolicyReject},
+			err:    true,
+		},
+		{
+			name:   "mount max rejects",
+			limits: ttlLimits{RoleDefault: 3 * day, MountMax: 2 * day, Policy: ttlPolicyReject},
+			err:    true,
+		},
+		{
+			name:     "role max clamps",
+			limits:   ttlLimits{Requested: 3 * day, RoleMax: 2 * day, MountMax: 7 * day, Policy: ttlPolicyClamp},
+			expected: 2 * day,
+			warnings: 1,
+		},
+		{
+			name:     "role and mount max clamp in turn",
+			limits:   ttlLimits{Requested: 5 * day, RoleMax: 3 * day, MountMax: 2 * day, Policy: ttlPolicyClamp},
+			expected: 2 * day,
+			warnings: 2,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture range var
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			ttl, warnings, err := test.limits.resolve()
+			if test.err {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "exceeds configured maximum ttl")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, ttl)
+			assert.Len(t, warnings, test.warnings)
+		})
+	}
+}
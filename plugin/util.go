@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 )
@@ -38,6 +39,86 @@ func validateScopes(scopes []string) error {
 	return err.ErrorOrNil()
 }
 
+// parseAccessLevel accepts an access level as a name such as "developer" or as a number such as "30".
+// An empty string is the zero value, which lets Gitlab pick its default.
+func parseAccessLevel(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	if level, err := strconv.Atoi(s); err == nil {
+		return level, nil
+	}
+	for level, name := range accessLevelNames {
+		if name == s {
+			return level, nil
+		}
+	}
+	return accessLevelInvalid, fmt.Errorf("%w '%s'", errInvalidAccessLevel, s)
+}
+
+// accessLevelName returns the name of an access level, or an empty string for an unknown level
+func accessLevelName(level int) string {
+	return accessLevelNames[level]
+}
+
+// accessLevelDisplayName returns the access level as Gitlab shows it, such as "Maintainer"
+func accessLevelDisplayName(level int) string {
+	name := accessLevelName(level)
+	if name == "" {
+		return fmt.Sprintf("access level %d", level)
+	}
+	return strings.ToUpper(name[:1]) + strings.ReplaceAll(name[1:], "_", " ")
+}
+
+// requiredAccessLevel returns the access level the backend identity needs to create a token with the given
+// access level. Creating access tokens requires Maintainer, and Gitlab does not allow granting a higher access
+// level than the backend identity holds.
+func requiredAccessLevel(level int) int {
+	if level > accessLevelMaintainer {
+		return level
+	}
+	return accessLevelMaintainer
+}
+
+// validateAccessLevel checks that tokens of the type can be created with the access level. The error echoes
+// input, the access level as the user gave it, or the level itself if input is empty, and lists the allowed
+// levels.
+func validateAccessLevel(tokenType string, level int, input string) error {
+	if level == 0 {
+		return nil
+	}
+	for _, allowed := range allowedAccessLevels[tokenType] {
+		if level == allowed {
+			return nil
+		}
+	}
+	if input == "" {
+		input = strconv.Itoa(level)
+	}
+	return fmt.Errorf("%w '%s' for %s access tokens, allowed levels are %s",
+		errInvalidAccessLevel, strings.TrimSpace(input), tokenType, allowedAccessLevelList(tokenType))
+}
+
+// allowedAccessLevelList lists the access levels allowed for the token type by name and number, such as
+// "guest (10), reporter (20)"
+func allowedAccessLevelList(tokenType string) string {
+	levels := make([]string, 0, len(allowedAccessLevels[tokenType]))
+	for _, level := range allowedAccessLevels[tokenType] {
+		levels = append(levels, fmt.Sprintf("%s (%d)", accessLevelName(level), level))
+	}
+	return strings.Join(levels, ", ")
+}
+
+func validateTokenType(tokenType string) error {
+	switch tokenType {
+	case tokenTypeProject, tokenTypeGroup:
+		return nil
+	default:
+		return fmt.Errorf("token type '%s' is not supported", tokenType)
+	}
+}
+
 func envOrDefault(key, d string) string {
 	env := os.Getenv(key)
 	if env == "" {
@@ -48,3 +48,54 @@ func TestValidateScopes(t *testing.T) {
 		assert.Contains(t, err.Error(), "scope 'something' is not allowed")
 	})
 }
+
+func TestParseAccessLevel(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected int
+		err      bool
+	}{
+		{input: "", expected: 0},
+		{input: "30", expected: accessLevelDeveloper},
+		{input: "developer", expected: accessLevelDeveloper},
+		{input: " Owner ", expected: accessLevelOwner},
+		{input: "minimal_access", expected: accessLevelMinimalAccess},
+		{input: "planner", expected: accessLevelPlanner},
+		{input: "superuser", expected: accessLevelInvalid, err: true},
+	}
+
+	for _, test := range tests {
+		level, err := parseAccessLevel(test.input)
+		if test.err {
+			assert.ErrorIs(t, err, errInvalidAccessLevel, "input %q", test.input)
+		} else {
+			assert.NoError(t, err, "input %q", test.input)
+		}
+		assert.Equal(t, test.expected, level, "input %q", test.input)
+	}
+}
+
+func TestValidateAccessLevel(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, validateAccessLevel(tokenTypeProject, 0, ""))
+	assert.NoError(t, validateAccessLevel(tokenTypeProject, accessLevelOwner, "owner"))
+	assert.NoError(t, validateAccessLevel(tokenTypeProject, accessLevelPlanner, "15"))
+	assert.NoError(t, validateAccessLevel(tokenTypeGroup, accessLevelMinimalAccess, "minimal_access"))
+
+	err := validateAccessLevel(tokenTypeProject, accessLevelMinimalAccess, "minimal_access")
+	assert.ErrorIs(t, err, errInvalidAccessLevel)
+	assert.EqualError(t, err, "invalid access level 'minimal_access' for project access tokens, allowed levels are "+
+		"guest (10), planner (15), reporter (20), developer (30), maintainer (40), owner (50)")
+
+	err = validateAccessLevel(tokenTypeProject, 31, "")
+	assert.ErrorIs(t, err, errInvalidAccessLevel)
+	assert.Contains(t, err.Error(), "invalid access level '31' for project access tokens")
+
+	err = validateAccessLevel(tokenTypeGroup, accessLevelInvalid, " superuser ")
+	assert.ErrorIs(t, err, errInvalidAccessLevel)
+	assert.EqualError(t, err, "invalid access level 'superuser' for group access tokens, allowed levels are "+
+		"minimal_access (5), guest (10), planner (15), reporter (20), developer (30), maintainer (40), owner (50)")
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// tokenTargetVerification is the outcome of checking a role against Gitlab. Problems prevent tokens from being
+// created, while Unknown lists what could not be checked.
+type tokenTargetVerification struct {
+	Problems *multierror.Error
+	Unknown  []string
+}
+
+// detail reports the verification as "verified", or "unknown" with what could not be checked
+func (v *tokenTargetVerification) detail() map[string]interface{} {
+	if len(v.Unknown) == 0 {
+		return map[string]interface{}{"status": "verified"}
+	}
+	return map[string]interface{}{"status": "unknown", "unknown": v.Unknown}
+}
+
+// verifyTokenTarget checks against Gitlab that the backend identity can create the tokens described by
+// base, and returns a failure to query Gitlab as error. Tokens created by impersonating users need an
+// administrator backend identity, and the permissions of the impersonated users are only checked when a
+// token is issued.
+//
+// Gitlab does not expose the group setting that disables access token creation, so it is reported as unknown.
+func verifyTokenTarget(gc Client, base *BaseTokenStorageEntry, impersonates bool) (*tokenTargetVerification, error) {
+	target := base.target()
+	access, err := gc.GetTargetAccess(target.tokenType(), target.ID)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Kind() == ErrorKindNotFound {
+		return &tokenTargetVerification{
+			Problems: multierror.Append(nil, fmt.Errorf("%s does not exist or is not visible to the backend token", target.describe())),
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := &tokenTargetVerification{}
+	if !access.AccessTokensAvailable {
+		v.Problems = multierror.Append(v.Problems, fmt.Errorf("%s access tokens are not available on %s (%s)",
+			target.tokenType(), target.describe(), access.Path))
+	}
+	switch {
+	case access.Admin:
+	case impersonates:
+		v.Problems = multierror.Append(v.Problems, errors.New("backend token is not an administrator, which Gitlab requires to create tokens as another user"))
+	case access.AccessLevel < requiredAccessLevel(base.AccessLevel):
+		has := "no access"
+		if access.AccessLevel > 0 {
+			has = accessLevelDisplayName(access.AccessLevel)
+		}
+		v.Problems = multierror.Append(v.Problems, fmt.Errorf("backend token lacks %s on %s (%s), it has %s",
+			accessLevelDisplayName(requiredAccessLevel(base.AccessLevel)), target.describe(), access.Path, has))
+	}
+	if v.Problems == nil {
+		v.Unknown = append(v.Unknown, fmt.Sprintf("whether a group setting disables %s access token creation on %s (%s)",
+			target.tokenType(), target.describe(), access.Path))
+	}
+	return v, nil
+}
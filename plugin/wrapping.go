@@ -0,0 +1,63 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/wrapping"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// requestWrapTTL returns the TTL the request asks its response to be wrapped with, 0 if it is not wrapped
+func requestWrapTTL(req *logical.Request) time.Duration {
+	if req.WrapInfo == nil {
+		return 0
+	}
+	return req.WrapInfo.TTL
+}
+
+// responseWrapping checks the request against the response wrapping settings of the role, and returns
+// the wrapping the backend applies to the response, nil when it is left to the request. A role with
+// require_response_wrapping refuses requests that do not ask for wrapping, and a wrap_ttl caps the wrap
+// TTL requests may ask for. Otherwise, a role with a wrap_ttl wraps responses to unwrapped requests.
+func (role *RoleStorageEntry) responseWrapping(req *logical.Request) (*wrapping.ResponseWrapInfo, error) {
+	requested := requestWrapTTL(req)
+	if requested == 0 {
+		if role.RequireResponseWrapping {
+			return nil, fmt.Errorf("role '%s' requires the response to be wrapped, request it with a wrap TTL", role.RoleName)
+		}
+		if role.WrapTTL > 0 {
+			return &wrapping.ResponseWrapInfo{TTL: role.WrapTTL}, nil
+		}
+		return nil, nil
+	}
+	if role.WrapTTL > 0 && requested > role.WrapTTL {
+		return nil, fmt.Errorf("requested wrap TTL '%v' exceeds the wrap_ttl '%v' of role '%s'", requested, role.WrapTTL, role.RoleName)
+	}
+	return nil, nil
+}
+
+// minimalTokenDetails returns only the token and its expiry, for responses that should not carry anything else
+func minimalTokenDetails(pat *PAT) map[string]interface{} {
+	d := map[string]interface{}{
+		"token": pat.Token,
+	}
+	if pat.ExpiresAt != nil {
+		d["expires_at"] = time.Time(*pat.ExpiresAt)
+	}
+	return d
+}
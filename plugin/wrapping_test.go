@@ -0,0 +1,124 @@
+// Copyright 2021 Splunk Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlabtoken
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleResponseWrapping(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabFakeEnv(t)
+	storage := req.Storage
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	mustRoleCreate(t, backend, storage, "wrapped", map[string]interface{}{
+		"id":                        1,
+		"name":                      "app-ci",
+		"scopes":                    "read_api",
+		"require_response_wrapping": true,
+		"wrap_ttl":                  "5m",
+	})
+	mustRoleCreate(t, backend, storage, "default-wrap", map[string]interface{}{
+		"id":       1,
+		"name":     "app-ci",
+		"scopes":   "read_api",
+		"wrap_ttl": 60,
+	})
+
+	issue := func(roleName string, wrapTTL time.Duration) (*logical.Response, error) {
+		t.Helper()
+		req := &logical.Request{Storage: storage}
+		if wrapTTL > 0 {
+			req.WrapInfo = &logical.RequestWrapInfo{TTL: wrapTTL}
+		}
+		return testIssueRoleToken(t, backend, req, roleName, nil)
+	}
+
+	t.Run("unwrapped requests are refused before calling Gitlab", func(t *testing.T) {
+		requests := fg.requestCount()
+		resp, err := issue("wrapped", 0)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "role 'wrapped' requires the response to be wrapped")
+		assert.Equal(t, requests, fg.requestCount())
+		assert.Empty(t, fg.activeTokens(tokenTypeProject, 1))
+	})
+
+	t.Run("wrapped requests are served within the wrap TTL", func(t *testing.T) {
+		resp, err := issue("wrapped", time.Minute)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.Nil(t, resp.WrapInfo, "wrapping is left to the request")
+		assert.NotEmpty(t, resp.Data["token"])
+
+		resp, err = issue("wrapped", time.Hour)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		assert.Contains(t, resp.Error().Error(), "exceeds the wrap_ttl '5m0s'")
+	})
+
+	t.Run("responses to unwrapped requests are wrapped with the wrap TTL", func(t *testing.T) {
+		resp, err := issue("default-wrap", 0)
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		require.NotNil(t, resp.WrapInfo)
+		assert.Equal(t, time.Minute, resp.WrapInfo.TTL)
+	})
+
+	t.Run("the role reports its wrapping settings", func(t *testing.T) {
+		resp, err := testRoleRead(t, backend, storage, "wrapped")
+		require.NoError(t, err)
+		assert.Equal(t, true, resp.Data["require_response_wrapping"])
+		assert.Equal(t, int64(300), resp.Data["wrap_ttl"])
+	})
+}
+
+func TestRoleTokenMinimal(t *testing.T) {
+	t.Parallel()
+
+	req, backend, fg := newGitlabFakeEnv(t)
+	storage := req.Storage
+	fg.addProject(1, "team/app", accessLevelMaintainer)
+	mustRoleCreate(t, backend, storage, "app", map[string]interface{}{
+		"id":           1,
+		"name":         "app-ci",
+		"scopes":       "read_api",
+		"reuse_tokens": true,
+	})
+
+	for _, reused := range []bool{false, true} {
+		resp, err := testIssueRoleToken(t, backend, &logical.Request{Storage: storage, EntityID: "entity-1"}, "app",
+			map[string]interface{}{"minimal": true})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "unexpected error: %v", resp.Error())
+		assert.ElementsMatch(t, []string{"token", "expires_at"}, dataKeys(resp.Data), "reused %v", reused)
+	}
+	assert.Len(t, fg.activeTokens(tokenTypeProject, 1), 1)
+}
+
+// dataKeys returns the keys of the response data
+func dataKeys(data map[string]interface{}) []string {
+	var keys []string
+	for key := range data {
+		keys = append(keys, key)
+	}
+	return keys
+}